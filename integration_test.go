@@ -58,7 +58,7 @@ Hello {{name}}!
 	}
 
 	// Merge variables
-	envVars := template.GetEnvVariables()
+	envVars, _ := template.GetEnvVariables()
 	cliVars := map[string]string{"cli": "value"}
 	allVars := template.MergeVariables(cfg.Variables, envVars, cliVars)
 
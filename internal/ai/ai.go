@@ -2,14 +2,24 @@ package ai
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
-	aiplatform "cloud.google.com/go/aiplatform/apiv1"
-	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
 	"air/internal/config"
 	"air/internal/schema"
 	"air/internal/util"
+	"air/internal/warnings"
+	aiplatform "cloud.google.com/go/aiplatform/apiv1"
+	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	aiplatformbeta "cloud.google.com/go/aiplatform/apiv1beta1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Response represents the AI response with metadata
@@ -18,22 +28,366 @@ type Response struct {
 	InputTokens  int32
 	OutputTokens int32
 	TotalTokens  int32
+
+	// SafetyRatings holds the safety ratings of each response candidate, in
+	// candidate order.
+	SafetyRatings [][]SafetyRating
+
+	// Files holds the inline data parts of the response, such as images, in
+	// response order.
+	Files []File
+
+	// FinishReason is why the model stopped generating the first candidate.
+	FinishReason aiplatformpb.Candidate_FinishReason
+
+	// Citations lists the sources the first candidate cites, in order and
+	// without duplicates.
+	Citations []Citation
+
+	// Source tells where the response came from when it was not generated
+	// by the model for this request, e.g. SourceReplay. It is empty for live
+	// calls.
+	Source string
+}
+
+// Citation is a source quoted or used by a response.
+type Citation struct {
+	Title   string
+	URI     string
+	License string
+}
+
+// File is binary data returned inline in a response.
+type File struct {
+	MimeType string
+	Data     []byte
+}
+
+// EmptyResponseError reports a response without any content. Blocked is set
+// when the prompt or the response was blocked, e.g. by safety filters, rather
+// than lost to a transient problem.
+type EmptyResponseError struct {
+	Reason  string
+	Blocked bool
+}
+
+func (e *EmptyResponseError) Error() string {
+	return e.Reason
+}
+
+// SourceReplay marks responses read from a --replay file.
+const SourceReplay = "replay"
+
+// SafetyRating is the model's assessment of one harm category for a candidate.
+type SafetyRating struct {
+	Category    aiplatformpb.HarmCategory
+	Probability aiplatformpb.SafetyRating_HarmProbability
+	Blocked     bool
+}
+
+// CategoryName returns the friendly name of a harm category, such as
+// hate_speech.
+func CategoryName(category aiplatformpb.HarmCategory) string {
+	return strings.ToLower(strings.TrimPrefix(category.String(), "HARM_CATEGORY_"))
+}
+
+// WarnSafetyRatings adds a warning for every rating at or above level, to
+// surface near misses that were not blocked.
+func WarnSafetyRatings(ctx context.Context, ratings [][]SafetyRating, level aiplatformpb.SafetyRating_HarmProbability) {
+	for i, candidate := range ratings {
+		for _, r := range candidate {
+			if r.Probability >= level {
+				warnings.FromContext(ctx).Add("candidate %d rated %s probability of %s (at or above %s)", i, r.Probability, CategoryName(r.Category), level)
+			}
+		}
+	}
+}
+
+// ProgressFunc receives the (possibly estimated) number of output tokens
+// generated so far while a response is streamed.
+type ProgressFunc func(outputTokens int32)
+
+// CallFunc sends a prompt to the model. CallVertexAI is the real
+// implementation.
+type CallFunc func(ctx context.Context, cfg config.Config, prompt string) (*Response, error)
+
+// CountFunc returns the number of input tokens prompt would use. CountTokens
+// is the real implementation.
+type CountFunc func(ctx context.Context, cfg config.Config, prompt string) (int32, error)
+
+// charsPerToken is the common rule of thumb for Gemini tokenization, used
+// where no exact count is available.
+const charsPerToken = 4
+
+// EstimateTokens estimates the number of tokens in text locally, without
+// calling the model. It is only a rough guide; CountTokens is exact.
+func EstimateTokens(text string) int32 {
+	return int32((utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken)
+}
+
+type progressKey struct{}
+
+type locationKey struct{}
+
+// WithProgress returns a context that makes CallVertexAI report streaming
+// progress to fn.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFromContext(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
 }
 
 func ModelPath(projectID, location, model string) string {
 	return fmt.Sprintf("projects/%s/locations/%s/publishers/google/models/%s", projectID, location, model)
 }
 
-func loadEnvironment() (projectID, location string, err error) {
-	projectID = os.Getenv("GOOGLE_CLOUD_PROJECT")
+// Location returns the Vertex AI location requests are sent to.
+func Location() string {
+	return util.GetEnvOrDefault("GOOGLE_CLOUD_LOCATION", config.DefaultLocation)
+}
+
+// WithLocation returns a context that makes CallVertexAI send the request to
+// location instead of the configured one.
+func WithLocation(ctx context.Context, location string) context.Context {
+	return context.WithValue(ctx, locationKey{}, location)
+}
+
+// LocationFromContext returns the location set by WithLocation, or Location()
+// when none is set.
+func LocationFromContext(ctx context.Context) string {
+	if location, ok := ctx.Value(locationKey{}).(string); ok {
+		return location
+	}
+	return Location()
+}
+
+type projectKey struct{}
+
+// Project returns the Google Cloud project requests are sent to.
+func Project() string {
+	return os.Getenv("GOOGLE_CLOUD_PROJECT")
+}
+
+// WithProject returns a context that makes CallVertexAI send the request to
+// project instead of the configured one.
+func WithProject(ctx context.Context, project string) context.Context {
+	return context.WithValue(ctx, projectKey{}, project)
+}
+
+// ProjectFromContext returns the project set by WithProject, or Project()
+// when none is set.
+func ProjectFromContext(ctx context.Context) string {
+	if project, ok := ctx.Value(projectKey{}).(string); ok {
+		return project
+	}
+	return Project()
+}
+
+// IsRegionError reports whether err indicates that the location is out of
+// capacity or unavailable, so the request may succeed elsewhere.
+func IsRegionError(err error) bool {
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable:
+		return true
+	}
+	return false
+}
+
+// WithRegionFallback wraps call so that a region error retries the request in
+// each of the fallback locations in turn. The first attempt uses the location
+// of the context.
+func WithRegionFallback(call CallFunc, fallbacks []string) CallFunc {
+	if len(fallbacks) == 0 {
+		return call
+	}
+	return func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+		location := LocationFromContext(ctx)
+		response, err := call(ctx, cfg, prompt)
+		for _, next := range fallbacks {
+			if err == nil || !IsRegionError(err) {
+				break
+			}
+			warnings.FromContext(ctx).Add("location %s failed, retrying in %s: %v", location, next, err)
+			location = next
+			response, err = call(WithLocation(ctx, location), cfg, prompt)
+		}
+		return response, err
+	}
+}
+
+// truncatedOutputTokens is the output size below which a MAX_TOKENS finish is
+// treated as a hiccup rather than a long response that hit the limit.
+const truncatedOutputTokens = 16
+
+// isBlockedFinish reports whether the finish reason means the response was
+// withheld by a filter, which a retry would not change.
+func isBlockedFinish(reason aiplatformpb.Candidate_FinishReason) bool {
+	switch reason {
+	case aiplatformpb.Candidate_SAFETY, aiplatformpb.Candidate_RECITATION, aiplatformpb.Candidate_BLOCKLIST,
+		aiplatformpb.Candidate_PROHIBITED_CONTENT, aiplatformpb.Candidate_SPII:
+		return true
+	}
+	return false
+}
+
+// emptyOrTruncated describes why the result of a call is worth retrying: an
+// empty response that was not blocked, or a MAX_TOKENS finish with almost no
+// output. It returns "" otherwise.
+func emptyOrTruncated(cfg config.Config, response *Response, err error) string {
+	var emptyErr *EmptyResponseError
+	if errors.As(err, &emptyErr) {
+		if emptyErr.Blocked {
+			return ""
+		}
+		return emptyErr.Reason
+	}
+	if err != nil || isBlockedFinish(response.FinishReason) {
+		return ""
+	}
+	if strings.TrimSpace(response.Text) == "" && len(response.Files) == 0 {
+		return "empty response"
+	}
+	if response.FinishReason == aiplatformpb.Candidate_MAX_TOKENS && response.OutputTokens < min(truncatedOutputTokens, cfg.MaxTokensOrDefault()) {
+		return fmt.Sprintf("response truncated after %d output tokens", response.OutputTokens)
+	}
+	return ""
+}
+
+// WithEmptyRetry wraps call so that an empty or truncated response is retried
+// once. Responses blocked by safety or other filters are not retried.
+func WithEmptyRetry(call CallFunc) CallFunc {
+	return func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+		response, err := call(ctx, cfg, prompt)
+		if reason := emptyOrTruncated(cfg, response, err); reason != "" {
+			warnings.FromContext(ctx).Add("%s, retrying once", reason)
+			response, err = call(ctx, cfg, prompt)
+		}
+		return response, err
+	}
+}
+
+// DefaultMaxContinuations is how many times WithContinuation asks for more of
+// a response by default.
+const DefaultMaxContinuations = 5
+
+// continuePrompt asks the model to carry on with a response cut off by the
+// token limit.
+const continuePrompt = "Continue exactly where your previous response stopped. Do not repeat any of it."
+
+// WithContinuation wraps call so that a response stopped by the token limit
+// is continued: the prompt and the text so far are sent as history with a
+// request to go on, and the segments are joined until the model stops on its
+// own or maxContinuations continuations were requested. Token usage is summed
+// over the segments. When a continuation fails, the error carries the text
+// received so far.
+func WithContinuation(call CallFunc, maxContinuations int) CallFunc {
+	return func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+		response, err := call(ctx, cfg, prompt)
+		if err != nil {
+			return response, err
+		}
+
+		history := append(append([]Turn(nil), HistoryFromContext(ctx)...), Turn{Role: RoleUser, Text: prompt})
+		for n := 1; response.FinishReason == aiplatformpb.Candidate_MAX_TOKENS; n++ {
+			if n > maxContinuations {
+				warnings.FromContext(ctx).Add("response still truncated after %d continuations", maxContinuations)
+				break
+			}
+
+			turns := append(history[:len(history):len(history)], Turn{Role: RoleModel, Text: response.Text})
+			next, err := call(WithHistory(ctx, turns), cfg, continuePrompt)
+			if err != nil {
+				partial := response.Text
+				var streamErr *StreamError
+				if errors.As(err, &streamErr) {
+					partial += streamErr.Partial
+				}
+				return nil, &StreamError{Partial: partial, Err: fmt.Errorf("continuation %d: %w", n, err)}
+			}
+			response = joinSegments(response, next)
+		}
+		return response, nil
+	}
+}
+
+// joinSegments appends the continuation next to response, summing the token
+// usage and collecting the citations. The finish reason and safety ratings
+// are those of the last segment.
+func joinSegments(response, next *Response) *Response {
+	joined := *response
+	joined.Text += next.Text
+	joined.InputTokens += next.InputTokens
+	joined.OutputTokens += next.OutputTokens
+	joined.TotalTokens += next.TotalTokens
+	joined.Files = append(append([]File(nil), response.Files...), next.Files...)
+	joined.FinishReason = next.FinishReason
+	joined.Citations = appendCitations(response.Citations, next.Citations)
+	if next.SafetyRatings != nil {
+		joined.SafetyRatings = next.SafetyRatings
+	}
+	return &joined
+}
+
+// appendCitations appends the citations of more that are not in citations.
+func appendCitations(citations, more []Citation) []Citation {
+	result := append([]Citation(nil), citations...)
+	for _, c := range more {
+		if !slices.Contains(result, c) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// IsStreamDeadline reports whether err is a response stream cut off by a
+// deadline after it started, as opposed to a stream that ended cleanly or
+// failed for another reason.
+func IsStreamDeadline(err error) bool {
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) {
+		return false
+	}
+	return errors.Is(streamErr.Err, context.DeadlineExceeded) || status.Code(streamErr.Err) == codes.DeadlineExceeded
+}
+
+// WithDeadlineRetry wraps call so that a response stream cut off by a deadline
+// is requested again once. It is not retried when the caller's own context
+// has expired. When the retry fails as well, the error carries the longer of
+// the two partial responses.
+func WithDeadlineRetry(call CallFunc) CallFunc {
+	return func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+		response, err := call(ctx, cfg, prompt)
+		if !IsStreamDeadline(err) || ctx.Err() != nil {
+			return response, err
+		}
+
+		var first *StreamError
+		errors.As(err, &first)
+		warnings.FromContext(ctx).Add("response stream timed out after %d characters, reconnecting", len(first.Partial))
+
+		response, err = call(ctx, cfg, prompt)
+		var second *StreamError
+		if errors.As(err, &second) && len(second.Partial) < len(first.Partial) {
+			return nil, &StreamError{Partial: first.Partial, Err: second.Err}
+		}
+		return response, err
+	}
+}
+
+func loadEnvironment(ctx context.Context) (projectID, location string, err error) {
+	projectID = ProjectFromContext(ctx)
 	if projectID == "" {
 		return "", "", fmt.Errorf("GOOGLE_CLOUD_PROJECT environment variable not set")
 	}
-	location = util.GetEnvOrDefault("GOOGLE_CLOUD_LOCATION", config.DefaultLocation)
-	return projectID, location, nil
+	return projectID, LocationFromContext(ctx), nil
 }
 
-func buildRequest(cfg config.Config, prompt, projectID, location string) (*aiplatformpb.GenerateContentRequest, error) {
+// buildRequest builds a request for Vertex AI from contents produced by
+// buildMessages.
+func buildRequest(cfg config.Config, contents []*aiplatformpb.Content, projectID, location string) (*aiplatformpb.GenerateContentRequest, error) {
 	temperature := cfg.TemperatureOrDefault()
 	topP := cfg.TopPOrDefault()
 	maxTokens := cfg.MaxTokensOrDefault()
@@ -49,15 +403,8 @@ func buildRequest(cfg config.Config, prompt, projectID, location string) (*aipla
 	// to set the protobuf GenerationConfig fields. This is intentional; in Go
 	// these locals will escape to the heap so the pointers remain valid.
 	req := &aiplatformpb.GenerateContentRequest{
-		Model: ModelPath(projectID, location, model),
-		Contents: []*aiplatformpb.Content{
-			{
-				Role: "user",
-				Parts: []*aiplatformpb.Part{
-					{Data: &aiplatformpb.Part_Text{Text: prompt}},
-				},
-			},
-		},
+		Model:    ModelPath(projectID, location, model),
+		Contents: contents,
 		GenerationConfig: &aiplatformpb.GenerationConfig{
 			Temperature:      &temperature,
 			TopP:             &topP,
@@ -67,32 +414,61 @@ func buildRequest(cfg config.Config, prompt, projectID, location string) (*aipla
 		SafetySettings: safetySettings,
 	}
 
-	if cfg.ResponseSchema != nil {
+	// topK is left to the model unless configured
+	if cfg.TopK != nil {
+		topK := float32(cfg.TopKOrDefault())
+		req.GenerationConfig.TopK = &topK
+	}
+
+	if cfg.SchemaEnabled() {
 		req.GenerationConfig.ResponseSchema = schema.ConvertSchemaToProtobuf(cfg.ResponseSchema)
 	}
 
+	if cfg.SystemInstruction != "" {
+		req.SystemInstruction = &aiplatformpb.Content{
+			Role:  "system",
+			Parts: []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: cfg.SystemInstruction}}},
+		}
+	}
+
 	return req, nil
 }
 
 func extractResponse(resp *aiplatformpb.GenerateContentResponse) (*Response, error) {
 	if len(resp.Candidates) == 0 {
-		return nil, fmt.Errorf("no response candidates")
+		blocked := resp.GetPromptFeedback().GetBlockReason() != aiplatformpb.GenerateContentResponse_PromptFeedback_BLOCKED_REASON_UNSPECIFIED
+		return nil, &EmptyResponseError{Reason: "no response candidates", Blocked: blocked}
 	}
 
 	candidate := resp.Candidates[0]
 	if candidate.Content == nil || len(candidate.Content.Parts) == 0 {
-		return nil, fmt.Errorf("empty response content")
+		return nil, &EmptyResponseError{Reason: "empty response content", Blocked: isBlockedFinish(candidate.FinishReason)}
 	}
 
-	text := candidate.Content.Parts[0].GetText()
-	if text == "" {
-		return nil, fmt.Errorf("no text in response")
+	// Text parts are concatenated; inline data parts are collected as files
+	var text strings.Builder
+	var files []File
+	for _, part := range candidate.Content.Parts {
+		switch data := part.Data.(type) {
+		case *aiplatformpb.Part_Text:
+			text.WriteString(data.Text)
+		case *aiplatformpb.Part_InlineData:
+			files = append(files, File{MimeType: data.InlineData.GetMimeType(), Data: data.InlineData.GetData()})
+		}
+	}
+	if text.Len() == 0 && len(files) == 0 {
+		return nil, &EmptyResponseError{Reason: "no text in response", Blocked: isBlockedFinish(candidate.FinishReason)}
 	}
 
 	result := &Response{
-		Text: text,
+		Text:         text.String(),
+		Files:        files,
+		FinishReason: candidate.FinishReason,
 	}
 
+	result.SafetyRatings = extractSafetyRatings(resp.Candidates)
+	result.Citations = extractCitations(candidate)
+
 	if resp.UsageMetadata != nil {
 		result.InputTokens = resp.UsageMetadata.PromptTokenCount
 		result.OutputTokens = resp.UsageMetadata.CandidatesTokenCount
@@ -102,37 +478,298 @@ func extractResponse(resp *aiplatformpb.GenerateContentResponse) (*Response, err
 	return result, nil
 }
 
-func CallVertexAI(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
-	projectID, location, err := loadEnvironment()
+// StreamError reports a response stream that failed after some text may
+// already have been received. Partial holds that text.
+type StreamError struct {
+	Partial string
+	Err     error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("receiving response stream: %v", e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// partialText returns the text received so far for the first candidate.
+func partialText(merged *aiplatformpb.GenerateContentResponse) string {
+	var text strings.Builder
+	for _, c := range merged.Candidates {
+		if c.Index != 0 || c.Content == nil {
+			continue
+		}
+		for _, part := range c.Content.Parts {
+			text.WriteString(part.GetText())
+		}
+	}
+	return text.String()
+}
+
+// contentStream is the part of the streaming GenerateContent client used to
+// receive response chunks.
+type contentStream interface {
+	Recv() (*aiplatformpb.GenerateContentResponse, error)
+}
+
+// collectStream receives all chunks of a streamed response and merges them
+// into a single response, reporting progress along the way.
+func collectStream(stream contentStream, onProgress ProgressFunc) (*Response, error) {
+	merged := &aiplatformpb.GenerateContentResponse{}
+	streamedChars := 0
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &StreamError{Partial: partialText(merged), Err: err}
+		}
+
+		streamedChars += mergeChunk(merged, chunk)
+
+		if onProgress != nil {
+			// Usage metadata is not sent with every chunk, so fall back to
+			// the common ~4 characters per token estimate.
+			outputTokens := int32(streamedChars / charsPerToken)
+			if chunk.UsageMetadata != nil && chunk.UsageMetadata.CandidatesTokenCount > 0 {
+				outputTokens = chunk.UsageMetadata.CandidatesTokenCount
+			}
+			onProgress(outputTokens)
+		}
+	}
+
+	return extractResponse(merged)
+}
+
+// mergeChunk folds a streamed chunk into merged, concatenating consecutive
+// text parts of each candidate. It returns the number of text characters the
+// chunk added.
+func mergeChunk(merged, chunk *aiplatformpb.GenerateContentResponse) int {
+	added := 0
+
+	for _, c := range chunk.Candidates {
+		var target *aiplatformpb.Candidate
+		for _, existing := range merged.Candidates {
+			if existing.Index == c.Index {
+				target = existing
+				break
+			}
+		}
+		if target == nil {
+			target = &aiplatformpb.Candidate{Index: c.Index}
+			merged.Candidates = append(merged.Candidates, target)
+		}
+
+		if c.Content != nil {
+			if target.Content == nil {
+				target.Content = &aiplatformpb.Content{Role: c.Content.Role}
+			}
+			for _, part := range c.Content.Parts {
+				text, isText := part.Data.(*aiplatformpb.Part_Text)
+				if isText {
+					added += len(text.Text)
+				}
+
+				parts := target.Content.Parts
+				if isText && len(parts) > 0 {
+					if last, ok := parts[len(parts)-1].Data.(*aiplatformpb.Part_Text); ok {
+						last.Text += text.Text
+						continue
+					}
+				}
+				target.Content.Parts = append(parts, part)
+			}
+		}
+
+		if c.FinishReason != aiplatformpb.Candidate_FINISH_REASON_UNSPECIFIED {
+			target.FinishReason = c.FinishReason
+			target.FinishMessage = c.FinishMessage
+		}
+		if len(c.SafetyRatings) > 0 {
+			target.SafetyRatings = c.SafetyRatings
+		}
+		// Chunks cite the sources of their own text, so they add up
+		if c.CitationMetadata != nil {
+			if target.CitationMetadata == nil {
+				target.CitationMetadata = &aiplatformpb.CitationMetadata{}
+			}
+			target.CitationMetadata.Citations = append(target.CitationMetadata.Citations, c.CitationMetadata.Citations...)
+		}
+	}
+
+	if chunk.UsageMetadata != nil {
+		merged.UsageMetadata = chunk.UsageMetadata
+	}
+	if chunk.PromptFeedback != nil {
+		merged.PromptFeedback = chunk.PromptFeedback
+	}
+
+	return added
+}
+
+// extractSafetyRatings returns the safety ratings of every candidate, or nil
+// when no candidate carries any.
+func extractSafetyRatings(candidates []*aiplatformpb.Candidate) [][]SafetyRating {
+	rated := false
+	all := make([][]SafetyRating, len(candidates))
+	for i, c := range candidates {
+		for _, r := range c.SafetyRatings {
+			all[i] = append(all[i], SafetyRating{
+				Category:    r.Category,
+				Probability: r.Probability,
+				Blocked:     r.Blocked,
+			})
+			rated = true
+		}
+	}
+	if !rated {
+		return nil
+	}
+	return all
+}
+
+// extractCitations returns the sources cited by candidate, skipping repeats of
+// the same source and citations without a title or URI.
+func extractCitations(candidate *aiplatformpb.Candidate) []Citation {
+	var citations []Citation
+	seen := map[Citation]bool{}
+	for _, c := range candidate.GetCitationMetadata().GetCitations() {
+		citation := Citation{Title: c.Title, URI: c.Uri, License: c.License}
+		if (citation.Title == "" && citation.URI == "") || seen[citation] {
+			continue
+		}
+		seen[citation] = true
+		citations = append(citations, citation)
+	}
+	return citations
+}
+
+// CountTokens asks the model how many input tokens prompt would use, without
+// generating anything.
+func CountTokens(ctx context.Context, cfg config.Config, prompt string) (int32, error) {
+	projectID, location, err := loadEnvironment(ctx)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	req, err := buildRequest(cfg, buildMessages(HistoryFromContext(ctx), prompt), projectID, location)
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := aiplatform.NewLlmUtilityClient(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("creating AI client: %w", err)
 	}
+	defer client.Close()
 
-	client, err := aiplatform.NewPredictionClient(ctx)
+	resp, err := client.CountTokens(ctx, &aiplatformpb.CountTokensRequest{
+		Endpoint: req.Model,
+		Model:    req.Model,
+		Contents: req.Contents,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("creating AI client: %w", err)
+		return 0, fmt.Errorf("counting tokens in %s: %w", location, err)
 	}
+	return resp.TotalTokens, nil
+}
+
+// CallVertexAI sends prompt to the model with a client created for this call
+// alone.
+func CallVertexAI(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+	var client Client
 	defer client.Close()
+	return client.Call(ctx, cfg, prompt)
+}
+
+// Client sends prompts over one prediction client, created on the first call
+// and reused until Close, so a session of many calls connects only once. The
+// zero value is ready to use.
+type Client struct {
+	mu         sync.Mutex
+	prediction *aiplatform.PredictionClient
+}
+
+func (c *Client) predictionClient(ctx context.Context) (*aiplatform.PredictionClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.prediction == nil {
+		client, err := aiplatform.NewPredictionClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating AI client: %w", err)
+		}
+		c.prediction = client
+	}
+	return c.prediction, nil
+}
+
+// Close releases the prediction client, if one was created.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.prediction == nil {
+		return nil
+	}
+	err := c.prediction.Close()
+	c.prediction = nil
+	return err
+}
 
-	req, err := buildRequest(cfg, prompt, projectID, location)
+// Call is a CallFunc sending prompt over the shared client. Requests using a
+// context cache still create their own client, as the cache needs the beta API.
+func (c *Client) Call(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+	projectID, location, err := loadEnvironment(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := client.GenerateContent(ctx, req)
+	req, err := buildRequest(cfg, buildMessages(HistoryFromContext(ctx), prompt), projectID, location)
 	if err != nil {
-		return nil, fmt.Errorf("generating content: %w", err)
+		return nil, err
+	}
+
+	var stream contentStream
+	if cachedContent := CachedContentFromContext(ctx); cachedContent != "" {
+		betaReq, err := withCachedContent(req, cachedContent)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := aiplatformbeta.NewPredictionClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating AI client: %w", err)
+		}
+		defer client.Close()
+
+		betaResp, err := client.StreamGenerateContent(ctx, betaReq)
+		if err != nil {
+			return nil, fmt.Errorf("generating content in %s: %w", location, err)
+		}
+		stream = &betaStream{stream: betaResp}
+	} else {
+		client, err := c.predictionClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err = client.StreamGenerateContent(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("generating content in %s: %w", location, err)
+		}
 	}
 
-	response, err := extractResponse(resp)
+	response, err := collectStream(stream, progressFromContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 
 	// Validate response against schema if provided (just warn, don't fail)
-	if cfg.ResponseSchema != nil {
+	if cfg.SchemaEnabled() {
 		if err := schema.ValidateResponse(response.Text, cfg.ResponseSchema); err != nil {
-			fmt.Fprintf(os.Stderr, "warning: response does not match schema: %v\n", err)
+			warnings.FromContext(ctx).Add("response does not match schema: %v", err)
 		}
 	}
 
@@ -1,11 +1,30 @@
 package ai
 
 import (
+	"air/internal/config"
 	"air/internal/util"
+	"air/internal/warnings"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	betapb "cloud.google.com/go/aiplatform/apiv1beta1/aiplatformpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestValueOrDefault(t *testing.T) {
@@ -69,6 +88,178 @@ func TestModelPath(t *testing.T) {
 	}
 }
 
+func TestBuildRequestSchema(t *testing.T) {
+	responseSchema := map[string]interface{}{"type": "object"}
+
+	tests := []struct {
+		name       string
+		cfg        config.Config
+		wantSchema bool
+	}{
+		{"no schema", config.Config{}, false},
+		{"schema with default mime type", config.Config{ResponseSchema: responseSchema}, true},
+		{"schema with text/plain", config.Config{ResponseMimeType: "text/plain", ResponseSchema: responseSchema}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := buildRequest(tt.cfg, vertexMessages(nil, "prompt"), "project", "location")
+			if err != nil {
+				t.Fatalf("buildRequest() error = %v", err)
+			}
+			if got := req.GenerationConfig.ResponseSchema != nil; got != tt.wantSchema {
+				t.Errorf("buildRequest() schema attached = %v, want %v", got, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func TestBuildRequestTopK(t *testing.T) {
+	topK := int32(40)
+
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want *float32
+	}{
+		{"not set", config.Config{}, nil},
+		{"set", config.Config{TopK: &topK}, &[]float32{40}[0]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := buildRequest(tt.cfg, vertexMessages(nil, "prompt"), "project", "location")
+			if err != nil {
+				t.Fatalf("buildRequest() error = %v", err)
+			}
+			if !reflect.DeepEqual(req.GenerationConfig.TopK, tt.want) {
+				t.Errorf("buildRequest() TopK = %v, want %v", req.GenerationConfig.TopK, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRequestSafetySettings(t *testing.T) {
+	noDefaults, defaults := true, false
+	explicit := map[string]string{"harassment": "BLOCK_ONLY_HIGH"}
+
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantLen int
+	}{
+		{"defaults", config.Config{}, 4},
+		{"noDefaultSafety", config.Config{NoDefaultSafety: &noDefaults}, 0},
+		{"noDefaultSafety false", config.Config{NoDefaultSafety: &defaults}, 4},
+		{"explicit settings win", config.Config{NoDefaultSafety: &noDefaults, SafetySettings: explicit}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := buildRequest(tt.cfg, vertexMessages(nil, "prompt"), "project", "location")
+			if err != nil {
+				t.Fatalf("buildRequest() error = %v", err)
+			}
+			if len(req.SafetySettings) != tt.wantLen {
+				t.Errorf("buildRequest() safety settings = %v, want %d", req.SafetySettings, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestBuildRequestSystemInstruction(t *testing.T) {
+	req, err := buildRequest(config.Config{}, vertexMessages(nil, "prompt"), "project", "location")
+	if err != nil {
+		t.Fatalf("buildRequest() error = %v", err)
+	}
+	if req.SystemInstruction != nil {
+		t.Errorf("buildRequest() SystemInstruction = %v, want nil without systemInstruction", req.SystemInstruction)
+	}
+
+	cfg := config.Config{SystemInstruction: "You are a concise reviewer."}
+	req, err = buildRequest(cfg, vertexMessages(nil, "prompt"), "project", "location")
+	if err != nil {
+		t.Fatalf("buildRequest() error = %v", err)
+	}
+	instruction := req.GetSystemInstruction()
+	if instruction.GetRole() != "system" || len(instruction.GetParts()) != 1 || instruction.GetParts()[0].GetText() != "You are a concise reviewer." {
+		t.Errorf("buildRequest() SystemInstruction = %v, want the system instruction text", instruction)
+	}
+	// The prompt itself stays the only user turn
+	if len(req.Contents) != 1 || req.Contents[0].GetParts()[0].GetText() != "prompt" {
+		t.Errorf("buildRequest() Contents = %v, want only the prompt", req.Contents)
+	}
+}
+
+func TestWithCachedContent(t *testing.T) {
+	req, err := buildRequest(config.Config{}, vertexMessages(nil, "question"), "project", "location")
+	if err != nil {
+		t.Fatalf("buildRequest() error = %v", err)
+	}
+
+	name := "projects/project/locations/location/cachedContents/123"
+	got, err := withCachedContent(req, name)
+	if err != nil {
+		t.Fatalf("withCachedContent() error = %v", err)
+	}
+	if got.CachedContent != name {
+		t.Errorf("withCachedContent() CachedContent = %q, want %q", got.CachedContent, name)
+	}
+	if got.Model != req.Model {
+		t.Errorf("withCachedContent() Model = %q, want %q", got.Model, req.Model)
+	}
+	if text := got.Contents[0].Parts[0].GetText(); text != "question" {
+		t.Errorf("withCachedContent() prompt = %q, want %q", text, "question")
+	}
+	if got.GenerationConfig.GetMaxOutputTokens() != req.GenerationConfig.GetMaxOutputTokens() {
+		t.Errorf("withCachedContent() MaxOutputTokens = %d, want %d", got.GenerationConfig.GetMaxOutputTokens(), req.GenerationConfig.GetMaxOutputTokens())
+	}
+}
+
+func TestVertexCacheResolve(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "project")
+	t.Setenv("GOOGLE_CLOUD_LOCATION", "europe-west1")
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	created := 0
+	cache := &VertexCache{
+		RegistryPath: filepath.Join(t.TempDir(), "cached-contents.json"),
+		create: func(ctx context.Context, parent string, content *betapb.CachedContent) (*betapb.CachedContent, error) {
+			created++
+			return &betapb.CachedContent{
+				Name:       fmt.Sprintf("%s/cachedContents/%d", parent, created),
+				Model:      content.Model,
+				Expiration: &betapb.CachedContent_ExpireTime{ExpireTime: timestamppb.New(now.Add(time.Hour))},
+			}, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	steps := []struct {
+		name     string
+		prefix   string
+		advance  time.Duration
+		wantName string
+		wantHit  bool
+	}{
+		{"first run creates", "docs", 0, "projects/project/locations/europe-west1/cachedContents/1", false},
+		{"same prefix reuses", "docs", 10 * time.Minute, "projects/project/locations/europe-west1/cachedContents/1", true},
+		{"changed prefix recreates", "new docs", 0, "projects/project/locations/europe-west1/cachedContents/2", false},
+		{"expiring soon recreates", "new docs", 58 * time.Minute, "projects/project/locations/europe-west1/cachedContents/3", false},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		name, hit, err := cache.Resolve(context.Background(), "docs", "gemini-2.0-flash-001", step.prefix)
+		if err != nil {
+			t.Fatalf("%s: Resolve() error = %v", step.name, err)
+		}
+		if name != step.wantName || hit != step.wantHit {
+			t.Errorf("%s: Resolve() = %q, %v, want %q, %v", step.name, name, hit, step.wantName, step.wantHit)
+		}
+	}
+}
+
 func TestExtractResponse(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -124,6 +315,45 @@ func TestExtractResponse(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "multiple text parts and inline data",
+			resp: &aiplatformpb.GenerateContentResponse{
+				Candidates: []*aiplatformpb.Candidate{
+					{
+						Content: &aiplatformpb.Content{
+							Parts: []*aiplatformpb.Part{
+								{Data: &aiplatformpb.Part_Text{Text: "Here is "}},
+								{Data: &aiplatformpb.Part_InlineData{InlineData: &aiplatformpb.Blob{MimeType: "image/png", Data: []byte("png")}}},
+								{Data: &aiplatformpb.Part_Text{Text: "the chart."}},
+							},
+						},
+					},
+				},
+			},
+			want: &Response{
+				Text:  "Here is the chart.",
+				Files: []File{{MimeType: "image/png", Data: []byte("png")}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "inline data only",
+			resp: &aiplatformpb.GenerateContentResponse{
+				Candidates: []*aiplatformpb.Candidate{
+					{
+						Content: &aiplatformpb.Content{
+							Parts: []*aiplatformpb.Part{
+								{Data: &aiplatformpb.Part_InlineData{InlineData: &aiplatformpb.Blob{MimeType: "audio/wav", Data: []byte("wav")}}},
+							},
+						},
+					},
+				},
+			},
+			want: &Response{
+				Files: []File{{MimeType: "audio/wav", Data: []byte("wav")}},
+			},
+			wantErr: false,
+		},
 		{
 			name:    "no candidates",
 			resp:    &aiplatformpb.GenerateContentResponse{Candidates: []*aiplatformpb.Candidate{}},
@@ -165,9 +395,568 @@ func TestExtractResponse(t *testing.T) {
 				t.Errorf("extractResponse() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !tt.wantErr && *got != *tt.want {
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("extractResponse() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
 }
+
+// fakeStream replays canned chunks, then returns err (io.EOF by default).
+type fakeStream struct {
+	chunks []*aiplatformpb.GenerateContentResponse
+	err    error
+}
+
+func (f *fakeStream) Recv() (*aiplatformpb.GenerateContentResponse, error) {
+	if len(f.chunks) == 0 {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return nil, io.EOF
+	}
+	chunk := f.chunks[0]
+	f.chunks = f.chunks[1:]
+	return chunk, nil
+}
+
+func textChunk(text string, usage *aiplatformpb.GenerateContentResponse_UsageMetadata) *aiplatformpb.GenerateContentResponse {
+	return &aiplatformpb.GenerateContentResponse{
+		Candidates: []*aiplatformpb.Candidate{
+			{
+				Content: &aiplatformpb.Content{
+					Role:  "model",
+					Parts: []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: text}}},
+				},
+			},
+		},
+		UsageMetadata: usage,
+	}
+}
+
+func TestCollectStream(t *testing.T) {
+	stream := &fakeStream{chunks: []*aiplatformpb.GenerateContentResponse{
+		textChunk("Hello, ", nil),
+		textChunk("streaming ", nil),
+		textChunk("world!", &aiplatformpb.GenerateContentResponse_UsageMetadata{
+			PromptTokenCount:     12,
+			CandidatesTokenCount: 5,
+			TotalTokenCount:      17,
+		}),
+	}}
+
+	var progress []int32
+	got, err := collectStream(stream, func(outputTokens int32) {
+		progress = append(progress, outputTokens)
+	})
+	if err != nil {
+		t.Fatalf("collectStream() error = %v", err)
+	}
+
+	want := &Response{Text: "Hello, streaming world!", InputTokens: 12, OutputTokens: 5, TotalTokens: 17}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectStream() = %+v, want %+v", got, want)
+	}
+
+	// Estimated from characters until usage metadata arrives
+	wantProgress := []int32{1, 4, 5}
+	if len(progress) != len(wantProgress) {
+		t.Fatalf("progress = %v, want %v", progress, wantProgress)
+	}
+	for i := range wantProgress {
+		if progress[i] != wantProgress[i] {
+			t.Errorf("progress[%d] = %v, want %v", i, progress[i], wantProgress[i])
+		}
+	}
+}
+
+func TestCollectStreamError(t *testing.T) {
+	stream := &fakeStream{
+		chunks: []*aiplatformpb.GenerateContentResponse{textChunk("partial", nil)},
+		err:    io.ErrUnexpectedEOF,
+	}
+
+	_, err := collectStream(stream, nil)
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) {
+		t.Fatalf("collectStream() error = %v, want a StreamError", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("collectStream() error = %v, want it to wrap the stream error", err)
+	}
+	if streamErr.Partial != "partial" {
+		t.Errorf("StreamError.Partial = %q, want %q", streamErr.Partial, "partial")
+	}
+}
+
+func TestCollectStreamErrorMidway(t *testing.T) {
+	stream := &fakeStream{
+		chunks: []*aiplatformpb.GenerateContentResponse{textChunk("Once upon ", nil), textChunk("a time", nil)},
+		err:    status.Error(codes.Unavailable, "connection reset"),
+	}
+
+	_, err := collectStream(stream, nil)
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) || streamErr.Partial != "Once upon a time" {
+		t.Fatalf("collectStream() error = %v, want a StreamError with the text so far", err)
+	}
+	if !IsRegionError(err) {
+		t.Error("IsRegionError() = false for a wrapped Unavailable stream error")
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int32
+	}{
+		{"", 0},
+		{"Hi", 1},
+		{"Hello, world", 3},
+		{"Grüße, Welt!", 3}, // characters, not bytes
+	}
+
+	for _, tt := range tests {
+		if got := EstimateTokens(tt.text); got != tt.want {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestWarnSafetyRatings(t *testing.T) {
+	ratings := [][]SafetyRating{
+		{
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HATE_SPEECH, Probability: aiplatformpb.SafetyRating_NEGLIGIBLE},
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HARASSMENT, Probability: aiplatformpb.SafetyRating_MEDIUM},
+		},
+		{
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_DANGEROUS_CONTENT, Probability: aiplatformpb.SafetyRating_LOW},
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_SEXUALLY_EXPLICIT, Probability: aiplatformpb.SafetyRating_HIGH, Blocked: true},
+		},
+	}
+
+	tests := []struct {
+		level aiplatformpb.SafetyRating_HarmProbability
+		want  []string
+	}{
+		{aiplatformpb.SafetyRating_HIGH, []string{
+			"candidate 1 rated HIGH probability of sexually_explicit (at or above HIGH)",
+		}},
+		{aiplatformpb.SafetyRating_MEDIUM, []string{
+			"candidate 0 rated MEDIUM probability of harassment (at or above MEDIUM)",
+			"candidate 1 rated HIGH probability of sexually_explicit (at or above MEDIUM)",
+		}},
+		{aiplatformpb.SafetyRating_LOW, []string{
+			"candidate 0 rated MEDIUM probability of harassment (at or above LOW)",
+			"candidate 1 rated LOW probability of dangerous_content (at or above LOW)",
+			"candidate 1 rated HIGH probability of sexually_explicit (at or above LOW)",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			warns := &warnings.Warnings{}
+			WarnSafetyRatings(warnings.NewContext(context.Background(), warns), ratings, tt.level)
+			if got := warns.Messages(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WarnSafetyRatings() warnings = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	if progressFromContext(context.Background()) != nil {
+		t.Error("progressFromContext() should be nil without WithProgress")
+	}
+
+	called := false
+	ctx := WithProgress(context.Background(), func(int32) { called = true })
+	progressFromContext(ctx)(1)
+	if !called {
+		t.Error("progressFromContext() should return the function set by WithProgress")
+	}
+}
+
+func TestWithRegionFallback(t *testing.T) {
+	exhausted := status.Error(codes.ResourceExhausted, "quota exceeded")
+
+	tests := []struct {
+		name      string
+		failIn    map[string]error
+		wantTried []string
+		wantErr   bool
+	}{
+		{"first location succeeds", nil, []string{"primary"}, false},
+		{"second location succeeds", map[string]error{"primary": exhausted}, []string{"primary", "second"}, false},
+		{"wrapped region error", map[string]error{"primary": fmt.Errorf("generating content: %w", exhausted)}, []string{"primary", "second"}, false},
+		{"other errors are not retried", map[string]error{"primary": errors.New("permission denied")}, []string{"primary"}, true},
+		{"all locations fail", map[string]error{"primary": exhausted, "second": exhausted, "third": exhausted}, []string{"primary", "second", "third"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tried []string
+			call := WithRegionFallback(func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+				location := LocationFromContext(ctx)
+				tried = append(tried, location)
+				if err := tt.failIn[location]; err != nil {
+					return nil, err
+				}
+				return &Response{Text: location}, nil
+			}, []string{"second", "third"})
+
+			resp, err := call(WithLocation(context.Background(), "primary"), config.Config{}, "prompt")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("call() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tried, tt.wantTried) {
+				t.Errorf("tried locations %v, want %v", tried, tt.wantTried)
+			}
+			if !tt.wantErr && resp.Text != tried[len(tried)-1] {
+				t.Errorf("response from %q, want the last location tried", resp.Text)
+			}
+		})
+	}
+}
+
+func TestWithEmptyRetry(t *testing.T) {
+	success := &Response{Text: "Done", FinishReason: aiplatformpb.Candidate_STOP, OutputTokens: 50}
+
+	tests := []struct {
+		name      string
+		first     *Response
+		firstErr  error
+		wantCalls int
+	}{
+		{"success is not retried", success, nil, 1},
+		{"empty content is retried", nil, &EmptyResponseError{Reason: "empty response content"}, 2},
+		{"blank text is retried", &Response{Text: " \n", FinishReason: aiplatformpb.Candidate_STOP}, nil, 2},
+		{"truncated response is retried", &Response{Text: "The", FinishReason: aiplatformpb.Candidate_MAX_TOKENS, OutputTokens: 1}, nil, 2},
+		{"long truncated response is not retried", &Response{Text: "Long", FinishReason: aiplatformpb.Candidate_MAX_TOKENS, OutputTokens: 8192}, nil, 1},
+		{"safety block is not retried", nil, &EmptyResponseError{Reason: "empty response content", Blocked: true}, 1},
+		{"other errors are not retried", nil, errors.New("permission denied"), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			call := WithEmptyRetry(func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+				calls++
+				if calls == 1 {
+					return tt.first, tt.firstErr
+				}
+				return success, nil
+			})
+
+			resp, err := call(context.Background(), config.Config{}, "prompt")
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantCalls == 2 && (err != nil || resp != success) {
+				t.Errorf("call() = %+v, %v; want the retried response", resp, err)
+			}
+		})
+	}
+}
+
+func TestWithContinuation(t *testing.T) {
+	truncated := func(text string) *Response {
+		return &Response{Text: text, InputTokens: 10, OutputTokens: 5, TotalTokens: 15, FinishReason: aiplatformpb.Candidate_MAX_TOKENS}
+	}
+	stopped := func(text string) *Response {
+		return &Response{Text: text, InputTokens: 10, OutputTokens: 5, TotalTokens: 15, FinishReason: aiplatformpb.Candidate_STOP}
+	}
+
+	tests := []struct {
+		name         string
+		segments     []*Response
+		failAt       int // 1-based call that fails, 0 for none
+		max          int
+		wantText     string
+		wantOutput   int32
+		wantWarnings int
+		wantPartial  string
+	}{
+		{"complete response is not continued", []*Response{stopped("Whole story")}, 0, 5, "Whole story", 5, 0, ""},
+		{"truncated then completed", []*Response{truncated("Once upon "), truncated("a time "), stopped("the end")}, 0, 5, "Once upon a time the end", 15, 0, ""},
+		{"stops at the cap", []*Response{truncated("A "), truncated("B "), truncated("C ")}, 0, 2, "A B C ", 15, 1, ""},
+		{"failed continuation keeps the text", []*Response{truncated("Once upon "), nil}, 2, 5, "", 0, 0, "Once upon "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var histories [][]Turn
+			var prompts []string
+			call := WithContinuation(func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+				histories = append(histories, HistoryFromContext(ctx))
+				prompts = append(prompts, prompt)
+				if len(prompts) == tt.failAt {
+					return nil, errors.New("quota exceeded")
+				}
+				return tt.segments[len(prompts)-1], nil
+			}, tt.max)
+
+			warns := &warnings.Warnings{}
+			resp, err := call(warnings.NewContext(context.Background(), warns), config.Config{}, "Tell a story")
+			if tt.wantPartial != "" {
+				var streamErr *StreamError
+				if !errors.As(err, &streamErr) || streamErr.Partial != tt.wantPartial {
+					t.Fatalf("call() error = %v, want partial %q", err, tt.wantPartial)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("call() error = %v", err)
+			}
+			if resp.Text != tt.wantText || resp.OutputTokens != tt.wantOutput || resp.InputTokens != 2*tt.wantOutput || resp.TotalTokens != 3*tt.wantOutput {
+				t.Errorf("call() = %+v, want text %q and %d output tokens", resp, tt.wantText, tt.wantOutput)
+			}
+			if n := len(warns.Messages()); n != tt.wantWarnings {
+				t.Errorf("warnings = %q, want %d", warns.Messages(), tt.wantWarnings)
+			}
+
+			// Each continuation sends the prompt and the text so far
+			if histories[0] != nil || prompts[0] != "Tell a story" {
+				t.Errorf("first call had history %v and prompt %q", histories[0], prompts[0])
+			}
+			text := ""
+			for i := 1; i < len(prompts); i++ {
+				text += tt.segments[i-1].Text
+				want := []Turn{{Role: RoleUser, Text: "Tell a story"}, {Role: RoleModel, Text: text}}
+				if !reflect.DeepEqual(histories[i], want) || prompts[i] != continuePrompt {
+					t.Errorf("continuation %d history = %v, prompt %q", i, histories[i], prompts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWithDeadlineRetry(t *testing.T) {
+	deadline := status.Error(codes.DeadlineExceeded, "deadline exceeded")
+	cutOff := func(err error, texts ...string) *fakeStream {
+		stream := &fakeStream{err: err}
+		for _, text := range texts {
+			stream.chunks = append(stream.chunks, textChunk(text, nil))
+		}
+		return stream
+	}
+
+	tests := []struct {
+		name        string
+		streams     []*fakeStream
+		cancel      bool
+		wantCalls   int
+		wantText    string
+		wantPartial string
+	}{
+		{"clean end is not retried", []*fakeStream{cutOff(nil, "Whole ", "story")}, false, 1, "Whole story", ""},
+		{"deadline midway reconnects", []*fakeStream{cutOff(deadline, "Once "), cutOff(nil, "Once upon a time")}, false, 2, "Once upon a time", ""},
+		{"context deadline midway reconnects", []*fakeStream{cutOff(context.DeadlineExceeded, "Once "), cutOff(nil, "Done")}, false, 2, "Done", ""},
+		{"failed retry keeps the longer partial", []*fakeStream{cutOff(deadline, "Once upon "), cutOff(deadline, "Once")}, false, 2, "", "Once upon "},
+		{"other stream errors are not retried", []*fakeStream{cutOff(io.ErrUnexpectedEOF, "Once "), cutOff(nil, "Done")}, false, 1, "", "Once "},
+		{"expired caller context is not retried", []*fakeStream{cutOff(deadline, "Once "), cutOff(nil, "Done")}, true, 1, "", "Once "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			call := WithDeadlineRetry(func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+				stream := tt.streams[calls]
+				calls++
+				return collectStream(stream, nil)
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			resp, err := call(ctx, config.Config{}, "prompt")
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantPartial == "" {
+				if err != nil || resp.Text != tt.wantText {
+					t.Fatalf("call() = %+v, %v; want text %q", resp, err, tt.wantText)
+				}
+				return
+			}
+			var streamErr *StreamError
+			if !errors.As(err, &streamErr) || streamErr.Partial != tt.wantPartial {
+				t.Errorf("call() error = %v, want a StreamError with partial %q", err, tt.wantPartial)
+			}
+		})
+	}
+}
+
+func TestIsStreamDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"deadline before streaming", status.Error(codes.DeadlineExceeded, "deadline"), false},
+		{"deadline midway", &StreamError{Partial: "Once", Err: status.Error(codes.DeadlineExceeded, "deadline")}, true},
+		{"wrapped context deadline", fmt.Errorf("calling: %w", &StreamError{Err: context.DeadlineExceeded}), true},
+		{"other stream error", &StreamError{Err: io.ErrUnexpectedEOF}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsStreamDeadline(tt.err); got != tt.want {
+				t.Errorf("IsStreamDeadline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractResponseEmptyBlocked(t *testing.T) {
+	resp := &aiplatformpb.GenerateContentResponse{
+		Candidates: []*aiplatformpb.Candidate{{FinishReason: aiplatformpb.Candidate_SAFETY}},
+	}
+	_, err := extractResponse(resp)
+	var emptyErr *EmptyResponseError
+	if !errors.As(err, &emptyErr) || !emptyErr.Blocked {
+		t.Errorf("extractResponse() error = %v, want a blocked EmptyResponseError", err)
+	}
+
+	resp.Candidates[0].FinishReason = aiplatformpb.Candidate_OTHER
+	_, err = extractResponse(resp)
+	if !errors.As(err, &emptyErr) || emptyErr.Blocked {
+		t.Errorf("extractResponse() error = %v, want an unblocked EmptyResponseError", err)
+	}
+}
+
+func TestWithAudit(t *testing.T) {
+	ctx := WithProject(context.Background(), "project")
+
+	var buf bytes.Buffer
+	logger := NewJSONAuditLogger(&buf)
+	now := func() time.Time { return time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC) }
+	call := WithAudit(func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+		if prompt == "fail" {
+			return nil, errors.New("quota exceeded")
+		}
+		return &Response{Text: "ok", InputTokens: 3, OutputTokens: 5, TotalTokens: 8}, nil
+	}, logger, now)
+
+	// Requests may be made concurrently; each must produce one whole record
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			call(WithLocation(ctx, "us-central1"), config.Config{}, "secret prompt")
+		}()
+	}
+	wg.Wait()
+	call(context.Background(), config.Config{Model: "gemini-1.5-pro-002"}, "fail")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 21 {
+		t.Fatalf("got %d audit records, want 21", len(lines))
+	}
+	var first, last AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("parsing audit record: %v", err)
+	}
+	sum := sha256.Sum256([]byte("secret prompt"))
+	want := AuditRecord{
+		Time:         now(),
+		Model:        config.DefaultModel,
+		Project:      "project",
+		Location:     "us-central1",
+		PromptSHA256: hex.EncodeToString(sum[:]),
+		InputTokens:  3,
+		OutputTokens: 5,
+		TotalTokens:  8,
+	}
+	if !reflect.DeepEqual(first, want) {
+		t.Errorf("audit record = %+v, want %+v", first, want)
+	}
+	if strings.Contains(buf.String(), "secret prompt") {
+		t.Error("audit log must not contain the prompt")
+	}
+	if err := json.Unmarshal([]byte(lines[20]), &last); err != nil {
+		t.Fatalf("parsing audit record: %v", err)
+	}
+	if last.Error != "quota exceeded" || last.Model != "gemini-1.5-pro-002" {
+		t.Errorf("failed request record = %+v, want its model and error", last)
+	}
+}
+
+func TestExtractResponseSafetyRatings(t *testing.T) {
+	resp := &aiplatformpb.GenerateContentResponse{
+		Candidates: []*aiplatformpb.Candidate{
+			{
+				Content: &aiplatformpb.Content{
+					Parts: []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: "First"}}},
+				},
+				SafetyRatings: []*aiplatformpb.SafetyRating{
+					{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HATE_SPEECH, Probability: aiplatformpb.SafetyRating_NEGLIGIBLE},
+					{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HARASSMENT, Probability: aiplatformpb.SafetyRating_MEDIUM, Blocked: true},
+				},
+			},
+			{
+				Index: 1,
+				Content: &aiplatformpb.Content{
+					Parts: []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: "Second"}}},
+				},
+				SafetyRatings: []*aiplatformpb.SafetyRating{
+					{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_DANGEROUS_CONTENT, Probability: aiplatformpb.SafetyRating_LOW},
+				},
+			},
+		},
+	}
+
+	got, err := extractResponse(resp)
+	if err != nil {
+		t.Fatalf("extractResponse() error = %v", err)
+	}
+
+	want := [][]SafetyRating{
+		{
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HATE_SPEECH, Probability: aiplatformpb.SafetyRating_NEGLIGIBLE},
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HARASSMENT, Probability: aiplatformpb.SafetyRating_MEDIUM, Blocked: true},
+		},
+		{
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_DANGEROUS_CONTENT, Probability: aiplatformpb.SafetyRating_LOW},
+		},
+	}
+	if !reflect.DeepEqual(got.SafetyRatings, want) {
+		t.Errorf("extractResponse() SafetyRatings = %+v, want %+v", got.SafetyRatings, want)
+	}
+}
+
+func TestExtractResponseCitations(t *testing.T) {
+	resp := &aiplatformpb.GenerateContentResponse{
+		Candidates: []*aiplatformpb.Candidate{{
+			Content: &aiplatformpb.Content{
+				Parts: []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: "Quoted text"}}},
+			},
+			CitationMetadata: &aiplatformpb.CitationMetadata{
+				Citations: []*aiplatformpb.Citation{
+					{Title: "Go spec", Uri: "https://go.dev/ref/spec", License: "BSD-3-Clause"},
+					{StartIndex: 10, Uri: "https://example.com/post"},
+					{StartIndex: 20, Title: "Go spec", Uri: "https://go.dev/ref/spec", License: "BSD-3-Clause"},
+					{License: "MIT"},
+				},
+			},
+		}},
+	}
+
+	got, err := extractResponse(resp)
+	if err != nil {
+		t.Fatalf("extractResponse() error = %v", err)
+	}
+
+	want := []Citation{
+		{Title: "Go spec", URI: "https://go.dev/ref/spec", License: "BSD-3-Clause"},
+		{URI: "https://example.com/post"},
+	}
+	if !reflect.DeepEqual(got.Citations, want) {
+		t.Errorf("extractResponse() Citations = %+v, want %+v", got.Citations, want)
+	}
+}
@@ -0,0 +1,114 @@
+package ai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"air/internal/config"
+	"air/internal/warnings"
+)
+
+// AuditRecord describes one request sent to the model. The prompt itself is
+// not recorded, only its SHA-256 hash.
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"requestId,omitempty"`
+	Model        string    `json:"model"`
+	Project      string    `json:"project"`
+	Location     string    `json:"location"`
+	PromptSHA256 string    `json:"promptSha256"`
+	InputTokens  int32     `json:"inputTokens"`
+	OutputTokens int32     `json:"outputTokens"`
+	TotalTokens  int32     `json:"totalTokens"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the ID that correlates the
+// requests of one run in audit records.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the ID set by WithRequestID, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// AuditLogger records requests. Implementations must be safe for concurrent
+// use.
+type AuditLogger interface {
+	Log(record AuditRecord) error
+}
+
+// NopAuditLogger discards every record. It is the default.
+type NopAuditLogger struct{}
+
+func (NopAuditLogger) Log(AuditRecord) error {
+	return nil
+}
+
+// JSONAuditLogger writes each record as a line of JSON.
+type JSONAuditLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditLogger returns a logger writing JSON lines to w.
+func NewJSONAuditLogger(w io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger{w: w}
+}
+
+func (l *JSONAuditLogger) Log(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding audit record: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing audit record: %w", err)
+	}
+	return nil
+}
+
+// WithAudit wraps call so that every request is recorded to logger, whether
+// it succeeds or not. A record that cannot be written is reported as a
+// warning rather than failing the request, which has already been made.
+func WithAudit(call CallFunc, logger AuditLogger, now func() time.Time) CallFunc {
+	return func(ctx context.Context, cfg config.Config, prompt string) (*Response, error) {
+		response, err := call(ctx, cfg, prompt)
+
+		sum := sha256.Sum256([]byte(prompt))
+		record := AuditRecord{
+			Time:         now().UTC(),
+			RequestID:    RequestIDFromContext(ctx),
+			Model:        cfg.ModelOrDefault(),
+			Project:      ProjectFromContext(ctx),
+			Location:     LocationFromContext(ctx),
+			PromptSHA256: hex.EncodeToString(sum[:]),
+		}
+		if response != nil {
+			record.InputTokens = response.InputTokens
+			record.OutputTokens = response.OutputTokens
+			record.TotalTokens = response.TotalTokens
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if logErr := logger.Log(record); logErr != nil {
+			warnings.FromContext(ctx).Add("audit log: %v", logErr)
+		}
+
+		return response, err
+	}
+}
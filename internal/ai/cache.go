@@ -0,0 +1,236 @@
+package ai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	aiplatformbeta "cloud.google.com/go/aiplatform/apiv1beta1"
+	betapb "cloud.google.com/go/aiplatform/apiv1beta1/aiplatformpb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// DefaultCacheTTL is how long a newly created cached content resource lives.
+const DefaultCacheTTL = time.Hour
+
+// cacheExpiryMargin keeps a cached content from being reused when it would
+// expire during the request.
+const cacheExpiryMargin = 5 * time.Minute
+
+// ContentCache creates or reuses Vertex AI cached content resources holding a
+// static prompt prefix.
+type ContentCache interface {
+	// Resolve returns the resource name of the cached content stored under
+	// key, creating it from prefix when there is none, it has expired, or the
+	// model or prefix changed. hit reports whether an existing resource was
+	// reused.
+	Resolve(ctx context.Context, key, model, prefix string) (name string, hit bool, err error)
+}
+
+type cachedContentKey struct{}
+
+// WithCachedContent returns a context that makes CallVertexAI reference the
+// cached content resource name in its requests.
+func WithCachedContent(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, cachedContentKey{}, name)
+}
+
+// CachedContentFromContext returns the cached content set by
+// WithCachedContent, or "" when none is set.
+func CachedContentFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(cachedContentKey{}).(string)
+	return name
+}
+
+// VertexCache is the ContentCache backed by Vertex AI context caching.
+// Cached contents have no user-defined name, so the resource created for each
+// key is remembered in a local registry file.
+type VertexCache struct {
+	// RegistryPath is the JSON file mapping keys to resource names. It
+	// defaults to air/cached-contents.json in the user cache directory.
+	RegistryPath string
+
+	// create creates the cached content; nil uses the Vertex AI API.
+	create func(ctx context.Context, parent string, content *betapb.CachedContent) (*betapb.CachedContent, error)
+	now    func() time.Time
+}
+
+type registryEntry struct {
+	Name       string    `json:"name"`
+	Model      string    `json:"model"`
+	PrefixHash string    `json:"prefixHash"`
+	ExpireTime time.Time `json:"expireTime"`
+}
+
+func (c *VertexCache) Resolve(ctx context.Context, key, model, prefix string) (string, bool, error) {
+	projectID, location, err := loadEnvironment(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	parent := fmt.Sprintf("projects/%s/locations/%s", projectID, location)
+	modelPath := ModelPath(projectID, location, model)
+
+	registry, err := c.loadRegistry()
+	if err != nil {
+		return "", false, err
+	}
+
+	registryKey := parent + "/" + key
+	sum := sha256.Sum256([]byte(prefix))
+	prefixHash := hex.EncodeToString(sum[:])
+	now := c.clock()
+
+	if entry, ok := registry[registryKey]; ok && entry.Model == modelPath && entry.PrefixHash == prefixHash && now.Add(cacheExpiryMargin).Before(entry.ExpireTime) {
+		return entry.Name, true, nil
+	}
+
+	created, err := c.createContent(ctx, parent, &betapb.CachedContent{
+		Model: modelPath,
+		Contents: []*betapb.Content{
+			{
+				Role:  "user",
+				Parts: []*betapb.Part{{Data: &betapb.Part_Text{Text: prefix}}},
+			},
+		},
+		Expiration: &betapb.CachedContent_Ttl{Ttl: durationpb.New(DefaultCacheTTL)},
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("creating cached content: %w", err)
+	}
+
+	expireTime := now.Add(DefaultCacheTTL)
+	if created.GetExpireTime() != nil {
+		expireTime = created.GetExpireTime().AsTime()
+	}
+	registry[registryKey] = registryEntry{
+		Name:       created.Name,
+		Model:      modelPath,
+		PrefixHash: prefixHash,
+		ExpireTime: expireTime,
+	}
+	if err := c.saveRegistry(registry); err != nil {
+		return "", false, err
+	}
+	return created.Name, false, nil
+}
+
+func (c *VertexCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *VertexCache) createContent(ctx context.Context, parent string, content *betapb.CachedContent) (*betapb.CachedContent, error) {
+	if c.create != nil {
+		return c.create(ctx, parent, content)
+	}
+
+	client, err := aiplatformbeta.NewGenAiCacheClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache client: %w", err)
+	}
+	defer client.Close()
+
+	return client.CreateCachedContent(ctx, &betapb.CreateCachedContentRequest{
+		Parent:        parent,
+		CachedContent: content,
+	})
+}
+
+func (c *VertexCache) registryPath() (string, error) {
+	if c.RegistryPath != "" {
+		return c.RegistryPath, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("locating cache registry: %w", err)
+	}
+	return filepath.Join(dir, "air", "cached-contents.json"), nil
+}
+
+func (c *VertexCache) loadRegistry() (map[string]registryEntry, error) {
+	path, err := c.registryPath()
+	if err != nil {
+		return nil, err
+	}
+
+	registry := make(map[string]registryEntry)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cache registry: %w", err)
+	}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("parsing cache registry %s: %w", path, err)
+	}
+	return registry, nil
+}
+
+func (c *VertexCache) saveRegistry(registry map[string]registryEntry) error {
+	path, err := c.registryPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding cache registry: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("writing cache registry: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("writing cache registry: %w", err)
+	}
+	return nil
+}
+
+// withCachedContent converts req to a v1beta1 request that references the
+// cached content. The v1 API of this client version has no cachedContent
+// field; the v1beta1 messages share its wire format.
+func withCachedContent(req *aiplatformpb.GenerateContentRequest, name string) (*betapb.GenerateContentRequest, error) {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+	betaReq := &betapb.GenerateContentRequest{}
+	if err := proto.Unmarshal(data, betaReq); err != nil {
+		return nil, fmt.Errorf("converting request: %w", err)
+	}
+	betaReq.CachedContent = name
+	return betaReq, nil
+}
+
+// betaStream adapts a v1beta1 response stream to contentStream.
+type betaStream struct {
+	stream interface {
+		Recv() (*betapb.GenerateContentResponse, error)
+	}
+}
+
+func (s *betaStream) Recv() (*aiplatformpb.GenerateContentResponse, error) {
+	chunk, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(chunk)
+	if err != nil {
+		return nil, fmt.Errorf("encoding response: %w", err)
+	}
+	resp := &aiplatformpb.GenerateContentResponse{}
+	if err := proto.Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("converting response: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,90 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	"gopkg.in/yaml.v3"
+)
+
+// Roles of the turns of a conversation.
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// Turn is a single message of a conversation.
+type Turn struct {
+	Role string `yaml:"role"`
+	Text string `yaml:"text"`
+}
+
+// Conversation is the file format written by --save-conversation and read by
+// the history setting.
+type Conversation struct {
+	Turns []Turn `yaml:"turns"`
+}
+
+// ParseConversation parses a conversation file, checking that every turn has
+// a known role.
+func ParseConversation(content []byte) (Conversation, error) {
+	var conv Conversation
+	if err := yaml.Unmarshal(content, &conv); err != nil {
+		return Conversation{}, fmt.Errorf("parsing conversation: %w", err)
+	}
+	for i, turn := range conv.Turns {
+		if turn.Role != RoleUser && turn.Role != RoleModel {
+			return Conversation{}, fmt.Errorf("turn %d: unknown role %q (expected %s or %s)", i+1, turn.Role, RoleUser, RoleModel)
+		}
+	}
+	return conv, nil
+}
+
+// Marshal encodes the conversation in the format read by ParseConversation.
+func (c Conversation) Marshal() ([]byte, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("encoding conversation: %w", err)
+	}
+	return data, nil
+}
+
+type historyKey struct{}
+
+// WithHistory returns a context that makes CallVertexAI and CountTokens send
+// the turns before the prompt.
+func WithHistory(ctx context.Context, turns []Turn) context.Context {
+	return context.WithValue(ctx, historyKey{}, turns)
+}
+
+// HistoryFromContext returns the turns set by WithHistory, or nil.
+func HistoryFromContext(ctx context.Context) []Turn {
+	turns, _ := ctx.Value(historyKey{}).([]Turn)
+	return turns
+}
+
+// messageBuilder assembles the contents of a request from the earlier turns
+// of a conversation and the new prompt. Backends that name roles differently
+// or structure their messages otherwise provide their own.
+type messageBuilder func(history []Turn, prompt string) []*aiplatformpb.Content
+
+// buildMessages is the messageBuilder of the backend requests are sent to.
+var buildMessages messageBuilder = vertexMessages
+
+// vertexMessages is the messageBuilder for Vertex AI: each turn becomes a
+// content with a single text part, and the prompt is the last user turn.
+func vertexMessages(history []Turn, prompt string) []*aiplatformpb.Content {
+	contents := make([]*aiplatformpb.Content, 0, len(history)+1)
+	for _, turn := range history {
+		contents = append(contents, textContent(turn.Role, turn.Text))
+	}
+	return append(contents, textContent(RoleUser, prompt))
+}
+
+func textContent(role, text string) *aiplatformpb.Content {
+	return &aiplatformpb.Content{
+		Role:  role,
+		Parts: []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: text}}},
+	}
+}
@@ -0,0 +1,91 @@
+package ai
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"air/internal/config"
+
+	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestConversationRoundTrip(t *testing.T) {
+	conv := Conversation{Turns: []Turn{
+		{Role: RoleUser, Text: "Name a colour"},
+		{Role: RoleModel, Text: "Blue\n"},
+	}}
+
+	data, err := conv.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	got, err := ParseConversation(data)
+	if err != nil {
+		t.Fatalf("ParseConversation() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, conv) {
+		t.Errorf("ParseConversation() = %+v, want %+v", got, conv)
+	}
+
+	if _, err := ParseConversation([]byte("turns:\n  - role: system\n    text: hi\n")); err == nil {
+		t.Error("ParseConversation() expected error for an unknown role")
+	}
+}
+
+func TestVertexMessages(t *testing.T) {
+	textPart := func(text string) []*aiplatformpb.Part {
+		return []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: text}}}
+	}
+
+	tests := []struct {
+		name    string
+		history []Turn
+		want    []*aiplatformpb.Content
+	}{
+		{
+			name: "prompt only",
+			want: []*aiplatformpb.Content{{Role: "user", Parts: textPart("And another?")}},
+		},
+		{
+			name: "history before prompt",
+			history: []Turn{
+				{Role: RoleUser, Text: "Name a colour"},
+				{Role: RoleModel, Text: "Blue"},
+			},
+			want: []*aiplatformpb.Content{
+				{Role: "user", Parts: textPart("Name a colour")},
+				{Role: "model", Parts: textPart("Blue")},
+				{Role: "user", Parts: textPart("And another?")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := vertexMessages(tt.history, "And another?")
+			if len(got) != len(tt.want) {
+				t.Fatalf("vertexMessages() returned %d contents, want %d", len(got), len(tt.want))
+			}
+			for i := range tt.want {
+				if !proto.Equal(got[i], tt.want[i]) {
+					t.Errorf("vertexMessages()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildRequestContents(t *testing.T) {
+	ctx := WithHistory(context.Background(), []Turn{{Role: RoleUser, Text: "Name a colour"}, {Role: RoleModel, Text: "Blue"}})
+	contents := buildMessages(HistoryFromContext(ctx), "And another?")
+
+	req, err := buildRequest(config.Config{}, contents, "project", "location")
+	if err != nil {
+		t.Fatalf("buildRequest() error = %v", err)
+	}
+	if !reflect.DeepEqual(req.Contents, contents) {
+		t.Errorf("buildRequest() contents = %v, want the built messages", req.Contents)
+	}
+}
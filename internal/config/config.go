@@ -3,11 +3,19 @@ package config
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	"air/internal/schema"
 	aiplatform "cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	"github.com/BurntSushi/toml"
 	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"gopkg.in/yaml.v3"
 )
 
@@ -15,11 +23,46 @@ const (
 	DefaultLocation         = "europe-west1"
 	DefaultTemperature      = float32(0.0)
 	DefaultTopP             = float32(0.95)
+	DefaultTopK             = int32(0)
 	DefaultMaxTokens        = int32(8192)
 	DefaultResponseMimeType = "application/json"
 	DefaultModel            = "gemini-2.0-flash-001"
+	DefaultLocaleHint       = "Respond in the language of the {{locale}} locale."
+
+	// DefaultModelEnv names the environment variable that overrides
+	// DefaultModel for templates that do not set a model.
+	DefaultModelEnv = "AIR_DEFAULT_MODEL"
+
+	// DefaultMaxTokensEnv and DefaultTemperatureEnv name the environment
+	// variables that override DefaultMaxTokens and DefaultTemperature.
+	DefaultMaxTokensEnv   = "AIR_DEFAULT_MAX_TOKENS"
+	DefaultTemperatureEnv = "AIR_DEFAULT_TEMPERATURE"
 )
 
+// GeminiModelPrefix starts every model name accepted in the model setting.
+// Names are not checked further, so Gemini models not in SupportedModels can
+// be used.
+const GeminiModelPrefix = "gemini-"
+
+// SupportedModels lists the model names accepted in AIR_DEFAULT_MODEL.
+var SupportedModels = []string{
+	"gemini-2.0-flash-001",
+	"gemini-1.5-pro-002",
+	"gemini-1.5-pro-001",
+	"gemini-1.5-flash-002",
+	"gemini-1.5-flash-001",
+}
+
+// MaxOutputTokens is the largest maxTokens each model accepts. Models not
+// listed are not checked.
+var MaxOutputTokens = map[string]int32{
+	"gemini-2.0-flash-001": 8192,
+	"gemini-1.5-pro-002":   8192,
+	"gemini-1.5-pro-001":   8192,
+	"gemini-1.5-flash-002": 8192,
+	"gemini-1.5-flash-001": 8192,
+}
+
 var HarmCategoryMap = map[string]aiplatform.HarmCategory{
 	"hate_speech":       aiplatform.HarmCategory_HARM_CATEGORY_HATE_SPEECH,
 	"dangerous_content": aiplatform.HarmCategory_HARM_CATEGORY_DANGEROUS_CONTENT,
@@ -34,18 +77,144 @@ var SafetyThresholdMap = map[string]aiplatform.SafetySetting_HarmBlockThreshold{
 	"BLOCK_LOW_AND_ABOVE":    aiplatform.SafetySetting_BLOCK_LOW_AND_ABOVE,
 }
 
+// HarmProbabilityMap maps the response safety rating levels to their enum
+// values, which increase with the probability of harm.
+var HarmProbabilityMap = map[string]aiplatform.SafetyRating_HarmProbability{
+	"NEGLIGIBLE": aiplatform.SafetyRating_NEGLIGIBLE,
+	"LOW":        aiplatform.SafetyRating_LOW,
+	"MEDIUM":     aiplatform.SafetyRating_MEDIUM,
+	"HIGH":       aiplatform.SafetyRating_HIGH,
+}
+
 type Config struct {
-	Temperature      *float32               `yaml:"temperature"`
-	TopP             *float32               `yaml:"topP"`
-	MaxTokens        *int32                 `yaml:"maxTokens"`
-	ResponseMimeType string                 `yaml:"responseMimeType"`
-	Model            string                 `yaml:"model"`
-	SafetySettings   map[string]string      `yaml:"safetySettings"`
-	Variables        map[string]string      `yaml:"variables"`
-	ResponseSchema   map[string]interface{} `yaml:"responseSchema"`
+	Temperature      *float32               `yaml:"temperature" toml:"temperature"`
+	TopP             *float32               `yaml:"topP" toml:"topP"`
+	TopK             *int32                 `yaml:"topK" toml:"topK"`
+	MaxTokens        *TokenCount            `yaml:"maxTokens" toml:"maxTokens"`
+	MaxPromptTokens  *int32                 `yaml:"maxPromptTokens" toml:"maxPromptTokens"`
+	ResponseMimeType string                 `yaml:"responseMimeType" toml:"responseMimeType"`
+	Model            string                 `yaml:"model" toml:"model"`
+	SafetySettings   map[string]string      `yaml:"safetySettings" toml:"safetySettings"`
+	Variables        map[string]string      `yaml:"variables" toml:"variables"`
+	ResponseSchema   map[string]interface{} `yaml:"responseSchema" toml:"responseSchema"`
+	Profiles         map[string]Config      `yaml:"profiles" toml:"profiles"`
+
+	// CacheKey names a Vertex AI cached content resource holding the file
+	// CachePrefix, which is sent once and then referenced by every request.
+	CacheKey    string `yaml:"cacheKey" toml:"cacheKey"`
+	CachePrefix string `yaml:"cachePrefix" toml:"cachePrefix"`
+
+	// SystemInstruction is sent as the Gemini system instruction, apart from
+	// the prompt. Placeholders are replaced like in the body.
+	SystemInstruction string `yaml:"systemInstruction" toml:"systemInstruction"`
+
+	// LocaleHint is appended to the prompt when --locale is given. It may use
+	// the {{locale}} placeholder.
+	LocaleHint string `yaml:"localeHint" toml:"localeHint"`
+
+	// DateFormat is the Go time layout of the built-in {{today}} variable.
+	DateFormat string `yaml:"dateFormat" toml:"dateFormat"`
+
+	// History is a conversation file, as written by --save-conversation,
+	// whose turns are sent before the prompt.
+	History string `yaml:"history" toml:"history"`
+
+	// IncludeKeyword replaces "include" as the name of include directives,
+	// e.g. "import" for {{import "file.md"}}. Only the template's own
+	// frontmatter can set it, since includes are expanded before the rest
+	// of the configuration is read.
+	IncludeKeyword string `yaml:"includeKeyword" toml:"includeKeyword"`
+
+	// NoDefaultSafety sends no safety settings when none are configured,
+	// so the defaults of the Google Cloud project apply instead of
+	// DefaultSafetySettings.
+	NoDefaultSafety *bool `yaml:"noDefaultSafety" toml:"noDefaultSafety"`
+}
+
+// TokenCount is a number of tokens that may be written with a k suffix for
+// multiples of 1024, such as 8k, as well as a plain integer.
+type TokenCount int32
+
+// ParseTokenCount parses a plain integer or a whole number followed by k (or
+// K), which stands for 1024 tokens.
+func ParseTokenCount(value string) (TokenCount, error) {
+	value = strings.TrimSpace(value)
+	digits, kilo := strings.CutSuffix(strings.ToLower(value), "k")
+	n, err := strconv.ParseInt(digits, 10, 32)
+	if kilo && n < 0 {
+		err = strconv.ErrRange
+	}
+	if err == nil && kilo {
+		n *= 1024
+		if n > math.MaxInt32 {
+			err = strconv.ErrRange
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid token count %q (expected an integer, or a number followed by k for 1024 tokens, e.g. 8k)", value)
+	}
+	return TokenCount(n), nil
+}
+
+// UnmarshalYAML accepts maxTokens: 8192 as well as maxTokens: 8k.
+func (t *TokenCount) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a token count", value.Line)
+	}
+	n, err := ParseTokenCount(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*t = n
+	return nil
+}
+
+// UnmarshalTOML accepts maxTokens = 8192 as well as maxTokens = "8k".
+func (t *TokenCount) UnmarshalTOML(data interface{}) error {
+	var n TokenCount
+	var err error
+	switch v := data.(type) {
+	case int64:
+		n, err = ParseTokenCount(strconv.FormatInt(v, 10))
+	case string:
+		n, err = ParseTokenCount(v)
+	default:
+		err = fmt.Errorf("invalid token count %v (expected an integer or a string such as \"8k\")", data)
+	}
+	if err != nil {
+		return err
+	}
+	*t = n
+	return nil
 }
 
 func (c *Config) Validate() error {
+	if c.Model != "" && !strings.HasPrefix(c.Model, GeminiModelPrefix) {
+		return fmt.Errorf("model: %q is not a Gemini model name (%s...)", c.Model, GeminiModelPrefix)
+	}
+	if c.TopK != nil && *c.TopK < 1 {
+		return fmt.Errorf("topK must be at least 1, got %d", *c.TopK)
+	}
+	if c.MaxPromptTokens != nil && *c.MaxPromptTokens < 1 {
+		return fmt.Errorf("maxPromptTokens must be a positive integer, got %d", *c.MaxPromptTokens)
+	}
+
+	model := c.ModelOrDefault()
+	if ceiling, ok := MaxOutputTokens[model]; ok {
+		if maxTokens := c.MaxTokensOrDefault(); maxTokens > ceiling {
+			return fmt.Errorf("maxTokens %d exceeds the limit of %d output tokens for model %s", maxTokens, ceiling, model)
+		}
+	}
+
+	if (c.CacheKey == "") != (c.CachePrefix == "") {
+		return fmt.Errorf("cacheKey and cachePrefix must be set together")
+	}
+	// Requests that reference cached content cannot carry their own
+	// system instruction
+	if c.SystemInstruction != "" && c.CacheKey != "" {
+		return fmt.Errorf("systemInstruction cannot be used with cacheKey")
+	}
+
 	// Validate safety settings without building (BuildSafetySettings will be called later)
 	for cat, thresh := range c.SafetySettings {
 		if _, err := ParseHarmCategory(cat); err != nil {
@@ -59,7 +228,128 @@ func (c *Config) Validate() error {
 	return nil
 }
 
-// Helper methods for parameter defaults
+// WithProfile returns the config with the named profile's settings merged over
+// the base settings. Unknown profile names are an error.
+func (c Config) WithProfile(name string) (Config, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown profile %q (available: %v)", name, sortedKeys(c.Profiles))
+	}
+	return Merge(c, profile), nil
+}
+
+// Merge returns base with every field set in override applied on top. Map
+// fields are merged key by key, with override winning.
+func Merge(base, override Config) Config {
+	result := base
+	if override.Temperature != nil {
+		result.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		result.TopP = override.TopP
+	}
+	if override.TopK != nil {
+		result.TopK = override.TopK
+	}
+	if override.MaxTokens != nil {
+		result.MaxTokens = override.MaxTokens
+	}
+	if override.MaxPromptTokens != nil {
+		result.MaxPromptTokens = override.MaxPromptTokens
+	}
+	if override.ResponseMimeType != "" {
+		result.ResponseMimeType = override.ResponseMimeType
+	}
+	if override.Model != "" {
+		result.Model = override.Model
+	}
+	if override.ResponseSchema != nil {
+		result.ResponseSchema = override.ResponseSchema
+	}
+	if override.CacheKey != "" {
+		result.CacheKey = override.CacheKey
+	}
+	if override.CachePrefix != "" {
+		result.CachePrefix = override.CachePrefix
+	}
+	if override.SystemInstruction != "" {
+		result.SystemInstruction = override.SystemInstruction
+	}
+	if override.LocaleHint != "" {
+		result.LocaleHint = override.LocaleHint
+	}
+	if override.DateFormat != "" {
+		result.DateFormat = override.DateFormat
+	}
+	if override.History != "" {
+		result.History = override.History
+	}
+	if override.IncludeKeyword != "" {
+		result.IncludeKeyword = override.IncludeKeyword
+	}
+	if override.NoDefaultSafety != nil {
+		result.NoDefaultSafety = override.NoDefaultSafety
+	}
+	result.SafetySettings = mergeStringMaps(base.SafetySettings, override.SafetySettings)
+	result.Variables = mergeStringMaps(base.Variables, override.Variables)
+	if len(override.Profiles) > 0 {
+		result.Profiles = make(map[string]Config, len(base.Profiles)+len(override.Profiles))
+		for name, profile := range base.Profiles {
+			result.Profiles[name] = profile
+		}
+		for name, profile := range override.Profiles {
+			result.Profiles[name] = profile
+		}
+	}
+	return result
+}
+
+func mergeStringMaps(base, override map[string]string) map[string]string {
+	if base == nil && override == nil {
+		return nil
+	}
+	result := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range override {
+		result[k] = v
+	}
+	return result
+}
+
+// envTemperature reads AIR_DEFAULT_TEMPERATURE from env. ok is false when it
+// is unset.
+func envTemperature(env map[string]string) (temperature float32, ok bool, err error) {
+	value := env[DefaultTemperatureEnv]
+	if value == "" {
+		return 0, false, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 32)
+	if err != nil || parsed < 0 || parsed > 2 {
+		return 0, false, fmt.Errorf("invalid %s value: %s (expected a number from 0.0 to 2.0)", DefaultTemperatureEnv, value)
+	}
+	return float32(parsed), true, nil
+}
+
+// envMaxTokens reads AIR_DEFAULT_MAX_TOKENS from env. ok is false when it is
+// unset.
+func envMaxTokens(env map[string]string) (maxTokens int32, ok bool, err error) {
+	value := env[DefaultMaxTokensEnv]
+	if value == "" {
+		return 0, false, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || parsed < 1 {
+		return 0, false, fmt.Errorf("invalid %s value: %s (expected a positive integer)", DefaultMaxTokensEnv, value)
+	}
+	return int32(parsed), true, nil
+}
+
+// Helper methods for parameter defaults. The AIR_DEFAULT_* environment
+// variables for temperature, maxTokens and model are applied to the
+// configuration by ApplyEnvDefaults, before these fall back to the built-in
+// defaults.
 func (c *Config) TemperatureOrDefault() float32 {
 	if c.Temperature != nil {
 		return *c.Temperature
@@ -74,9 +364,18 @@ func (c *Config) TopPOrDefault() float32 {
 	return DefaultTopP
 }
 
+// TopKOrDefault returns topK, or DefaultTopK when it is not set. topK is only
+// sent when set, so the model's own default applies otherwise.
+func (c *Config) TopKOrDefault() int32 {
+	if c.TopK != nil {
+		return *c.TopK
+	}
+	return DefaultTopK
+}
+
 func (c *Config) MaxTokensOrDefault() int32 {
 	if c.MaxTokens != nil {
-		return *c.MaxTokens
+		return int32(*c.MaxTokens)
 	}
 	return DefaultMaxTokens
 }
@@ -88,6 +387,33 @@ func (c *Config) ResponseMimeTypeOrDefault() string {
 	return DefaultResponseMimeType
 }
 
+func (c *Config) LocaleHintOrDefault() string {
+	if c.LocaleHint != "" {
+		return c.LocaleHint
+	}
+	return DefaultLocaleHint
+}
+
+// SchemaEnabled reports whether the response schema is used: it is ignored
+// when it is empty, or when responseMimeType is text/plain, since plain text
+// cannot follow it.
+func (c *Config) SchemaEnabled() bool {
+	return len(c.ResponseSchema) > 0 && c.ResponseMimeTypeOrDefault() != "text/plain"
+}
+
+// DropEmptySchema removes a response schema without any keys, such as
+// `responseSchema: {}`, so it is treated as absent rather than sent to the
+// model. It reports whether a schema was removed.
+func (c *Config) DropEmptySchema() bool {
+	if c.ResponseSchema == nil || len(c.ResponseSchema) > 0 {
+		return false
+	}
+	c.ResponseSchema = nil
+	return true
+}
+
+// ModelOrDefault returns the configured model, or DefaultModel.
+// ApplyEnvDefaults sets the model from AIR_DEFAULT_MODEL beforehand.
 func (c *Config) ModelOrDefault() string {
 	if c.Model != "" {
 		return c.Model
@@ -95,6 +421,51 @@ func (c *Config) ModelOrDefault() string {
 	return DefaultModel
 }
 
+// ApplyEnvDefaults sets the model, temperature and maxTokens the
+// configuration does not set from their AIR_DEFAULT_* variables in env, and
+// reports invalid values of the ones it uses. The model must be one of
+// SupportedModels, since it applies to every template.
+func (c *Config) ApplyEnvDefaults(env map[string]string) error {
+	if c.Model == "" {
+		if model := env[DefaultModelEnv]; model != "" {
+			if err := ValidateModel(model); err != nil {
+				return fmt.Errorf("%s: %w", DefaultModelEnv, err)
+			}
+			c.Model = model
+		}
+	}
+	if c.Temperature == nil {
+		temperature, ok, err := envTemperature(env)
+		if err != nil {
+			return err
+		}
+		if ok {
+			c.Temperature = &temperature
+		}
+	}
+	if c.MaxTokens == nil {
+		maxTokens, ok, err := envMaxTokens(env)
+		if err != nil {
+			return err
+		}
+		if ok {
+			count := TokenCount(maxTokens)
+			c.MaxTokens = &count
+		}
+	}
+	return nil
+}
+
+// ValidateModel returns an error if model is not one of SupportedModels.
+func ValidateModel(model string) error {
+	for _, supported := range SupportedModels {
+		if model == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported model %q (supported: %s)", model, strings.Join(SupportedModels, ", "))
+}
+
 func (c *Config) ValidateSchema() error {
 	if c.ResponseSchema == nil {
 		return nil
@@ -112,41 +483,294 @@ func (c *Config) ValidateSchema() error {
 		return fmt.Errorf("invalid JSON schema: %w", err)
 	}
 
+	if err := schema.ValidatePropertyOrdering(c.ResponseSchema); err != nil {
+		return fmt.Errorf("invalid response schema: %w", err)
+	}
+	if err := schema.ValidateAdditionalProperties(c.ResponseSchema); err != nil {
+		return fmt.Errorf("invalid response schema: %w", err)
+	}
+
 	return nil
 }
 
-// ParseFrontmatter extracts YAML frontmatter from markdown content delimited by ---.
+// SchemaWarnings returns a warning for every object property in the response
+// schema that has no description, and for every dead-end schema that only
+// admits an empty value or none at all. Descriptions help the model fill
+// properties correctly, so --schema-strict reports them.
+func (c *Config) SchemaWarnings() []string {
+	var warnings []string
+	collectMissingDescriptions(c.ResponseSchema, "", &warnings)
+	collectDeadEnds(c.ResponseSchema, "", &warnings)
+	return warnings
+}
+
+// collectDeadEnds warns about schemas that compile but cannot describe a
+// useful value: closed objects without properties, required properties that
+// a closed object does not list, empty enums and contradictory bounds.
+func collectDeadEnds(node map[string]interface{}, path string, warnings *[]string) {
+	if node == nil {
+		return
+	}
+	name := "responseSchema"
+	if path != "" {
+		name = "responseSchema property " + path
+	}
+	warn := func(format string, args ...interface{}) {
+		*warnings = append(*warnings, name+" "+fmt.Sprintf(format, args...))
+	}
+
+	properties, _ := node["properties"].(map[string]interface{})
+	closed := node["additionalProperties"] == false
+	if closed && len(properties) == 0 {
+		warn("has no properties and additionalProperties: false, so it can only be an empty object")
+	}
+	if required, ok := node["required"].([]interface{}); ok && closed {
+		for _, r := range required {
+			if prop, ok := r.(string); ok {
+				if _, listed := properties[prop]; !listed {
+					warn("requires %s, which additionalProperties: false does not allow", prop)
+				}
+			}
+		}
+	}
+	if enum, ok := node["enum"].([]interface{}); ok && len(enum) == 0 {
+		warn("has an empty enum, so no value is valid")
+	}
+	for _, bounds := range [][2]string{{"minItems", "maxItems"}, {"minLength", "maxLength"}, {"minimum", "maximum"}, {"minProperties", "maxProperties"}} {
+		low, hasMin := schema.Number(node[bounds[0]])
+		high, hasMax := schema.Number(node[bounds[1]])
+		if hasMin && hasMax && low > high {
+			warn("has %s greater than %s, so no value is valid", bounds[0], bounds[1])
+		}
+	}
+	maxItems, hasMaxItems := schema.Number(node["maxItems"])
+	if minItems, _ := schema.Number(node["minItems"]); hasMaxItems && maxItems == 0 && minItems == 0 {
+		warn("has maxItems: 0, so it can only be an empty array")
+	}
+
+	names := make([]string, 0, len(properties))
+	for prop := range properties {
+		names = append(names, prop)
+	}
+	sort.Strings(names)
+	for _, prop := range names {
+		propPath := prop
+		if path != "" {
+			propPath = path + "." + prop
+		}
+		if property, ok := properties[prop].(map[string]interface{}); ok {
+			collectDeadEnds(property, propPath, warnings)
+		}
+	}
+	if items, ok := node["items"].(map[string]interface{}); ok {
+		collectDeadEnds(items, path+"[]", warnings)
+	}
+}
+
+func collectMissingDescriptions(schema map[string]interface{}, path string, warnings *[]string) {
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			propPath := name
+			if path != "" {
+				propPath = path + "." + name
+			}
+			property, ok := properties[name].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if description, _ := property["description"].(string); strings.TrimSpace(description) == "" {
+				*warnings = append(*warnings, fmt.Sprintf("responseSchema property %s has no description", propPath))
+			}
+			collectMissingDescriptions(property, propPath, warnings)
+		}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		collectMissingDescriptions(items, path+"[]", warnings)
+	}
+}
+
+// frontmatterFormat describes a supported frontmatter flavour, recognised by
+// its opening delimiter line.
+type frontmatterFormat struct {
+	name      string
+	delimiter string
+	unmarshal func([]byte, any) error
+}
+
+var frontmatterFormats = []frontmatterFormat{
+	{name: "YAML", delimiter: "---", unmarshal: yaml.Unmarshal},
+	{name: "TOML", delimiter: "+++", unmarshal: toml.Unmarshal},
+}
+
+// ParseFrontmatter extracts frontmatter from markdown content. YAML frontmatter
+// is delimited by --- and TOML frontmatter by +++; the opening delimiter
+// decides which parser is used.
 func ParseFrontmatter(content []byte) (Config, string, error) {
 	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
 
-	if !bytes.HasPrefix(content, []byte("---\n")) {
-		return Config{}, string(content), nil
+	for _, format := range frontmatterFormats {
+		opening := []byte(format.delimiter + "\n")
+		if !bytes.HasPrefix(content, opening) {
+			continue
+		}
+
+		// Remove the opening delimiter and find the closing one
+		rawConfig, markdown, found := bytes.Cut(content[len(opening):], []byte("\n"+format.delimiter+"\n"))
+		if !found {
+			return Config{}, "", fmt.Errorf("invalid frontmatter: missing closing %s", format.delimiter)
+		}
+
+		var config Config
+		if len(rawConfig) > 0 {
+			if err := format.unmarshal(rawConfig, &config); err != nil {
+				// The parser counts lines from the start of the block, which
+				// is one line below the opening delimiter
+				return Config{}, "", fmt.Errorf("failed to parse %s: %w", format.name, mapLines(err, func(line int) int { return line + 1 }))
+			}
+		}
+
+		return config, strings.TrimSpace(string(markdown)), nil
 	}
 
-	// Remove leading "---\n"
-	content = content[4:]
+	return Config{}, string(content), nil
+}
+
+var errorLinePattern = regexp.MustCompile(`line (\d+)`)
+
+// lineShiftedError reports a parser error with its "line N" references
+// renumbered to match the template file.
+type lineShiftedError struct {
+	msg  string
+	line int
+	err  error
+}
 
-	// Find closing "---"
-	yamlContent, markdown, found := bytes.Cut(content, []byte("\n---\n"))
-	if !found {
-		return Config{}, "", fmt.Errorf("invalid frontmatter: missing closing ---")
+func (e *lineShiftedError) Error() string {
+	return e.msg
+}
+
+func (e *lineShiftedError) Unwrap() error {
+	return e.err
+}
+
+// Line returns the first line of the template file the error refers to, or 0
+// when the message names no line.
+func (e *lineShiftedError) Line() int {
+	return e.line
+}
+
+// mapLines renumbers every "line N" reference in err's message with mapLine,
+// such as those in yaml.v3 syntax and type errors.
+func mapLines(err error, mapLine func(int) int) error {
+	first := 0
+	msg := errorLinePattern.ReplaceAllStringFunc(err.Error(), func(match string) string {
+		line, _ := strconv.Atoi(strings.TrimPrefix(match, "line "))
+		line = mapLine(line)
+		if first == 0 {
+			first = line
+		}
+		return fmt.Sprintf("line %d", line)
+	})
+	return &lineShiftedError{msg: msg, line: first, err: err}
+}
+
+// MapErrorLines renumbers the lines a ParseFrontmatter error refers to with
+// mapLine, for content whose lines are not those of the template file, such
+// as content with expanded includes. Other errors are returned unchanged.
+func MapErrorLines(err error, mapLine func(int) int) error {
+	var lineErr *lineShiftedError
+	if !errors.As(err, &lineErr) {
+		return err
 	}
+	return mapLines(err, mapLine)
+}
 
+// SidecarSuffix is appended to a template path to find its sidecar config
+// file, e.g. prompt.md.air.yaml.
+const SidecarSuffix = ".air.yaml"
+
+// ParseSidecar parses the YAML content of a sidecar config file.
+func ParseSidecar(content []byte) (Config, error) {
 	var config Config
-	if len(yamlContent) > 0 {
-		if err := yaml.Unmarshal(yamlContent, &config); err != nil {
-			return Config{}, "", fmt.Errorf("failed to parse YAML: %w", err)
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return Config{}, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	return config, nil
+}
+
+// ParseSchemaFile parses a response schema from a JSON or YAML file.
+func ParseSchemaFile(content []byte) (map[string]interface{}, error) {
+	var responseSchema map[string]interface{}
+	if err := yaml.Unmarshal(content, &responseSchema); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %w", err)
+	}
+	if responseSchema == nil {
+		return nil, fmt.Errorf("schema file is empty")
+	}
+	return responseSchema, nil
+}
+
+// ParseSafetyFile parses a shared safety policy: a JSON or YAML map of harm
+// category to threshold, in the format of safetySettings.
+func ParseSafetyFile(content []byte) (map[string]string, error) {
+	var settings map[string]string
+	if err := yaml.Unmarshal(content, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse safety settings: %w", err)
+	}
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("safety file has no settings")
+	}
+	for category, threshold := range settings {
+		if _, err := ParseHarmCategory(category); err != nil {
+			return nil, err
+		}
+		if _, err := ParseSafetyThreshold(threshold); err != nil {
+			return nil, fmt.Errorf("%s: %w", category, err)
 		}
 	}
+	return settings, nil
+}
+
+// SupportedHarmCategories returns the friendly harm category names accepted
+// in safetySettings, sorted.
+func SupportedHarmCategories() []string {
+	return sortedKeys(HarmCategoryMap)
+}
+
+// SupportedThresholds returns the accepted safety threshold names, sorted.
+func SupportedThresholds() []string {
+	return sortedKeys(SafetyThresholdMap)
+}
 
-	return config, strings.TrimSpace(string(markdown)), nil
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // ParseHarmCategory converts a string harm category to the protobuf enum value.
+// Besides the friendly names in HarmCategoryMap it accepts raw enum names such
+// as HARM_CATEGORY_HARASSMENT, looked up in the protobuf enum descriptor, so
+// categories added to the API work before they get a friendly name.
 func ParseHarmCategory(category string) (aiplatform.HarmCategory, error) {
 	if v, ok := HarmCategoryMap[category]; ok {
 		return v, nil
 	}
+
+	unspecified := aiplatform.HarmCategory_HARM_CATEGORY_UNSPECIFIED
+	if value := unspecified.Descriptor().Values().ByName(protoreflect.Name(category)); value != nil && value.Number() != unspecified.Number() {
+		return aiplatform.HarmCategory(value.Number()), nil
+	}
+
 	return 0, fmt.Errorf("unknown harm category: %s", category)
 }
 
@@ -157,8 +781,33 @@ func ParseSafetyThreshold(threshold string) (aiplatform.SafetySetting_HarmBlockT
 	return 0, fmt.Errorf("unknown safety threshold: %s", threshold)
 }
 
+// UniformSafetySettings returns safety settings that apply threshold to every
+// harm category, as --safety does.
+func UniformSafetySettings(threshold string) (map[string]string, error) {
+	if _, err := ParseSafetyThreshold(threshold); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(HarmCategoryMap))
+	for category := range HarmCategoryMap {
+		settings[category] = threshold
+	}
+	return settings, nil
+}
+
+// ParseHarmProbability converts a safety rating level such as MEDIUM, in any
+// case, to the protobuf enum value.
+func ParseHarmProbability(level string) (aiplatform.SafetyRating_HarmProbability, error) {
+	if v, ok := HarmProbabilityMap[strings.ToUpper(level)]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown harm probability: %s (expected NEGLIGIBLE, LOW, MEDIUM or HIGH)", level)
+}
+
 func BuildSafetySettings(config Config) ([]*aiplatform.SafetySetting, error) {
 	if len(config.SafetySettings) == 0 {
+		if config.NoDefaultSafety != nil && *config.NoDefaultSafety {
+			return nil, nil
+		}
 		return DefaultSafetySettings(), nil
 	}
 
@@ -183,6 +832,38 @@ func BuildSafetySettings(config Config) ([]*aiplatform.SafetySetting, error) {
 	return settings, nil
 }
 
+// ValidateNoBlockNone returns an error naming every harm category whose
+// threshold is BLOCK_NONE, including the defaults used when no safety
+// settings are configured.
+func (c *Config) ValidateNoBlockNone() error {
+	settings, err := BuildSafetySettings(*c)
+	if err != nil {
+		return err
+	}
+
+	var unblocked []string
+	for _, setting := range settings {
+		if setting.Threshold != aiplatform.SafetySetting_BLOCK_NONE {
+			continue
+		}
+		name := setting.Category.String()
+		for friendly, category := range HarmCategoryMap {
+			if category == setting.Category {
+				name = friendly
+			}
+		}
+		unblocked = append(unblocked, name)
+	}
+	sort.Strings(unblocked)
+	if len(unblocked) == 0 {
+		return nil
+	}
+	if len(c.SafetySettings) == 0 {
+		return fmt.Errorf("safetySettings: not configured, and the defaults are BLOCK_NONE for %s", strings.Join(unblocked, ", "))
+	}
+	return fmt.Errorf("safetySettings: BLOCK_NONE for %s", strings.Join(unblocked, ", "))
+}
+
 func DefaultSafetySettings() []*aiplatform.SafetySetting {
 	return []*aiplatform.SafetySetting{
 		{Category: aiplatform.HarmCategory_HARM_CATEGORY_HATE_SPEECH, Threshold: aiplatform.SafetySetting_BLOCK_NONE},
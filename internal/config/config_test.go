@@ -1,6 +1,8 @@
 package config
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
 	aiplatform "cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
@@ -68,6 +70,264 @@ Hello world`,
 	}
 }
 
+func TestParseFrontmatterTopK(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *int32
+	}{
+		{"set", "---\ntopK: 40\n---\nPrompt", &[]int32{40}[0]},
+		{"TOML", "+++\ntopK = 40\n+++\nPrompt", &[]int32{40}[0]},
+		{"absent", "---\ntopP: 0.9\n---\nPrompt", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, _, err := ParseFrontmatter([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("ParseFrontmatter() error = %v", err)
+			}
+			// An absent topK stays nil so no value is forced on the model
+			if !reflect.DeepEqual(config.TopK, tt.want) {
+				t.Errorf("ParseFrontmatter() config.TopK = %v, want %v", config.TopK, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFrontmatter_TOML(t *testing.T) {
+	content := `+++
+temperature = 0.5
+topP = 0.9
+maxTokens = 1024
+model = "gemini-1.5-pro-002"
+
+[safetySettings]
+hate_speech = "BLOCK_ONLY_HIGH"
+
+[variables]
+name = "Alice"
+
+[responseSchema]
+type = "object"
++++
+Hello {{name}}`
+
+	config, body, err := ParseFrontmatter([]byte(content))
+	if err != nil {
+		t.Fatalf("ParseFrontmatter() error = %v", err)
+	}
+
+	if body != "Hello {{name}}" {
+		t.Errorf("ParseFrontmatter() body = %q, want %q", body, "Hello {{name}}")
+	}
+	if config.Model != "gemini-1.5-pro-002" {
+		t.Errorf("ParseFrontmatter() config.Model = %v, want gemini-1.5-pro-002", config.Model)
+	}
+	if config.Temperature == nil || *config.Temperature != 0.5 {
+		t.Errorf("ParseFrontmatter() config.Temperature = %v, want 0.5", config.Temperature)
+	}
+	if config.TopP == nil || *config.TopP != 0.9 {
+		t.Errorf("ParseFrontmatter() config.TopP = %v, want 0.9", config.TopP)
+	}
+	if config.MaxTokens == nil || *config.MaxTokens != 1024 {
+		t.Errorf("ParseFrontmatter() config.MaxTokens = %v, want 1024", config.MaxTokens)
+	}
+	if config.SafetySettings["hate_speech"] != "BLOCK_ONLY_HIGH" {
+		t.Errorf("ParseFrontmatter() config.SafetySettings = %v", config.SafetySettings)
+	}
+	if config.Variables["name"] != "Alice" {
+		t.Errorf("ParseFrontmatter() config.Variables = %v", config.Variables)
+	}
+	if config.ResponseSchema["type"] != "object" {
+		t.Errorf("ParseFrontmatter() config.ResponseSchema = %v", config.ResponseSchema)
+	}
+}
+
+func TestParseFrontmatter_TOMLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"invalid TOML", "+++\ntemperature = = 0.5\n+++\nHello"},
+		{"missing closing delimiter", "+++\ntemperature = 0.5\nHello"},
+		{"mismatched delimiters", "+++\ntemperature = 0.5\n---\nHello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ParseFrontmatter([]byte(tt.content)); err == nil {
+				t.Error("ParseFrontmatter() expected error")
+			}
+		})
+	}
+}
+
+func TestParseFrontmatterErrorLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantLine string
+	}{
+		{"type error", "---\nmodel: gemini-1.5-pro-002\ntemperature: hot\n---\nPrompt", "line 3"},
+		{"syntax error", "---\nmodel: x\n\n  bad: : y\n---\nPrompt", "line 4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseFrontmatter([]byte(tt.content))
+			if err == nil {
+				t.Fatal("ParseFrontmatter() expected error")
+			}
+			if !strings.Contains(err.Error(), tt.wantLine) {
+				t.Errorf("ParseFrontmatter() error = %v, want it to mention %s", err, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestConfigWithProfile(t *testing.T) {
+	content := `---
+model: gemini-1.5-pro-002
+temperature: 0.2
+variables:
+  env: base
+  name: Alice
+profiles:
+  dev:
+    model: gemini-2.0-flash-001
+    variables:
+      env: dev
+  prod:
+    maxTokens: 4096
+---
+Hello`
+
+	base, _, err := ParseFrontmatter([]byte(content))
+	if err != nil {
+		t.Fatalf("ParseFrontmatter() error = %v", err)
+	}
+
+	dev, err := base.WithProfile("dev")
+	if err != nil {
+		t.Fatalf("WithProfile(dev) error = %v", err)
+	}
+	if dev.Model != "gemini-2.0-flash-001" {
+		t.Errorf("WithProfile(dev).Model = %v, want gemini-2.0-flash-001", dev.Model)
+	}
+	if dev.Temperature == nil || *dev.Temperature != 0.2 {
+		t.Errorf("WithProfile(dev).Temperature = %v, want base value 0.2", dev.Temperature)
+	}
+	if dev.Variables["env"] != "dev" || dev.Variables["name"] != "Alice" {
+		t.Errorf("WithProfile(dev).Variables = %v, want merged variables", dev.Variables)
+	}
+	if base.Variables["env"] != "base" {
+		t.Errorf("WithProfile() modified base variables: %v", base.Variables)
+	}
+
+	prod, err := base.WithProfile("prod")
+	if err != nil {
+		t.Fatalf("WithProfile(prod) error = %v", err)
+	}
+	if prod.Model != "gemini-1.5-pro-002" {
+		t.Errorf("WithProfile(prod).Model = %v, want base model", prod.Model)
+	}
+	if prod.MaxTokens == nil || *prod.MaxTokens != 4096 {
+		t.Errorf("WithProfile(prod).MaxTokens = %v, want 4096", prod.MaxTokens)
+	}
+
+	if _, err := base.WithProfile("staging"); err == nil {
+		t.Error("WithProfile(staging) expected error for unknown profile")
+	}
+}
+
+func TestMergeSidecar(t *testing.T) {
+	sidecar, err := ParseSidecar([]byte(`model: gemini-1.5-pro-002
+temperature: 0.2
+variables:
+  tone: formal
+  name: Alice
+profiles:
+  dev:
+    model: gemini-2.0-flash-001
+`))
+	if err != nil {
+		t.Fatalf("ParseSidecar() error = %v", err)
+	}
+
+	inline, _, err := ParseFrontmatter([]byte("---\nmodel: gemini-1.5-flash-002\nvariables:\n  tone: casual\n---\nHello"))
+	if err != nil {
+		t.Fatalf("ParseFrontmatter() error = %v", err)
+	}
+
+	got := Merge(sidecar, inline)
+	if got.Model != "gemini-1.5-flash-002" {
+		t.Errorf("Merge().Model = %v, want inline model", got.Model)
+	}
+	if got.Temperature == nil || *got.Temperature != 0.2 {
+		t.Errorf("Merge().Temperature = %v, want sidecar value 0.2", got.Temperature)
+	}
+	if got.Variables["tone"] != "casual" || got.Variables["name"] != "Alice" {
+		t.Errorf("Merge().Variables = %v, want inline tone and sidecar name", got.Variables)
+	}
+	if _, ok := got.Profiles["dev"]; !ok {
+		t.Errorf("Merge().Profiles = %v, want sidecar dev profile", got.Profiles)
+	}
+
+	if _, err := ParseSidecar([]byte("model: [unclosed")); err == nil {
+		t.Error("ParseSidecar() expected error for invalid YAML")
+	}
+}
+
+func TestParseSchemaFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"json", `{"type": "object", "properties": {"name": {"type": "string"}}}`, false},
+		{"yaml", "type: object\nproperties:\n  name:\n    type: string\n", false},
+		{"empty", "", true},
+		{"invalid", "type: [unclosed", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSchemaFile([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSchemaFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			properties, _ := got["properties"].(map[string]interface{})
+			if got["type"] != "object" || properties["name"] == nil {
+				t.Errorf("ParseSchemaFile() = %v", got)
+			}
+		})
+	}
+}
+
+func TestSupportedSafetyValues(t *testing.T) {
+	categories := SupportedHarmCategories()
+	if want := []string{"dangerous_content", "harassment", "hate_speech", "sexually_explicit"}; !reflect.DeepEqual(categories, want) {
+		t.Errorf("SupportedHarmCategories() = %v, want %v", categories, want)
+	}
+	for _, category := range categories {
+		if _, ok := HarmCategoryMap[category]; !ok {
+			t.Errorf("SupportedHarmCategories() returned %q, which is not in HarmCategoryMap", category)
+		}
+	}
+
+	thresholds := SupportedThresholds()
+	if want := []string{"BLOCK_LOW_AND_ABOVE", "BLOCK_MEDIUM_AND_ABOVE", "BLOCK_NONE", "BLOCK_ONLY_HIGH"}; !reflect.DeepEqual(thresholds, want) {
+		t.Errorf("SupportedThresholds() = %v, want %v", thresholds, want)
+	}
+	if len(thresholds) != len(SafetyThresholdMap) {
+		t.Errorf("SupportedThresholds() has %d entries, want %d", len(thresholds), len(SafetyThresholdMap))
+	}
+}
+
 func TestParseHarmCategory(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -77,6 +337,9 @@ func TestParseHarmCategory(t *testing.T) {
 	}{
 		{"hate_speech", "hate_speech", aiplatform.HarmCategory_HARM_CATEGORY_HATE_SPEECH, false},
 		{"dangerous_content", "dangerous_content", aiplatform.HarmCategory_HARM_CATEGORY_DANGEROUS_CONTENT, false},
+		{"raw enum name", "HARM_CATEGORY_HARASSMENT", aiplatform.HarmCategory_HARM_CATEGORY_HARASSMENT, false},
+		{"raw unspecified", "HARM_CATEGORY_UNSPECIFIED", 0, true},
+		{"raw unknown", "HARM_CATEGORY_FOO", 0, true},
 		{"invalid", "invalid", 0, true},
 	}
 
@@ -120,6 +383,78 @@ func TestParseSafetyThreshold(t *testing.T) {
 	}
 }
 
+func TestDropEmptySchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		schema      map[string]interface{}
+		wantDropped bool
+		wantEnabled bool
+	}{
+		{"no schema", nil, false, false},
+		{"empty schema", map[string]interface{}{}, true, false},
+		{"schema", map[string]interface{}{"type": "object"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{ResponseSchema: tt.schema}
+			if cfg.SchemaEnabled() != tt.wantEnabled {
+				t.Errorf("SchemaEnabled() = %v, want %v", cfg.SchemaEnabled(), tt.wantEnabled)
+			}
+			if dropped := cfg.DropEmptySchema(); dropped != tt.wantDropped {
+				t.Errorf("DropEmptySchema() = %v, want %v", dropped, tt.wantDropped)
+			}
+			if tt.wantDropped && cfg.ResponseSchema != nil {
+				t.Errorf("ResponseSchema = %v after DropEmptySchema(), want nil", cfg.ResponseSchema)
+			}
+		})
+	}
+}
+
+func TestParseHarmProbability(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    aiplatform.SafetyRating_HarmProbability
+		wantErr bool
+	}{
+		{"MEDIUM", aiplatform.SafetyRating_MEDIUM, false},
+		{"low", aiplatform.SafetyRating_LOW, false},
+		{"HARM_PROBABILITY_UNSPECIFIED", 0, true},
+		{"SEVERE", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseHarmProbability(tt.level)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseHarmProbability(%q) error = %v, wantErr %v", tt.level, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseHarmProbability(%q) = %v, want %v", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestUniformSafetySettings(t *testing.T) {
+	got, err := UniformSafetySettings("BLOCK_ONLY_HIGH")
+	if err != nil {
+		t.Fatalf("UniformSafetySettings() error = %v", err)
+	}
+	want := map[string]string{
+		"hate_speech":       "BLOCK_ONLY_HIGH",
+		"dangerous_content": "BLOCK_ONLY_HIGH",
+		"sexually_explicit": "BLOCK_ONLY_HIGH",
+		"harassment":        "BLOCK_ONLY_HIGH",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UniformSafetySettings() = %v, want %v", got, want)
+	}
+
+	if _, err := UniformSafetySettings("BLOCK_SOME"); err == nil {
+		t.Error("UniformSafetySettings(BLOCK_SOME) expected error")
+	}
+}
+
 func TestBuildSafetySettings(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -172,6 +507,8 @@ func TestBuildSafetySettings(t *testing.T) {
 }
 
 func TestConfigValidate(t *testing.T) {
+	promptTokens, zeroPromptTokens := int32(1000), int32(0)
+	topK, zeroTopK, negativeTopK := int32(40), int32(0), int32(-1)
 	tests := []struct {
 		name    string
 		config  Config
@@ -180,6 +517,16 @@ func TestConfigValidate(t *testing.T) {
 		{"valid config", Config{Model: "gemini-2.0-flash-001"}, false},
 		{"invalid model", Config{Model: "invalid"}, true},
 		{"invalid safety category", Config{SafetySettings: map[string]string{"invalid": "BLOCK_NONE"}}, true},
+		{"cache key and prefix", Config{CacheKey: "docs", CachePrefix: "docs.md"}, false},
+		{"cache key without prefix", Config{CacheKey: "docs"}, true},
+		{"cache prefix without key", Config{CachePrefix: "docs.md"}, true},
+		{"system instruction", Config{SystemInstruction: "Be brief."}, false},
+		{"system instruction with cache", Config{SystemInstruction: "Be brief.", CacheKey: "docs", CachePrefix: "docs.md"}, true},
+		{"max prompt tokens", Config{MaxPromptTokens: &promptTokens}, false},
+		{"zero max prompt tokens", Config{MaxPromptTokens: &zeroPromptTokens}, true},
+		{"top k", Config{TopK: &topK}, false},
+		{"zero top k", Config{TopK: &zeroTopK}, true},
+		{"negative top k", Config{TopK: &negativeTopK}, true},
 	}
 
 	for _, tt := range tests {
@@ -192,6 +539,182 @@ func TestConfigValidate(t *testing.T) {
 	}
 }
 
+func TestConfigValidateNoBlockNone(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		wantErr  string
+	}{
+		{"defaults", nil, "not configured, and the defaults are BLOCK_NONE for dangerous_content, harassment, hate_speech, sexually_explicit"},
+		{"one BLOCK_NONE", map[string]string{"hate_speech": "BLOCK_ONLY_HIGH", "harassment": "BLOCK_NONE"}, "BLOCK_NONE for harassment"},
+		{"all blocking", map[string]string{"hate_speech": "BLOCK_ONLY_HIGH", "harassment": "BLOCK_LOW_AND_ABOVE"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{SafetySettings: tt.settings}
+			err := cfg.ValidateNoBlockNone()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateNoBlockNone() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateNoBlockNone() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestModelOrDefaultEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		env       string
+		wantModel string
+		wantErr   bool
+	}{
+		{"builtin default", Config{}, "", DefaultModel, false},
+		{"env default", Config{}, "gemini-1.5-pro-002", "gemini-1.5-pro-002", false},
+		{"frontmatter overrides env", Config{Model: "gemini-1.5-flash-002"}, "gemini-1.5-pro-002", "gemini-1.5-flash-002", false},
+		{"invalid env default", Config{}, "gemini-99", DefaultModel, true},
+		{"invalid env ignored when model set", Config{Model: "gemini-1.5-flash-002"}, "gemini-99", "gemini-1.5-flash-002", false},
+		{"unlisted frontmatter model", Config{Model: "gemini-2.5-pro"}, "", "gemini-2.5-pro", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.ApplyEnvDefaults(map[string]string{DefaultModelEnv: tt.env})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ApplyEnvDefaults() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := tt.config.ModelOrDefault(); got != tt.wantModel {
+				t.Errorf("ModelOrDefault() = %v, want %v", got, tt.wantModel)
+			}
+			if err := tt.config.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestParseFrontmatterMaxTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    TokenCount
+		wantErr string
+	}{
+		{"plain integer", "---\nmaxTokens: 1000\n---\nPrompt", 1000, ""},
+		{"8k", "---\nmaxTokens: 8k\n---\nPrompt", 8192, ""},
+		{"32k", "---\nmaxTokens: 32K\n---\nPrompt", 32768, ""},
+		{"TOML string", "+++\nmaxTokens = \"8k\"\n+++\nPrompt", 8192, ""},
+		{"TOML integer", "+++\nmaxTokens = 512\n+++\nPrompt", 512, ""},
+		{"invalid suffix", "---\nmodel: gemini-1.5-pro-002\nmaxTokens: 8m\n---\nPrompt", 0, `line 3: invalid token count "8m"`},
+		{"fraction", "---\nmaxTokens: 1.5k\n---\nPrompt", 0, `invalid token count "1.5k"`},
+		{"overflow", "---\nmaxTokens: 3000000k\n---\nPrompt", 0, `invalid token count "3000000k"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _, err := ParseFrontmatter([]byte(tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseFrontmatter() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFrontmatter() error = %v", err)
+			}
+			if cfg.MaxTokens == nil || *cfg.MaxTokens != tt.want {
+				t.Errorf("ParseFrontmatter() MaxTokens = %v, want %d", cfg.MaxTokens, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidateMaxTokensCeiling(t *testing.T) {
+	atLimit := TokenCount(8192)
+	overLimit := TokenCount(100000)
+
+	tests := []struct {
+		name    string
+		config  Config
+		env     string
+		wantErr bool
+	}{
+		{"at the limit", Config{Model: "gemini-1.5-pro-002", MaxTokens: &atLimit}, "", false},
+		{"over the limit", Config{Model: "gemini-1.5-pro-002", MaxTokens: &overLimit}, "", true},
+		{"over the limit for default model", Config{MaxTokens: &overLimit}, "", true},
+		{"env default over the limit", Config{Model: "gemini-1.5-flash-002"}, "100000", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.ApplyEnvDefaults(map[string]string{DefaultMaxTokensEnv: tt.env}); err != nil {
+				t.Fatalf("ApplyEnvDefaults() error = %v", err)
+			}
+			err := tt.config.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "limit of 8192") {
+				t.Errorf("Validate() error = %v, want the model's limit", err)
+			}
+		})
+	}
+
+	// Models without a known ceiling are not checked
+	delete(MaxOutputTokens, "gemini-1.5-pro-002")
+	defer func() { MaxOutputTokens["gemini-1.5-pro-002"] = 8192 }()
+	if err := (&Config{Model: "gemini-1.5-pro-002", MaxTokens: &overLimit}).Validate(); err != nil {
+		t.Errorf("Validate() error = %v for a model without a ceiling", err)
+	}
+}
+
+func TestGenerationParamsEnvDefaults(t *testing.T) {
+	temperature := float32(0.7)
+	maxTokens := TokenCount(512)
+
+	tests := []struct {
+		name            string
+		config          Config
+		envTemperature  string
+		envMaxTokens    string
+		wantTemperature float32
+		wantMaxTokens   int32
+		wantErr         bool
+	}{
+		{"builtin defaults", Config{}, "", "", DefaultTemperature, DefaultMaxTokens, false},
+		{"env defaults", Config{}, "0.4", "1024", 0.4, 1024, false},
+		{"frontmatter overrides env", Config{Temperature: &temperature, MaxTokens: &maxTokens}, "0.4", "1024", 0.7, 512, false},
+		{"invalid temperature", Config{}, "hot", "", DefaultTemperature, DefaultMaxTokens, true},
+		{"temperature out of range", Config{}, "3", "", DefaultTemperature, DefaultMaxTokens, true},
+		{"invalid max tokens", Config{}, "", "0", DefaultTemperature, DefaultMaxTokens, true},
+		{"invalid env ignored when set", Config{Temperature: &temperature, MaxTokens: &maxTokens}, "hot", "lots", 0.7, 512, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{DefaultTemperatureEnv: tt.envTemperature, DefaultMaxTokensEnv: tt.envMaxTokens}
+			if err := tt.config.ApplyEnvDefaults(env); (err != nil) != tt.wantErr {
+				t.Errorf("ApplyEnvDefaults() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := tt.config.TemperatureOrDefault(); got != tt.wantTemperature {
+				t.Errorf("TemperatureOrDefault() = %v, want %v", got, tt.wantTemperature)
+			}
+			if got := tt.config.MaxTokensOrDefault(); got != tt.wantMaxTokens {
+				t.Errorf("MaxTokensOrDefault() = %v, want %v", got, tt.wantMaxTokens)
+			}
+		})
+	}
+}
+
 func TestConfigValidateSchema(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -202,6 +725,11 @@ func TestConfigValidateSchema(t *testing.T) {
 		{"valid schema", Config{ResponseSchema: map[string]interface{}{"type": "string"}}, false},
 		{"invalid JSON", Config{ResponseSchema: map[string]interface{}{"type": make(chan int)}}, true},
 		{"invalid schema", Config{ResponseSchema: map[string]interface{}{"type": "invalid"}}, true},
+		{"unknown propertyOrdering entry", Config{ResponseSchema: map[string]interface{}{
+			"type":             "object",
+			"properties":       map[string]interface{}{"name": map[string]interface{}{"type": "string"}},
+			"propertyOrdering": []interface{}{"age"},
+		}}, true},
 	}
 
 	for _, tt := range tests {
@@ -213,3 +741,167 @@ func TestConfigValidateSchema(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigSchemaWarnings(t *testing.T) {
+	content := `---
+responseSchema:
+  type: object
+  properties:
+    name:
+      type: string
+      description: Full name
+    age:
+      type: integer
+    tags:
+      type: array
+      description: Labels
+      items:
+        type: object
+        properties:
+          label:
+            type: string
+---
+Prompt`
+
+	cfg, _, err := ParseFrontmatter([]byte(content))
+	if err != nil {
+		t.Fatalf("ParseFrontmatter() error = %v", err)
+	}
+
+	want := []string{
+		"responseSchema property age has no description",
+		"responseSchema property tags[].label has no description",
+	}
+	if got := cfg.SchemaWarnings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SchemaWarnings() = %v, want %v", got, want)
+	}
+
+	if got := (&Config{}).SchemaWarnings(); got != nil {
+		t.Errorf("SchemaWarnings() without schema = %v, want nil", got)
+	}
+}
+
+func TestConfigSchemaWarningsDeadEnds(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema map[string]interface{}
+		want   []string
+	}{
+		{
+			"closed object without properties",
+			map[string]interface{}{"type": "object", "additionalProperties": false},
+			[]string{"responseSchema has no properties and additionalProperties: false, so it can only be an empty object"},
+		},
+		{
+			"required property not listed",
+			map[string]interface{}{
+				"type":                 "object",
+				"properties":           map[string]interface{}{"name": map[string]interface{}{"type": "string", "description": "Name"}},
+				"required":             []interface{}{"name", "age"},
+				"additionalProperties": false,
+			},
+			[]string{"responseSchema requires age, which additionalProperties: false does not allow"},
+		},
+		{
+			"nested empty enum",
+			map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"mood": map[string]interface{}{"type": "string", "description": "Mood", "enum": []interface{}{}}},
+			},
+			[]string{"responseSchema property mood has an empty enum, so no value is valid"},
+		},
+		{
+			"contradictory bounds",
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "minItems": 3, "maxItems": 1.0},
+			[]string{"responseSchema has minItems greater than maxItems, so no value is valid"},
+		},
+		{
+			"empty array",
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string", "minLength": 5, "maxLength": 2}, "maxItems": 0},
+			[]string{
+				"responseSchema has maxItems: 0, so it can only be an empty array",
+				"responseSchema property [] has minLength greater than maxLength, so no value is valid",
+			},
+		},
+		{
+			"open object without properties",
+			map[string]interface{}{"type": "object"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{ResponseSchema: tt.schema}
+			if got := cfg.SchemaWarnings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SchemaWarnings() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSampleConfig(t *testing.T) {
+	sample := SampleConfig()
+
+	for _, key := range []string{"temperature: ", "model: ", "# cacheKey: "} {
+		if !strings.Contains(sample, "\n"+key) {
+			t.Errorf("SampleConfig() is missing %q", key)
+		}
+	}
+
+	// sampleKeys is kept by hand, so every key must be annotated and every
+	// annotation must belong to a key
+	typ := reflect.TypeOf(Config{})
+	keys := make(map[string]bool)
+	for i := 0; i < typ.NumField(); i++ {
+		name := yamlKey(typ.Field(i))
+		if name == "" {
+			continue
+		}
+		keys[name] = true
+		if _, ok := sampleKeys[name]; !ok {
+			t.Errorf("Config field %s (%s) has no entry in sampleKeys", typ.Field(i).Name, name)
+		}
+	}
+	for name := range sampleKeys {
+		if !keys[name] {
+			t.Errorf("sampleKeys entry %s is not a key of Config", name)
+		}
+	}
+
+	cfg, _, err := ParseFrontmatter([]byte(sample + "Prompt"))
+	if err != nil {
+		t.Fatalf("ParseFrontmatter(SampleConfig()) error = %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("SampleConfig() does not validate: %v", err)
+	}
+}
+
+func TestParseSafetyFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"yaml", "hate_speech: BLOCK_LOW_AND_ABOVE\nHARM_CATEGORY_HARASSMENT: BLOCK_ONLY_HIGH\n", map[string]string{"hate_speech": "BLOCK_LOW_AND_ABOVE", "HARM_CATEGORY_HARASSMENT": "BLOCK_ONLY_HIGH"}, false},
+		{"json", `{"dangerous_content": "BLOCK_MEDIUM_AND_ABOVE"}`, map[string]string{"dangerous_content": "BLOCK_MEDIUM_AND_ABOVE"}, false},
+		{"unknown category", "violence: BLOCK_NONE\n", nil, true},
+		{"unknown threshold", "hate_speech: BLOCK_SOME\n", nil, true},
+		{"empty", "", nil, true},
+		{"not a map", "- hate_speech\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSafetyFile([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSafetyFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSafetyFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
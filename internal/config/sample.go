@@ -0,0 +1,153 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// sampleKey documents a frontmatter key for SampleConfig. Optional keys are
+// printed commented out so the sample is valid frontmatter as it stands.
+type sampleKey struct {
+	comment  string
+	example  string
+	optional bool
+}
+
+// sampleKeys holds the annotation of every Config key, by its YAML name.
+var sampleKeys = map[string]sampleKey{
+	"temperature": {
+		comment: fmt.Sprintf("Randomness of the response, 0.0 to 2.0 (default %v, or $%s)", DefaultTemperature, DefaultTemperatureEnv),
+		example: fmt.Sprintf("%.1f", DefaultTemperature),
+	},
+	"topP": {
+		comment: fmt.Sprintf("Nucleus sampling threshold, 0.0 to 1.0 (default %v)", DefaultTopP),
+		example: fmt.Sprintf("%v", DefaultTopP),
+	},
+	"topK": {
+		comment:  "Sample from the K most likely tokens, applied before topP (default: the model's)",
+		example:  "40",
+		optional: true,
+	},
+	"maxTokens": {
+		comment: fmt.Sprintf("Maximum number of output tokens (default %d, or $%s)", DefaultMaxTokens, DefaultMaxTokensEnv),
+		example: fmt.Sprintf("%d", DefaultMaxTokens),
+	},
+	"maxPromptTokens": {
+		comment:  "Refuse to send prompts larger than this many tokens",
+		example:  "100000",
+		optional: true,
+	},
+	"responseMimeType": {
+		comment: "Response format, application/json or text/plain",
+		example: DefaultResponseMimeType,
+	},
+	"model": {
+		comment: fmt.Sprintf("Model name, such as %s (default %s, or $%s)", strings.Join(SupportedModels, ", "), DefaultModel, DefaultModelEnv),
+		example: DefaultModel,
+	},
+	"safetySettings": {
+		comment:  "Block threshold per harm category (default BLOCK_NONE for every category)",
+		example:  "\n  hate_speech: BLOCK_LOW_AND_ABOVE\n  harassment: BLOCK_MEDIUM_AND_ABOVE",
+		optional: true,
+	},
+	"variables": {
+		comment:  "Default values of {{placeholders}}, overridden by --vars-file and --var",
+		example:  "\n  tone: formal",
+		optional: true,
+	},
+	"responseSchema": {
+		comment:  "JSON schema the response must follow (with responseMimeType application/json)",
+		example:  "\n  type: object\n  properties:\n    answer:\n      type: string",
+		optional: true,
+	},
+	"profiles": {
+		comment:  "Named sets of these keys, selected with --profile",
+		example:  "\n  dev:\n    model: gemini-1.5-flash-002",
+		optional: true,
+	},
+	"cacheKey": {
+		comment:  "Name of a Vertex AI context cache holding cachePrefix",
+		example:  "product-docs",
+		optional: true,
+	},
+	"cachePrefix": {
+		comment:  "File sent once and cached under cacheKey",
+		example:  "docs/products.md",
+		optional: true,
+	},
+	"systemInstruction": {
+		comment:  "System instruction sent apart from the prompt, e.g. a persona; placeholders are replaced",
+		example:  "\"You are a concise technical writer.\"",
+		optional: true,
+	},
+	"localeHint": {
+		comment:  "Instruction appended to the prompt with --locale",
+		example:  fmt.Sprintf("%q", DefaultLocaleHint),
+		optional: true,
+	},
+	"dateFormat": {
+		comment:  "Go time layout of the {{today}} variable (default 2006-01-02)",
+		example:  "2 January 2006",
+		optional: true,
+	},
+	"includeKeyword": {
+		comment:  "Directive name used instead of include, e.g. {{import \"file.md\"}}",
+		example:  "import",
+		optional: true,
+	},
+	"noDefaultSafety": {
+		comment:  "Without safetySettings, send none so the project's defaults apply, instead of BLOCK_NONE",
+		example:  "true",
+		optional: true,
+	},
+	"history": {
+		comment:  "Conversation file, as written by --save-conversation, sent before the prompt",
+		example:  "chat.yaml",
+		optional: true,
+	},
+}
+
+// SampleConfig returns an annotated YAML frontmatter block with every key of
+// Config, in the order of its fields.
+func SampleConfig() string {
+	var b strings.Builder
+	b.WriteString("---\n")
+
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlKey(t.Field(i))
+		if name == "" {
+			continue
+		}
+
+		key, ok := sampleKeys[name]
+		if !ok {
+			key = sampleKey{comment: fmt.Sprintf("(%s)", t.Field(i).Type), optional: true}
+		}
+
+		fmt.Fprintf(&b, "\n# %s\n", key.comment)
+		line := name + ":"
+		if key.example != "" && !strings.HasPrefix(key.example, "\n") {
+			line += " "
+		}
+		line += key.example
+		if key.optional {
+			line = "# " + strings.ReplaceAll(line, "\n", "\n# ")
+		}
+		b.WriteString(line + "\n")
+	}
+
+	b.WriteString("---\n")
+	return b.String()
+}
+
+// yamlKey returns the frontmatter key of a Config field, or "" for fields
+// that are not read from frontmatter.
+func yamlKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
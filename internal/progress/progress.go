@@ -0,0 +1,49 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+)
+
+// Percent estimates completion of a response as outputTokens / maxTokens,
+// capped at 100. It returns -1 when maxTokens is unbounded (zero or negative).
+func Percent(outputTokens, maxTokens int32) int {
+	if maxTokens <= 0 {
+		return -1
+	}
+	percent := int(int64(outputTokens) * 100 / int64(maxTokens))
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// Reporter renders a single-line progress indicator for a streamed response.
+type Reporter struct {
+	w         io.Writer
+	maxTokens int32
+	last      int
+}
+
+func NewReporter(w io.Writer, maxTokens int32) *Reporter {
+	return &Reporter{w: w, maxTokens: maxTokens, last: -1}
+}
+
+// Update redraws the indicator when the percentage has changed.
+func (r *Reporter) Update(outputTokens int32) {
+	percent := Percent(outputTokens, r.maxTokens)
+	if percent < 0 || percent == r.last {
+		return
+	}
+	r.last = percent
+	fmt.Fprintf(r.w, "\rGenerating... %3d%%", percent)
+}
+
+// Done clears the indicator line if anything was drawn, so the reporter can
+// be reused for another response.
+func (r *Reporter) Done() {
+	if r.last >= 0 {
+		fmt.Fprint(r.w, "\r\033[K")
+	}
+	r.last = -1
+}
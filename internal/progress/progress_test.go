@@ -0,0 +1,66 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		name         string
+		outputTokens int32
+		maxTokens    int32
+		want         int
+	}{
+		{"start", 0, 8192, 0},
+		{"halfway", 4096, 8192, 50},
+		{"rounds down", 999, 1000, 99},
+		{"complete", 8192, 8192, 100},
+		{"estimate overshoots", 9000, 8192, 100},
+		{"unbounded", 100, 0, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Percent(tt.outputTokens, tt.maxTokens); got != tt.want {
+				t.Errorf("Percent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReporter(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewReporter(&buf, 200)
+
+	for _, tokens := range []int32{50, 50, 100, 200} {
+		r.Update(tokens)
+	}
+	r.Done()
+
+	output := buf.String()
+	for _, want := range []string{" 25%", " 50%", "100%"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Reporter output should contain %q, got: %q", want, output)
+		}
+	}
+	if strings.Count(output, "Generating") != 3 {
+		t.Errorf("Reporter should redraw only on change, got: %q", output)
+	}
+	if !strings.HasSuffix(output, "\r\033[K") {
+		t.Errorf("Done() should clear the line, got: %q", output)
+	}
+}
+
+func TestReporterUnbounded(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewReporter(&buf, 0)
+
+	r.Update(100)
+	r.Done()
+
+	if buf.Len() != 0 {
+		t.Errorf("Reporter should not render for unbounded maxTokens, got: %q", buf.String())
+	}
+}
@@ -1,13 +1,23 @@
 package schema
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	aiplatform "cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
 	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
+// ConvertSchemaToProtobuf converts a JSON schema to the Vertex AI protobuf
+// schema. The protobuf schema has no additionalProperties; the model only
+// generates the listed properties, which is what additionalProperties: false
+// asks for, so the keyword is left out and enforced by ValidateResponse.
 func ConvertSchemaToProtobuf(schema map[string]interface{}) *aiplatform.Schema {
 	pbSchema := &aiplatform.Schema{}
 
@@ -26,6 +36,11 @@ func ConvertSchemaToProtobuf(schema map[string]interface{}) *aiplatform.Schema {
 		}
 	}
 
+	// Descriptions tell the model what to put in each field
+	if description, ok := schema["description"].(string); ok {
+		pbSchema.Description = description
+	}
+
 	if properties, ok := schema["properties"].(map[string]interface{}); ok {
 		pbSchema.Properties = make(map[string]*aiplatform.Schema)
 		for key, val := range properties {
@@ -39,6 +54,14 @@ func ConvertSchemaToProtobuf(schema map[string]interface{}) *aiplatform.Schema {
 		pbSchema.Items = ConvertSchemaToProtobuf(items)
 	}
 
+	if minItems, ok := toInt64(schema["minItems"]); ok {
+		pbSchema.MinItems = minItems
+	}
+
+	if maxItems, ok := toInt64(schema["maxItems"]); ok {
+		pbSchema.MaxItems = maxItems
+	}
+
 	if enum, ok := schema["enum"].([]interface{}); ok {
 		pbSchema.Enum = make([]string, len(enum))
 		for i, val := range enum {
@@ -60,17 +83,309 @@ func ConvertSchemaToProtobuf(schema map[string]interface{}) *aiplatform.Schema {
 	return pbSchema
 }
 
+// PropertyOrdering returns the normalized propertyOrdering of an object
+// schema: every property exactly once, in the given order, with properties
+// missing from the ordering appended (required ones first, in required order,
+// then the rest alphabetically). Entries that name no property are an error.
+// It returns nil when the schema has no propertyOrdering.
+func PropertyOrdering(schema map[string]interface{}) ([]string, error) {
+	rawOrdering, ok := schema["propertyOrdering"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	seen := make(map[string]bool, len(properties))
+	ordering := make([]string, 0, len(properties))
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			ordering = append(ordering, name)
+		}
+	}
+
+	for _, val := range rawOrdering {
+		name, _ := val.(string)
+		if _, exists := properties[name]; !exists {
+			return nil, fmt.Errorf("propertyOrdering entry %q is not a property", name)
+		}
+		add(name)
+	}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, val := range required {
+			if name, ok := val.(string); ok {
+				if _, exists := properties[name]; exists {
+					add(name)
+				}
+			}
+		}
+	}
+
+	rest := make([]string, 0, len(properties))
+	for name := range properties {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		add(name)
+	}
+
+	return ordering, nil
+}
+
+// ValidatePropertyOrdering checks the propertyOrdering of schema and of every
+// nested object schema.
+//
+// The Vertex AI client in use has no PropertyOrdering field on Schema, so the
+// ordering is validated but not yet sent by ConvertSchemaToProtobuf.
+func ValidatePropertyOrdering(schema map[string]interface{}) error {
+	return validatePropertyOrdering(schema, "")
+}
+
+func validatePropertyOrdering(schema map[string]interface{}, path string) error {
+	return walkSchema(schema, path, func(schema map[string]interface{}) error {
+		_, err := PropertyOrdering(schema)
+		return err
+	})
+}
+
+// ValidateAdditionalProperties checks the additionalProperties of schema and
+// of every nested schema. The model cannot generate properties beyond the
+// listed ones, so only boolean values are accepted; false is enforced when
+// the response is validated.
+func ValidateAdditionalProperties(schema map[string]interface{}) error {
+	return walkSchema(schema, "", func(schema map[string]interface{}) error {
+		additional, ok := schema["additionalProperties"]
+		if !ok {
+			return nil
+		}
+		if _, isBool := additional.(bool); !isBool {
+			return fmt.Errorf("additionalProperties must be true or false; schemas for additional properties are not supported")
+		}
+		return nil
+	})
+}
+
+// walkSchema calls check for schema and every nested property and items
+// schema, prefixing errors with the path of the schema that failed.
+func walkSchema(schema map[string]interface{}, path string, check func(map[string]interface{}) error) error {
+	if err := check(schema); err != nil {
+		if path != "" {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return err
+	}
+
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, val := range properties {
+			if propSchema, ok := val.(map[string]interface{}); ok {
+				propPath := name
+				if path != "" {
+					propPath = path + "." + name
+				}
+				if err := walkSchema(propSchema, propPath, check); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		return walkSchema(items, path+"[]", check)
+	}
+	return nil
+}
+
+// FormatProtobuf converts schema to the Vertex AI protobuf schema and renders
+// it as indented protojson, showing exactly what is sent to the model.
+func FormatProtobuf(schema map[string]interface{}) (string, error) {
+	out, err := protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(ConvertSchemaToProtobuf(schema))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal protobuf schema: %w", err)
+	}
+	return string(out), nil
+}
+
+// Number reports the value of a numeric schema keyword. Depending on the
+// source (YAML, TOML or JSON) numbers arrive as int, int64, uint64 or float64.
+func Number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// toInt64 converts a numeric schema value to int64.
+func toInt64(v interface{}) (int64, bool) {
+	n, ok := Number(v)
+	return int64(n), ok
+}
+
+// StripCodeFence removes a markdown code fence (``` or ```json) wrapping the
+// whole response. Responses without a surrounding fence are returned as is.
+func StripCodeFence(response string) string {
+	trimmed := strings.TrimSpace(response)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") {
+		return response
+	}
+	firstLineEnd := strings.Index(trimmed, "\n")
+	if firstLineEnd < 0 {
+		return response
+	}
+	// The opening fence may carry a language tag, but nothing else
+	if tag := strings.TrimSpace(trimmed[3:firstLineEnd]); strings.ContainsAny(tag, " `") {
+		return response
+	}
+	body := strings.TrimSuffix(trimmed[firstLineEnd+1:], "```")
+	return strings.TrimSpace(body)
+}
+
+// FormatOptions controls how FormatResponseWith lays out a JSON response.
+type FormatOptions struct {
+	// Indent is the number of spaces per nesting level; 0 writes compact
+	// JSON on a single line.
+	Indent int
+
+	// KeepOrder keeps object keys in the order the model wrote them instead
+	// of sorting them.
+	KeepOrder bool
+}
+
+// DefaultFormatOptions is the layout of FormatResponse: two spaces, sorted
+// keys.
+var DefaultFormatOptions = FormatOptions{Indent: 2}
+
 func FormatResponse(response string) string {
-	var jsonData interface{}
-	if err := json.Unmarshal([]byte(response), &jsonData); err != nil {
+	return FormatResponseWith(response, DefaultFormatOptions)
+}
+
+// FormatResponseWith reformats a JSON response, ignoring a surrounding code
+// fence. A response that is not JSON is returned as is. With sorted keys the
+// output only depends on the JSON value, not on how the model spaced or
+// ordered it.
+func FormatResponseWith(response string, opts FormatOptions) string {
+	data := []byte(strings.TrimSpace(StripCodeFence(response)))
+	if !json.Valid(data) {
 		return response // If not JSON, return as is
 	}
-	if formatted, err := json.MarshalIndent(jsonData, "", "  "); err == nil {
-		return string(formatted)
+
+	if !opts.KeepOrder {
+		var jsonData interface{}
+		if err := json.Unmarshal(data, &jsonData); err != nil {
+			return response
+		}
+		formatted, err := json.Marshal(jsonData)
+		if err != nil {
+			return response
+		}
+		data = formatted
+	}
+
+	var b bytes.Buffer
+	var err error
+	if opts.Indent > 0 {
+		err = json.Indent(&b, data, "", strings.Repeat(" ", opts.Indent))
+	} else {
+		err = json.Compact(&b, data)
+	}
+	if err != nil {
+		return response
+	}
+	return b.String()
+}
+
+// ExtractField returns the value at a dotted path, such as
+// "result.items.0.name", in a JSON response. Numeric segments index arrays.
+// Strings are returned without quotes, other values as indented JSON.
+func ExtractField(response, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(StripCodeFence(response)), &value); err != nil {
+		return "", fmt.Errorf("response is not JSON: %w", err)
+	}
+
+	segments := strings.Split(path, ".")
+	for i, segment := range segments {
+		at := strings.Join(segments[:i], ".")
+		if at == "" {
+			at = "the top level"
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			field, ok := v[segment]
+			if !ok {
+				return "", fmt.Errorf("path %s: no field %q at %s", path, segment, at)
+			}
+			value = field
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(v) {
+				return "", fmt.Errorf("path %s: no index %s in the array of %d items at %s", path, segment, len(v), at)
+			}
+			value = v[index]
+		default:
+			return "", fmt.Errorf("path %s: %s is not an object or array", path, at)
+		}
 	}
-	return response
+
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	formatted, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding %s: %w", path, err)
+	}
+	return string(formatted), nil
+}
+
+// Violation is one way in which a response does not match its schema.
+type Violation struct {
+	// Location is the JSON pointer of the offending value, e.g. "/items/0".
+	Location string
+	Message  string
 }
 
+// ViolationsError lists every schema violation of a response.
+type ViolationsError struct {
+	Violations []Violation
+}
+
+func (e *ViolationsError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d schema violation(s):", len(e.Violations))
+	for _, v := range e.Violations {
+		location := v.Location
+		if location == "" {
+			location = "/"
+		}
+		fmt.Fprintf(&b, "\n  - %s: %s", location, v.Message)
+	}
+	return b.String()
+}
+
+// collectViolations flattens the tree of a validation error into the
+// violations at its leaves, which name the individual failing values.
+func collectViolations(err *jsonschema.ValidationError, violations []Violation) []Violation {
+	if len(err.Causes) == 0 {
+		return append(violations, Violation{Location: err.InstanceLocation, Message: err.Message})
+	}
+	for _, cause := range err.Causes {
+		violations = collectViolations(cause, violations)
+	}
+	return violations
+}
+
+// ValidateResponse checks a JSON response against the schema. When it does
+// not match, the error is a *ViolationsError listing every violation.
 func ValidateResponse(response string, schema map[string]interface{}) error {
 	schemaBytes, err := json.Marshal(schema)
 	if err != nil {
@@ -83,9 +398,16 @@ func ValidateResponse(response string, schema map[string]interface{}) error {
 	}
 
 	var data interface{}
-	if err := json.Unmarshal([]byte(response), &data); err != nil {
+	if err := json.Unmarshal([]byte(StripCodeFence(response)), &data); err != nil {
 		return fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
-	return sch.Validate(data)
+	if err := sch.Validate(data); err != nil {
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) {
+			return err
+		}
+		return &ViolationsError{Violations: collectViolations(validationErr, nil)}
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package schema
 
 import (
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 
 	aiplatform "cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
@@ -33,6 +36,19 @@ func TestConvertSchemaToProtobuf(t *testing.T) {
 				return s.Type == aiplatform.Type_OBJECT && s.Properties["name"].Type == aiplatform.Type_STRING
 			},
 		},
+		{
+			name: "descriptions",
+			schema: map[string]interface{}{
+				"type":        "object",
+				"description": "A person",
+				"properties": map[string]interface{}{
+					"name": map[string]interface{}{"type": "string", "description": "Full name"},
+				},
+			},
+			check: func(s *aiplatform.Schema) bool {
+				return s.Description == "A person" && s.Properties["name"].Description == "Full name"
+			},
+		},
 		{
 			name: "array with items",
 			schema: map[string]interface{}{
@@ -83,14 +99,40 @@ func TestFormatResponse(t *testing.T) {
 		wantJSON bool
 	}{
 		{"JSON response", `{"key": "value"}`, true},
+		{"fenced JSON response", "```json\n{\"key\": \"value\"}\n```", true},
 		{"non-JSON response", "plain text", false},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			formatted := FormatResponse(tt.response)
-			if tt.wantJSON && formatted == tt.response {
-				t.Errorf("FormatResponse() should have formatted JSON")
+			if tt.wantJSON && formatted != "{\n  \"key\": \"value\"\n}" {
+				t.Errorf("FormatResponse() = %q, should have formatted JSON", formatted)
+			}
+			if !tt.wantJSON && formatted != tt.response {
+				t.Errorf("FormatResponse() = %q, want unchanged response", formatted)
+			}
+		})
+	}
+}
+
+func TestStripCodeFence(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"unfenced", `{"a": 1}`, `{"a": 1}`},
+		{"json fence", "```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"bare fence with whitespace", "\n```\n[1, 2]\n```\n", "[1, 2]"},
+		{"text around fence", "Here you go:\n```json\n{}\n```", "Here you go:\n```json\n{}\n```"},
+		{"single line", "```{}```", "```{}```"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StripCodeFence(tt.response); got != tt.want {
+				t.Errorf("StripCodeFence() = %q, want %q", got, tt.want)
 			}
 		})
 	}
@@ -114,6 +156,17 @@ func TestValidateResponse(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:     "fenced valid response",
+			response: "```json\n{\"name\": \"test\"}\n```",
+			schema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"name": map[string]interface{}{"type": "string"},
+				},
+			},
+			wantErr: false,
+		},
 		{
 			name:     "invalid JSON",
 			response: `invalid json`,
@@ -142,3 +195,304 @@ func TestValidateResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestPropertyOrdering(t *testing.T) {
+	properties := map[string]interface{}{
+		"name":  map[string]interface{}{"type": "string"},
+		"age":   map[string]interface{}{"type": "integer"},
+		"email": map[string]interface{}{"type": "string"},
+		"city":  map[string]interface{}{"type": "string"},
+	}
+
+	tests := []struct {
+		name    string
+		schema  map[string]interface{}
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "no ordering",
+			schema: map[string]interface{}{"type": "object", "properties": properties},
+			want:   nil,
+		},
+		{
+			name: "complete ordering",
+			schema: map[string]interface{}{
+				"properties":       properties,
+				"propertyOrdering": []interface{}{"email", "name", "city", "age"},
+			},
+			want: []string{"email", "name", "city", "age"},
+		},
+		{
+			name: "missing required and optional properties appended",
+			schema: map[string]interface{}{
+				"properties":       properties,
+				"required":         []interface{}{"name", "age"},
+				"propertyOrdering": []interface{}{"age"},
+			},
+			want: []string{"age", "name", "city", "email"},
+		},
+		{
+			name: "duplicates removed",
+			schema: map[string]interface{}{
+				"properties":       properties,
+				"propertyOrdering": []interface{}{"name", "name", "age", "email", "city"},
+			},
+			want: []string{"name", "age", "email", "city"},
+		},
+		{
+			name: "unknown entry",
+			schema: map[string]interface{}{
+				"properties":       properties,
+				"propertyOrdering": []interface{}{"name", "phone"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PropertyOrdering(tt.schema)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PropertyOrdering() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PropertyOrdering() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePropertyOrderingNested(t *testing.T) {
+	nested := map[string]interface{}{
+		"type": "array",
+		"items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"label": map[string]interface{}{"type": "string"},
+			},
+			"propertyOrdering": []interface{}{"title"},
+		},
+	}
+
+	err := ValidatePropertyOrdering(map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"tags": nested},
+	})
+	if err == nil || !strings.Contains(err.Error(), `tags[]: propertyOrdering entry "title"`) {
+		t.Errorf("ValidatePropertyOrdering() error = %v, want nested path in error", err)
+	}
+}
+
+func TestAdditionalPropertiesFalse(t *testing.T) {
+	strict := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string"},
+			"address": map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"city": map[string]interface{}{"type": "string"},
+				},
+				"additionalProperties": false,
+			},
+		},
+		"additionalProperties": false,
+	}
+
+	if err := ValidateAdditionalProperties(strict); err != nil {
+		t.Fatalf("ValidateAdditionalProperties() error = %v", err)
+	}
+
+	// The keyword has no protobuf field and is left out of the request
+	pb := ConvertSchemaToProtobuf(strict)
+	if pb.Type != aiplatform.Type_OBJECT || pb.Properties["address"].Properties["city"] == nil {
+		t.Errorf("ConvertSchemaToProtobuf() = %v, want the nested object converted", pb)
+	}
+
+	// It is enforced at every level when the response is validated
+	tests := []struct {
+		name     string
+		response string
+		wantErr  bool
+	}{
+		{"listed properties", `{"name": "Ann", "address": {"city": "Oslo"}}`, false},
+		{"extra top-level property", `{"name": "Ann", "age": 30}`, true},
+		{"extra nested property", `{"name": "Ann", "address": {"city": "Oslo", "zip": "0150"}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateResponse(tt.response, strict); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	err := ValidateAdditionalProperties(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"tags": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": map[string]interface{}{"type": "string"},
+			},
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "tags: additionalProperties") {
+		t.Errorf("ValidateAdditionalProperties() error = %v, want nested path in error", err)
+	}
+}
+
+func TestTopLevelArraySchema(t *testing.T) {
+	arraySchema := map[string]interface{}{
+		"type":     "array",
+		"minItems": 1,
+		"maxItems": float64(3),
+		"items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{"type": "string"},
+				"age":  map[string]interface{}{"type": "integer"},
+			},
+			"required": []interface{}{"name"},
+		},
+	}
+
+	pb := ConvertSchemaToProtobuf(arraySchema)
+	if pb.Type != aiplatform.Type_ARRAY {
+		t.Errorf("ConvertSchemaToProtobuf() Type = %v, want ARRAY", pb.Type)
+	}
+	if pb.MinItems != 1 || pb.MaxItems != 3 {
+		t.Errorf("ConvertSchemaToProtobuf() MinItems/MaxItems = %d/%d, want 1/3", pb.MinItems, pb.MaxItems)
+	}
+	if pb.Items == nil || pb.Items.Type != aiplatform.Type_OBJECT || pb.Items.Properties["age"].Type != aiplatform.Type_INTEGER {
+		t.Errorf("ConvertSchemaToProtobuf() Items = %v, want object with properties", pb.Items)
+	}
+	if len(pb.Items.Required) != 1 || pb.Items.Required[0] != "name" {
+		t.Errorf("ConvertSchemaToProtobuf() Items.Required = %v, want [name]", pb.Items.Required)
+	}
+
+	valid := `[{"name":"Alice","age":30},{"name":"Bob"}]`
+	if err := ValidateResponse(valid, arraySchema); err != nil {
+		t.Errorf("ValidateResponse() error = %v for valid array", err)
+	}
+
+	for _, invalid := range []string{`[]`, `[{"age":30}]`, `{"name":"Alice"}`, `[{"name":"a"},{"name":"b"},{"name":"c"},{"name":"d"}]`} {
+		if err := ValidateResponse(invalid, arraySchema); err == nil {
+			t.Errorf("ValidateResponse(%s) expected error", invalid)
+		}
+	}
+
+	want := "[\n  {\n    \"age\": 30,\n    \"name\": \"Alice\"\n  },\n  {\n    \"name\": \"Bob\"\n  }\n]"
+	if got := FormatResponse(valid); got != want {
+		t.Errorf("FormatResponse() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatResponseWith(t *testing.T) {
+	response := "```json\n{\"b\": 1, \"a\": {\"d\": [1, 2], \"c\": \"x\"}}\n```"
+
+	tests := []struct {
+		name string
+		opts FormatOptions
+		want string
+	}{
+		{"defaults", DefaultFormatOptions, "{\n  \"a\": {\n    \"c\": \"x\",\n    \"d\": [\n      1,\n      2\n    ]\n  },\n  \"b\": 1\n}"},
+		{"indent 4", FormatOptions{Indent: 4}, "{\n    \"a\": {\n        \"c\": \"x\",\n        \"d\": [\n            1,\n            2\n        ]\n    },\n    \"b\": 1\n}"},
+		{"compact", FormatOptions{Indent: 0}, `{"a":{"c":"x","d":[1,2]},"b":1}`},
+		{"keep order", FormatOptions{Indent: 2, KeepOrder: true}, "{\n  \"b\": 1,\n  \"a\": {\n    \"d\": [\n      1,\n      2\n    ],\n    \"c\": \"x\"\n  }\n}"},
+		{"keep order compact", FormatOptions{KeepOrder: true}, `{"b":1,"a":{"d":[1,2],"c":"x"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatResponseWith(response, tt.opts); got != tt.want {
+				t.Errorf("FormatResponseWith() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := FormatResponseWith("plain text", FormatOptions{KeepOrder: true}); got != "plain text" {
+		t.Errorf("FormatResponseWith() = %q, want unchanged response", got)
+	}
+}
+
+func TestExtractField(t *testing.T) {
+	response := "```json\n" + `{"result": {"items": [{"name": "first", "tags": ["a", "b"]}, {"name": "second", "count": 2}]}}` + "\n```"
+
+	tests := []struct {
+		name     string
+		response string
+		path     string
+		want     string
+		wantErr  string
+	}{
+		{"nested string", response, "result.items.0.name", "first", ""},
+		{"number", response, "result.items.1.count", "2", ""},
+		{"array", response, "result.items.0.tags", "[\n  \"a\",\n  \"b\"\n]", ""},
+		{"missing field", response, "result.total", "", `no field "total" at result`},
+		{"index out of range", response, "result.items.5", "", "no index 5 in the array of 2 items at result.items"},
+		{"scalar has no fields", response, "result.items.0.name.first", "", "result.items.0.name is not an object or array"},
+		{"not JSON", "Sorry, I can't do that.", "result", "", "response is not JSON"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractField(tt.response, tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ExtractField() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExtractField() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ExtractField() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateResponseAllViolations(t *testing.T) {
+	responseSchema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"name", "tags"},
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string"},
+			"age":  map[string]interface{}{"type": "integer", "minimum": 0},
+			"tags": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "string"},
+			},
+		},
+	}
+
+	err := ValidateResponse(`{"name": 123, "age": -1, "extra": {"tags": []}}`, responseSchema)
+	var violationsErr *ViolationsError
+	if !errors.As(err, &violationsErr) {
+		t.Fatalf("ValidateResponse() error = %v, want a ViolationsError", err)
+	}
+
+	locations := map[string]bool{}
+	for _, v := range violationsErr.Violations {
+		locations[v.Location] = true
+	}
+	for _, want := range []string{"", "/name", "/age"} {
+		if !locations[want] {
+			t.Errorf("ValidateResponse() violations = %+v, want one at %q", violationsErr.Violations, want)
+		}
+	}
+
+	message := err.Error()
+	for _, want := range []string{"schema violation(s):", "\n  - /name: ", "\n  - /age: ", "\n  - /: missing properties"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("ValidateResponse() error = %q, want it to contain %q", message, want)
+		}
+	}
+
+	err = ValidateResponse(`{"name": "x", "tags": ["a", 1, 2]}`, responseSchema)
+	if !errors.As(err, &violationsErr) || len(violationsErr.Violations) != 2 {
+		t.Errorf("ValidateResponse() error = %v, want one violation per bad array item", err)
+	}
+}
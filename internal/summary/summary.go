@@ -4,39 +4,173 @@ import (
 	"air/internal/ai"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 type Summary struct {
 	Model        string
+	Calls        int
 	InputTokens  int32
 	OutputTokens int32
 	TotalTokens  int32
+
+	// EstimatedInputTokens is a prior estimate of the input tokens for all
+	// calls, or zero when none was made. When set, Format compares it with
+	// the actual count.
+	EstimatedInputTokens int32
+
+	// Source is where the responses came from, e.g. "replay", or empty for
+	// live calls to the model.
+	Source string
+
+	// RequestID correlates the run with audit records and logs. It is
+	// shown when set.
+	RequestID string
+
+	// Cache is "hit" when the requests reused an existing cached content,
+	// "created" when it was created for them, and empty without caching.
+	Cache string
+
+	// Duration is the time spent calling the model, reported by
+	// FormatPrometheus.
+	Duration time.Duration
 }
 
 func BuildSummary(model string, response *ai.Response) *Summary {
 	return &Summary{
 		Model:        model,
+		Calls:        1,
 		InputTokens:  response.InputTokens,
 		OutputTokens: response.OutputTokens,
 		TotalTokens:  response.TotalTokens,
+		Source:       response.Source,
 	}
 }
 
+// Add accumulates the token usage of another call into the summary.
+func (s *Summary) Add(response *ai.Response) {
+	s.Calls++
+	s.InputTokens += response.InputTokens
+	s.OutputTokens += response.OutputTokens
+	s.TotalTokens += response.TotalTokens
+}
+
 func (s *Summary) Format() string {
+	calls := ""
+	if s.Calls > 1 {
+		calls = fmt.Sprintf("Calls: %d\n", s.Calls)
+	}
+	source := ""
+	if s.Source != "" {
+		source = fmt.Sprintf("Source: %s\n", s.Source)
+	}
+	cache := ""
+	if s.Cache != "" {
+		cache = fmt.Sprintf("Cache: %s\n", s.Cache)
+	}
+	requestID := ""
+	if s.RequestID != "" {
+		requestID = fmt.Sprintf("Request ID: %s\n", s.RequestID)
+	}
+
 	return fmt.Sprintf(`---
 Request Summary
 Model: %s
-Input tokens: %d
+%s%s%s%sInput tokens: %d%s
 Output tokens: %d
 Total tokens: %d
 ---`,
 		s.Model,
+		requestID,
+		source,
+		calls,
+		cache,
 		s.InputTokens,
+		s.estimateComparison(),
 		s.OutputTokens,
 		s.TotalTokens,
 	)
 }
 
+// estimateComparison describes how the actual input tokens differ from the
+// estimate, e.g. " (estimated 100, +20)". It is empty without an estimate.
+func (s *Summary) estimateComparison() string {
+	if s.EstimatedInputTokens <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (estimated %d, %+d)", s.EstimatedInputTokens, s.InputTokens-s.EstimatedInputTokens)
+}
+
+// FormatPrometheus renders the summary as gauges in the Prometheus text
+// exposition format, labelled with the model, for a node exporter textfile
+// collector. now is the time of the run.
+func (s *Summary) FormatPrometheus(now time.Time) string {
+	labels := fmt.Sprintf(`{model="%s"}`, escapeLabel(s.Model))
+
+	var b strings.Builder
+	gauge := func(name, help, value string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n", name, help, name, name, labels, value)
+	}
+	gauge("air_calls", "Model calls of the last run.", strconv.Itoa(s.Calls))
+	gauge("air_input_tokens", "Input tokens of the last run.", strconv.Itoa(int(s.InputTokens)))
+	gauge("air_output_tokens", "Output tokens of the last run.", strconv.Itoa(int(s.OutputTokens)))
+	gauge("air_total_tokens", "Total tokens of the last run.", strconv.Itoa(int(s.TotalTokens)))
+	gauge("air_duration_seconds", "Time spent calling the model in the last run.", strconv.FormatFloat(s.Duration.Seconds(), 'f', -1, 64))
+	gauge("air_last_run_timestamp_seconds", "Unix time of the last run.", strconv.FormatInt(now.Unix(), 10))
+	return b.String()
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
 func Display(summary *Summary, writer io.Writer) {
 	fmt.Fprintln(writer, summary.Format())
 }
+
+// Destination returns the writer for a --summary-dest value: stderr (the
+// default) or stdout as given, or else the named file opened for appending.
+// The returned close function must be called once the summary is written.
+func Destination(dest string, stdout, stderr io.Writer) (io.Writer, func() error, error) {
+	switch dest {
+	case "", "stderr":
+		return stderr, func() error { return nil }, nil
+	case "stdout":
+		return stdout, func() error { return nil }, nil
+	}
+
+	if strings.Contains(dest, "..") {
+		return nil, nil, fmt.Errorf("invalid summary path: path traversal not allowed")
+	}
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening summary file: %w", err)
+	}
+	return file, file.Close, nil
+}
+
+// FormatSafetyRatings renders the per-candidate safety ratings as a table.
+func FormatSafetyRatings(ratings [][]ai.SafetyRating) string {
+	var b strings.Builder
+	b.WriteString("Safety ratings\n")
+
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Candidate\tCategory\tProbability\tBlocked")
+	for i, candidate := range ratings {
+		for _, r := range candidate {
+			blocked := "no"
+			if r.Blocked {
+				blocked = "yes"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i, ai.CategoryName(r.Category), r.Probability, blocked)
+		}
+	}
+	tw.Flush()
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
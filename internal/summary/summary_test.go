@@ -3,8 +3,14 @@ package summary
 import (
 	"air/internal/ai"
 	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
+
+	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
 )
 
 func TestBuildSummary(t *testing.T) {
@@ -54,6 +60,83 @@ func TestBuildSummary(t *testing.T) {
 	}
 }
 
+func TestSummaryAdd(t *testing.T) {
+	summary := BuildSummary("gemini-2.0-flash-001", &ai.Response{InputTokens: 10, OutputTokens: 20, TotalTokens: 30})
+	summary.Add(&ai.Response{InputTokens: 1, OutputTokens: 2, TotalTokens: 3})
+
+	if summary.Calls != 2 {
+		t.Errorf("Add() Calls = %v, want 2", summary.Calls)
+	}
+	if summary.InputTokens != 11 || summary.OutputTokens != 22 || summary.TotalTokens != 33 {
+		t.Errorf("Add() tokens = %d/%d/%d, want 11/22/33", summary.InputTokens, summary.OutputTokens, summary.TotalTokens)
+	}
+	if !strings.Contains(summary.Format(), "Calls: 2") {
+		t.Errorf("Format() should contain call count, got: %s", summary.Format())
+	}
+}
+
+func TestFormatEstimatedInputTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		estimated int32
+		actual    int32
+		want      string
+	}{
+		{"no estimate", 0, 120, "Input tokens: 120\n"},
+		{"under estimate", 100, 120, "Input tokens: 120 (estimated 100, +20)\n"},
+		{"over estimate", 150, 120, "Input tokens: 120 (estimated 150, -30)\n"},
+		{"exact estimate", 120, 120, "Input tokens: 120 (estimated 120, +0)\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary := &Summary{Model: "gemini-2.0-flash-001", InputTokens: tt.actual, EstimatedInputTokens: tt.estimated}
+			if got := summary.Format(); !strings.Contains(got, tt.want) {
+				t.Errorf("Format() = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *ai.Response
+		want     string
+	}{
+		{"live", &ai.Response{InputTokens: 10}, ""},
+		{"cached", &ai.Response{Source: "cache"}, "Source: cache\n"},
+		{"replayed", &ai.Response{Source: ai.SourceReplay}, "Source: replay\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BuildSummary("gemini-2.0-flash-001", tt.response).Format()
+			if tt.want == "" {
+				if strings.Contains(got, "Source:") {
+					t.Errorf("Format() = %q, want no source for live calls", got)
+				}
+				return
+			}
+			if !strings.Contains(got, "Model: gemini-2.0-flash-001\n"+tt.want) {
+				t.Errorf("Format() = %q, want %q after the model", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatRequestID(t *testing.T) {
+	s := BuildSummary("gemini-2.0-flash-001", &ai.Response{Source: ai.SourceReplay})
+	if strings.Contains(s.Format(), "Request ID:") {
+		t.Errorf("Format() = %q, want no request ID when unset", s.Format())
+	}
+
+	s.RequestID = "build-42"
+	if want := "Model: gemini-2.0-flash-001\nRequest ID: build-42\nSource: replay\n"; !strings.Contains(s.Format(), want) {
+		t.Errorf("Format() = %q, want it to contain %q", s.Format(), want)
+	}
+}
+
 func TestFormat(t *testing.T) {
 	summary := &Summary{
 		Model:        "gemini-2.0-flash-001",
@@ -106,3 +189,126 @@ func TestDisplay(t *testing.T) {
 		t.Error("Display() output should contain model name")
 	}
 }
+
+func TestDestination(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	summary := &Summary{Model: "gemini-2.0-flash-001", Calls: 1}
+
+	tests := []struct {
+		dest string
+		want *bytes.Buffer
+	}{
+		{"", stderr},
+		{"stderr", stderr},
+		{"stdout", stdout},
+	}
+	for _, tt := range tests {
+		stdout.Reset()
+		stderr.Reset()
+		writer, closeDest, err := Destination(tt.dest, stdout, stderr)
+		if err != nil {
+			t.Fatalf("Destination(%q) error = %v", tt.dest, err)
+		}
+		Display(summary, writer)
+		closeDest()
+		if !strings.Contains(tt.want.String(), "Request Summary") {
+			t.Errorf("Destination(%q) did not write to the expected stream", tt.dest)
+		}
+	}
+
+	// A file destination is appended to, not truncated
+	path := filepath.Join(t.TempDir(), "summaries.log")
+	for i := 0; i < 2; i++ {
+		writer, closeDest, err := Destination(path, stdout, stderr)
+		if err != nil {
+			t.Fatalf("Destination(%q) error = %v", path, err)
+		}
+		Display(summary, writer)
+		if err := closeDest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "Request Summary"); got != 2 {
+		t.Errorf("summary file has %d summaries, want 2:\n%s", got, data)
+	}
+
+	if _, _, err := Destination("../summaries.log", stdout, stderr); err == nil {
+		t.Error("Destination() expected error for path traversal")
+	}
+}
+
+func TestFormatPrometheus(t *testing.T) {
+	s := &Summary{Model: "gemini-2.0-flash", Calls: 2, InputTokens: 30, OutputTokens: 50, TotalTokens: 80, Duration: 1500 * time.Millisecond}
+	got := s.FormatPrometheus(time.Unix(1717245000, 0))
+
+	want := `# HELP air_calls Model calls of the last run.
+# TYPE air_calls gauge
+air_calls{model="gemini-2.0-flash"} 2
+# HELP air_input_tokens Input tokens of the last run.
+# TYPE air_input_tokens gauge
+air_input_tokens{model="gemini-2.0-flash"} 30
+# HELP air_output_tokens Output tokens of the last run.
+# TYPE air_output_tokens gauge
+air_output_tokens{model="gemini-2.0-flash"} 50
+# HELP air_total_tokens Total tokens of the last run.
+# TYPE air_total_tokens gauge
+air_total_tokens{model="gemini-2.0-flash"} 80
+# HELP air_duration_seconds Time spent calling the model in the last run.
+# TYPE air_duration_seconds gauge
+air_duration_seconds{model="gemini-2.0-flash"} 1.5
+# HELP air_last_run_timestamp_seconds Unix time of the last run.
+# TYPE air_last_run_timestamp_seconds gauge
+air_last_run_timestamp_seconds{model="gemini-2.0-flash"} 1717245000
+`
+	if got != want {
+		t.Errorf("FormatPrometheus() =\n%s\nwant\n%s", got, want)
+	}
+
+	// Every sample line is valid exposition format, even with a label value
+	// that needs escaping
+	s.Model = `odd "model"\name`
+	sample := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*\{model="(?:[^"\\]|\\.)*"\} [0-9.eE+-]+$`)
+	for _, line := range strings.Split(strings.TrimSuffix(s.FormatPrometheus(time.Unix(0, 0)), "\n"), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if !sample.MatchString(line) {
+			t.Errorf("FormatPrometheus() line %q is not a valid sample", line)
+		}
+	}
+	if !strings.Contains(s.FormatPrometheus(time.Unix(0, 0)), `{model="odd \"model\"\\name"}`) {
+		t.Errorf("FormatPrometheus() does not escape the model label")
+	}
+}
+
+func TestFormatSafetyRatings(t *testing.T) {
+	ratings := [][]ai.SafetyRating{
+		{
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HATE_SPEECH, Probability: aiplatformpb.SafetyRating_NEGLIGIBLE},
+		},
+		{
+			{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HARASSMENT, Probability: aiplatformpb.SafetyRating_HIGH, Blocked: true},
+		},
+	}
+
+	formatted := FormatSafetyRatings(ratings)
+	lines := strings.Split(formatted, "\n")
+	if len(lines) != 4 {
+		t.Fatalf("FormatSafetyRatings() should have a title, header and one row per rating, got: %q", formatted)
+	}
+
+	for i, fields := range [][]string{
+		{"Candidate", "Category", "Probability", "Blocked"},
+		{"0", "hate_speech", "NEGLIGIBLE", "no"},
+		{"1", "harassment", "HIGH", "yes"},
+	} {
+		got := strings.Fields(lines[i+1])
+		if strings.Join(got, " ") != strings.Join(fields, " ") {
+			t.Errorf("FormatSafetyRatings() row %d = %v, want %v", i, got, fields)
+		}
+	}
+}
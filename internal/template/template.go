@@ -1,28 +1,153 @@
 package template
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
 )
 
-var IncludePattern = regexp.MustCompile(`\{\{include\s+"([^"]+)"\}\}`)
+// DefaultMaxIncludes bounds how many includes a single template may expand.
+const DefaultMaxIncludes = 1000
+
+// DefaultMaxIncludeDepth bounds how deeply includes may be nested.
+const DefaultMaxIncludeDepth = 32
+
+// DefaultMaxIncludeSize bounds the size of a single included file, in bytes.
+const DefaultMaxIncludeSize = 1 << 20
+
+// DefaultIncludeKeyword is the directive name of {{include "path"}}.
+const DefaultIncludeKeyword = "include"
+
+var includeKeywordPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// IncludePattern matches {{include "path"}} and the conditional form
+// {{include-if "path" when=variable}}. Groups: "-if" marker, path, variable.
+// A path may end in #name to include only that section of the file.
+var IncludePattern = includePattern(DefaultIncludeKeyword)
+
+func includePattern(keyword string) *regexp.Regexp {
+	return regexp.MustCompile(`\{\{` + regexp.QuoteMeta(keyword) + `(-if)?\s+"([^"]+)"(?:\s+when=([a-zA-Z_][a-zA-Z0-9_]*))?\}\}`)
+}
+
+// IncludePatternFor returns the include pattern for another directive name,
+// e.g. "import" for {{import "path"}} and {{import-if "path" when=variable}}.
+func IncludePatternFor(keyword string) (*regexp.Regexp, error) {
+	if keyword == "" || keyword == DefaultIncludeKeyword {
+		return IncludePattern, nil
+	}
+	if !includeKeywordPattern.MatchString(keyword) {
+		return nil, fmt.Errorf("invalid include keyword %q: must be a letter followed by letters, digits or underscores", keyword)
+	}
+	return includePattern(keyword), nil
+}
 
 var PlaceholderPattern = regexp.MustCompile(`\{\{([a-zA-Z_][a-zA-Z0-9_]*?)(?:\|([^}]*))?\}\}`)
 
 // InclusionContext tracks processed files to detect circular includes
 type InclusionContext struct {
-	Visited map[string]bool // Absolute paths of files currently being processed
-	BaseDir string          // Base directory for resolving relative includes
+	Visited  map[string]bool // Absolute paths of files currently being processed
+	BaseDir  string          // Base directory for resolving relative includes
+	File     string          // File whose content is currently being processed
+	Included []string        // Absolute paths of every file included so far, in order
+
+	// AllowedExtensions restricts includes to files with these extensions
+	// (e.g. ".md"). An empty list allows any extension.
+	AllowedExtensions []string
+
+	// MaxIncludes is the maximum number of includes processed in total,
+	// counting repeated includes of the same file. Zero means no limit.
+	MaxIncludes int
+
+	// MaxDepth is the maximum nesting depth of includes, where a file
+	// included directly by the template is at depth 1. Zero means no limit.
+	MaxDepth int
+
+	// MaxFileSize is the maximum size of an included file in bytes. Zero
+	// means no limit.
+	MaxFileSize int64
+
+	// Variables decide {{include-if}} directives: the file is included only
+	// when its when= variable has a non-empty value.
+	Variables map[string]string
+
+	// Root is the directory includes must stay within. Empty means the
+	// current directory.
+	Root string
+
+	// SearchPath lists directories tried, in order, for relative includes
+	// that do not exist next to the including file.
+	SearchPath []string
+
+	// Pattern matches include directives. Nil means IncludePattern.
+	Pattern *regexp.Regexp
+
+	// Warnings collects non-fatal problems found in included files, such as
+	// frontmatter that ends up in the body.
+	Warnings []string
+
+	// inBody is set while processing a file included after the start of
+	// the template, where a frontmatter block is not parsed.
+	inBody bool
+
+	// expansions lists the include directives of the last top-level content,
+	// for SourceLine.
+	expansions []expansion
+}
+
+// expansion is an include directive of the top-level content and the text
+// that replaced it, measured in line breaks.
+type expansion struct {
+	line          int // line of the directive in the top-level content
+	lines         int // line breaks within the directive
+	expandedLines int // line breaks within the text that replaced it
+}
+
+// SourceLine maps a line of the text returned by the last top-level
+// ProcessIncludes call to the line of the content it was given. Lines of
+// included text map to the line of their include directive.
+func (ctx *InclusionContext) SourceLine(line int) int {
+	delta := 0
+	for _, e := range ctx.expansions {
+		start := e.line + delta
+		if line < start {
+			break
+		}
+		if line <= start+e.expandedLines {
+			return e.line
+		}
+		delta += e.expandedLines - e.lines
+	}
+	return line - delta
+}
+
+// pattern returns the include pattern in use.
+func (ctx *InclusionContext) pattern() *regexp.Regexp {
+	if ctx.Pattern == nil {
+		return IncludePattern
+	}
+	return ctx.Pattern
 }
 
 func NewInclusionContext(initialFile string) *InclusionContext {
 	return &InclusionContext{
-		Visited: make(map[string]bool),
-		BaseDir: filepath.Dir(initialFile),
+		Visited:     make(map[string]bool),
+		BaseDir:     filepath.Dir(initialFile),
+		File:        initialFile,
+		MaxIncludes: DefaultMaxIncludes,
+		MaxDepth:    DefaultMaxIncludeDepth,
+		MaxFileSize: DefaultMaxIncludeSize,
 	}
 }
 
@@ -34,9 +159,14 @@ func ResolveAbsolutePath(path, baseDir string) (string, error) {
 	return filepath.Abs(cleaned)
 }
 
-// validatePathSecurity ensures the include path doesn't escape the project directory
-func validatePathSecurity(absPath string) error {
-	projectRoot, err := filepath.Abs(".")
+// ValidatePathSecurity ensures the path doesn't escape the project directory
+func ValidatePathSecurity(absPath string) error {
+	return validatePathWithin(absPath, ".")
+}
+
+// validatePathWithin ensures the path doesn't escape root
+func validatePathWithin(absPath, root string) error {
+	projectRoot, err := filepath.Abs(root)
 	if err != nil {
 		return fmt.Errorf("getting project root: %w", err)
 	}
@@ -50,74 +180,405 @@ func validatePathSecurity(absPath string) error {
 	return nil
 }
 
+// resolveInclude returns the absolute path of includePath: relative to the
+// including file, or else in the first search path directory that has it
+func (ctx *InclusionContext) resolveInclude(includePath string) (string, error) {
+	absPath, err := ResolveAbsolutePath(includePath, ctx.BaseDir)
+	if err != nil || filepath.IsAbs(includePath) || len(ctx.SearchPath) == 0 {
+		return absPath, err
+	}
+	if _, err := os.Stat(absPath); err == nil {
+		return absPath, nil
+	}
+	for _, dir := range ctx.SearchPath {
+		candidate, err := ResolveAbsolutePath(includePath, dir)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	// Not found anywhere; reading it reports the error for the usual path
+	return absPath, nil
+}
+
 // checkCircular verifies no circular dependency exists
-func (ctx *InclusionContext) checkCircular(absPath string) error {
-	if ctx.Visited[absPath] {
-		return fmt.Errorf("circular include detected: %s", absPath)
+func (ctx *InclusionContext) checkCircular(absPath, section string) error {
+	if key := includeKey(absPath, section); ctx.Visited[key] {
+		return fmt.Errorf("circular include detected: %s", key)
 	}
 	return nil
 }
 
-// processIncludeFile reads and recursively processes an included file
-func (ctx *InclusionContext) processIncludeFile(absPath string) (string, error) {
-	ctx.Visited[absPath] = true
-	defer delete(ctx.Visited, absPath) // Allow same file in different branches
+// checkExtension verifies the file extension is in the allowlist, if any
+func (ctx *InclusionContext) checkExtension(absPath string) error {
+	if len(ctx.AllowedExtensions) == 0 {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(absPath))
+	for _, allowed := range ctx.AllowedExtensions {
+		if ext == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("include file extension %q is not allowed (allowed: %s)", ext, strings.Join(ctx.AllowedExtensions, ", "))
+}
+
+// processIncludeFile reads and recursively processes an included file, or
+// only its named section when section is not empty
+func (ctx *InclusionContext) processIncludeFile(absPath, section string) (string, error) {
+	if ctx.MaxIncludes > 0 && len(ctx.Included) >= ctx.MaxIncludes {
+		return "", fmt.Errorf("include limit exceeded: include #%d is over the limit of %d", len(ctx.Included)+1, ctx.MaxIncludes)
+	}
+
+	// Visited holds exactly the chain of files being processed, so its size
+	// is the current nesting depth
+	if ctx.MaxDepth > 0 && len(ctx.Visited) >= ctx.MaxDepth {
+		return "", fmt.Errorf("include depth exceeded: %s would be nested %d levels deep (limit %d)", absPath, len(ctx.Visited)+1, ctx.MaxDepth)
+	}
+
+	// Sections of one file may include each other, so each is visited on
+	// its own
+	visitKey := includeKey(absPath, section)
+	ctx.Visited[visitKey] = true
+	defer delete(ctx.Visited, visitKey) // Allow same file in different branches
+	ctx.Included = append(ctx.Included, absPath)
+
+	// Check the size before reading the file into memory
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", &IncludeReadError{err: err}
+	}
+	if ctx.MaxFileSize > 0 && info.Size() > ctx.MaxFileSize {
+		return "", fmt.Errorf("included file %s is too large: %d bytes (limit %d)", absPath, info.Size(), ctx.MaxFileSize)
+	}
 
 	includedContent, err := os.ReadFile(absPath)
 	if err != nil {
-		return "", fmt.Errorf("reading included file: %w", err)
+		return "", &IncludeReadError{err: err}
+	}
+
+	// Guard against binary files being dumped into the prompt
+	if !utf8.Valid(includedContent) || bytes.IndexByte(includedContent, 0) != -1 {
+		return "", fmt.Errorf("included file %s is not UTF-8 text", absPath)
+	}
+
+	content := string(includedContent)
+	if section != "" {
+		content, err = extractSection(content, section)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", absPath, err)
+		}
+	} else if ctx.inBody && hasFrontmatter(includedContent) {
+		// Only frontmatter that ends up at the very start of the template
+		// is parsed; anywhere else it would be sent as part of the prompt
+		ctx.Warnings = append(ctx.Warnings, fmt.Sprintf("included file %s starts with frontmatter, which is not parsed there and becomes part of the prompt", absPath))
+	}
+
+	// Process nested includes with updated baseDir and file
+	oldBaseDir, oldFile := ctx.BaseDir, ctx.File
+	ctx.BaseDir, ctx.File = filepath.Dir(absPath), absPath
+	defer func() { ctx.BaseDir, ctx.File = oldBaseDir, oldFile }()
+
+	return ProcessIncludes(content, ctx)
+}
+
+// includeKey identifies a file, or one section of it, among the files being
+// processed.
+func includeKey(absPath, section string) string {
+	if section == "" {
+		return absPath
+	}
+	return absPath + "#" + section
+}
+
+// hasFrontmatter reports whether content opens with a YAML (---) or TOML
+// (+++) frontmatter block that is closed later on.
+func hasFrontmatter(content []byte) bool {
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	for _, delimiter := range []string{"---", "+++"} {
+		opening := []byte(delimiter + "\n")
+		if bytes.HasPrefix(content, opening) && bytes.Contains(content[len(opening):], []byte("\n"+delimiter+"\n")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionPattern matches the "## section:name" lines that split a file into
+// named sections for {{include "file#name"}}.
+var sectionPattern = regexp.MustCompile(`(?m)^##[ \t]*section:[ \t]*(\S+)[ \t]*\r?$`)
+
+// extractSection returns the lines between the marker of the named section
+// and the next marker or the end of content, without the blank lines around
+// them.
+func extractSection(content, name string) (string, error) {
+	markers := sectionPattern.FindAllStringSubmatchIndex(content, -1)
+	var names []string
+	found := -1
+	for i, m := range markers {
+		marker := content[m[2]:m[3]]
+		if slices.Contains(names, marker) {
+			return "", fmt.Errorf("section %q is defined more than once", marker)
+		}
+		names = append(names, marker)
+		if marker == name {
+			found = i
+		}
 	}
+	if found == -1 {
+		if len(names) == 0 {
+			return "", fmt.Errorf("section %q not found: the file has no \"## section:name\" markers", name)
+		}
+		return "", fmt.Errorf("section %q not found (sections: %s)", name, strings.Join(names, ", "))
+	}
+
+	start := markers[found][1]
+	end := len(content)
+	if found+1 < len(markers) {
+		end = markers[found+1][0]
+	}
+	return strings.Trim(content[start:end], "\r\n"), nil
+}
+
+// IncludeReadError reports an included file that could not be read, along with
+// the directive that referenced it.
+type IncludeReadError struct {
+	File        string // File containing the include directive
+	Line        int    // 1-based line of the directive in File
+	IncludePath string // Path as written in the directive
+	err         error
+}
+
+func (e *IncludeReadError) Error() string {
+	return fmt.Sprintf("%s:%d: include %q: reading included file: %v", e.File, e.Line, e.IncludePath, e.err)
+}
+
+func (e *IncludeReadError) Unwrap() error {
+	return e.err
+}
+
+// LocationError is an error at a specific line of a template file.
+type LocationError struct {
+	File string
+	Line int
+	Err  error
+}
 
-	// Process nested includes with updated baseDir
-	oldBaseDir := ctx.BaseDir
-	ctx.BaseDir = filepath.Dir(absPath)
-	defer func() { ctx.BaseDir = oldBaseDir }()
+func (e *LocationError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *LocationError) Unwrap() error {
+	return e.Err
+}
 
-	return ProcessIncludes(string(includedContent), ctx)
+// RejectIncludes returns an error naming the first {{include}} directive in
+// content, or nil if there is none. It is used when includes are disabled for
+// untrusted templates.
+func RejectIncludes(content, file string) error {
+	return RejectIncludesPattern(content, file, IncludePattern)
+}
+
+// RejectIncludesPattern is RejectIncludes for directives matched by pattern,
+// as returned by IncludePatternFor.
+func RejectIncludesPattern(content, file string, pattern *regexp.Regexp) error {
+	match := pattern.FindStringSubmatchIndex(content)
+	if match == nil {
+		return nil
+	}
+	return &LocationError{
+		File: file,
+		Line: lineAt(content, match[0]),
+		Err:  fmt.Errorf("include %q: includes are disabled", content[match[4]:match[5]]),
+	}
+}
+
+// lineAt returns the 1-based line number of offset within content.
+func lineAt(content string, offset int) int {
+	return strings.Count(content[:offset], "\n") + 1
+}
+
+// IncludeOptions configures ExpandIncludes.
+type IncludeOptions struct {
+	// File is the file content was read from. Relative includes resolve
+	// against its directory, and errors name it. Empty means the current
+	// directory.
+	File string
+
+	// Root is the directory includes must stay within. Empty means the
+	// current directory.
+	Root string
+
+	// SearchPath lists directories tried, in order, for relative includes
+	// that do not exist next to the including file.
+	SearchPath []string
+
+	// MaxDepth, MaxIncludes and MaxFileSize default to
+	// DefaultMaxIncludeDepth, DefaultMaxIncludes and DefaultMaxIncludeSize
+	// when zero. A negative value means no limit.
+	MaxDepth    int
+	MaxIncludes int
+	MaxFileSize int64
+
+	// AllowedExtensions and Variables are as in InclusionContext.
+	AllowedExtensions []string
+	Variables         map[string]string
+
+	// Keyword is the directive name. Empty means DefaultIncludeKeyword.
+	Keyword string
+}
+
+// ExpandIncludes expands the {{include}} directives of content and returns the
+// expanded text along with the absolute paths of the files read, in the order
+// they were first included.
+func ExpandIncludes(content string, opts IncludeOptions) (string, []string, error) {
+	ctx, err := includeContext(opts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	expanded, err := ProcessIncludes(content, ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	files := []string{}
+	seen := make(map[string]bool)
+	for _, file := range ctx.Included {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	return expanded, files, nil
+}
+
+// includeContext returns an inclusion context configured by opts.
+func includeContext(opts IncludeOptions) (*InclusionContext, error) {
+	ctx := NewInclusionContext(opts.File)
+	ctx.Root = opts.Root
+	ctx.SearchPath = opts.SearchPath
+	ctx.AllowedExtensions = opts.AllowedExtensions
+	ctx.Variables = opts.Variables
+	pattern, err := IncludePatternFor(opts.Keyword)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Pattern = pattern
+	if opts.MaxDepth != 0 {
+		ctx.MaxDepth = max(opts.MaxDepth, 0)
+	}
+	if opts.MaxIncludes != 0 {
+		ctx.MaxIncludes = max(opts.MaxIncludes, 0)
+	}
+	if opts.MaxFileSize != 0 {
+		ctx.MaxFileSize = max(opts.MaxFileSize, 0)
+	}
+	return ctx, nil
 }
 
 func ProcessIncludes(content string, ctx *InclusionContext) (string, error) {
 	var result strings.Builder
 	lastIndex := 0
 
+	// Only the directives of the top-level content are mapped by SourceLine
+	top := len(ctx.Visited) == 0
+	if top {
+		ctx.expansions = nil
+	}
+	expanded := func(matchStart, matchEnd int, text string) {
+		if top {
+			ctx.expansions = append(ctx.expansions, expansion{
+				line:          lineAt(content, matchStart),
+				lines:         strings.Count(content[matchStart:matchEnd], "\n"),
+				expandedLines: strings.Count(text, "\n"),
+			})
+		}
+	}
+
 	for {
 		sub := content[lastIndex:]
-		idxs := IncludePattern.FindStringSubmatchIndex(sub)
+		idxs := ctx.pattern().FindStringSubmatchIndex(sub)
 		if idxs == nil {
 			result.WriteString(sub)
 			break
 		}
 
-		// idxs[0], idxs[1] are start/end of full match; idxs[2],idxs[3] are the first capture group
+		// idxs[0], idxs[1] are start/end of full match; the capture groups
+		// follow in pairs (-if marker, path, when= variable)
 		matchStart := lastIndex + idxs[0]
 		matchEnd := lastIndex + idxs[1]
-		includePath := sub[idxs[2]:idxs[3]]
+		conditional := idxs[2] != -1
+		includePath := sub[idxs[4]:idxs[5]]
+		condition := ""
+		if idxs[6] != -1 {
+			condition = sub[idxs[6]:idxs[7]]
+		}
 
 		// Write content before match
 		result.WriteString(content[lastIndex:matchStart])
 
+		if conditional && condition == "" {
+			return "", fmt.Errorf("%s:%d: include-if %q: missing when=variable", ctx.File, lineAt(content, matchStart), includePath)
+		}
+		if !conditional && condition != "" {
+			return "", fmt.Errorf("%s:%d: include %q: when= is only allowed with include-if", ctx.File, lineAt(content, matchStart), includePath)
+		}
+		// A false condition skips the include without reading the file
+		if conditional && ctx.Variables[condition] == "" {
+			expanded(matchStart, matchEnd, "")
+			lastIndex = matchEnd
+			continue
+		}
+
+		// "file#name" includes only the named section of the file
+		filePath, section, hasSection := strings.Cut(includePath, "#")
+		if hasSection && section == "" {
+			return "", fmt.Errorf("%s:%d: include %q: missing section name after #", ctx.File, lineAt(content, matchStart), includePath)
+		}
+
 		// Resolve path relative to current file's directory
-		absPath, err := ResolveAbsolutePath(includePath, ctx.BaseDir)
+		absPath, err := ctx.resolveInclude(filePath)
 		if err != nil {
 			return "", fmt.Errorf("resolving include path %s: %w", includePath, err)
 		}
 
 		// Security check
-		if err := validatePathSecurity(absPath); err != nil {
+		root := ctx.Root
+		if root == "" {
+			root = "."
+		}
+		if err := validatePathWithin(absPath, root); err != nil {
+			return "", fmt.Errorf("%s: %w", includePath, err)
+		}
+
+		if err := ctx.checkExtension(absPath); err != nil {
 			return "", fmt.Errorf("%s: %w", includePath, err)
 		}
 
 		// Check for circular includes
-		if err := ctx.checkCircular(absPath); err != nil {
+		if err := ctx.checkCircular(absPath, section); err != nil {
 			return "", fmt.Errorf("%s: %w", includePath, err)
 		}
 
 		// Process included file
-		processedContent, err := ctx.processIncludeFile(absPath)
+		inBody := ctx.inBody
+		ctx.inBody = inBody || result.Len() > 0
+		processedContent, err := ctx.processIncludeFile(absPath, section)
+		ctx.inBody = inBody
 		if err != nil {
+			// Only the innermost read error gets the position of its directive
+			if readErr, ok := err.(*IncludeReadError); ok && readErr.IncludePath == "" {
+				readErr.File = ctx.File
+				readErr.Line = lineAt(content, matchStart)
+				readErr.IncludePath = includePath
+			}
 			return "", err
 		}
 
+		expanded(matchStart, matchEnd, processedContent)
 		result.WriteString(processedContent)
 		lastIndex = matchEnd
 	}
@@ -160,16 +621,110 @@ func ReplacePlaceholders(content string, variables map[string]string) (string, e
 	return result, nil
 }
 
+// RequiredVariables returns the sorted names of placeholders in content that
+// have no default value and therefore must be provided.
+func RequiredVariables(content string) []string {
+	seen := make(map[string]struct{})
+	for _, submatches := range PlaceholderPattern.FindAllStringSubmatch(content, -1) {
+		if submatches[2] == "" {
+			seen[submatches[1]] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type CLIOptions struct {
-	Variables      map[string]string // --var flags
+	Variables      map[string]string // --var and --var-json flags
+	VarsFiles      []string          // --vars-file, in the order given
+	VarsStdin      bool              // --vars-stdin, read key=value lines from stdin
+	EchoVars       bool              // --echo-vars
 	OutputFile     string            // -o, --output
 	NoSummary      bool              // --no-summary
+	SummaryFirst   bool              // --summary-first
+	SummaryDest    string            // --summary-dest, or "stdout" for --summary-stdout
 	ShowPromptOnly bool              // --show-prompt-only
+	IncludePrompt  bool              // --include-prompt
+	NoFrontmatter  bool              // --no-frontmatter
+	NoPlaceholders bool              // --no-placeholders
+	NoIncludes     bool              // --no-includes or --reject-includes
+	RejectIncludes bool              // --reject-includes, error on include directives
+	Explain        bool              // --explain
+	Check          bool              // --check or --check-dir
+	CheckDir       string            // --check-dir, directory of templates to check
+	Manifest       string            // --manifest, list of templates with their vars and output
+	Interactive    bool              // --interactive, read commands from stdin
+	SchemaStrict   bool              // --schema-strict
+	PrintSchema    bool              // --print-schema or --print-schema-only
+	SchemaOnly     bool              // --print-schema-only, exit after printing
+	Diff           string            // --diff, expected output file
+	ExpectMatch    *regexp.Regexp    // --expect-match, response must match
+	Replay         string            // --replay, file used as the response
+	Body           string            // --body, file with the prompt body
+	Prompt         string            // --prompt, inline prompt used instead of a template file
+	BaseDir        string            // --base-dir, directory includes of --prompt resolve from
+	Model          string            // --model, overrides model
+	Locale         string            // --locale, sets the locale variable
+	NoLocaleHint   bool              // --no-locale-hint
+	Redactions     []Redaction       // --redact, applied in order
+	ResponseMime   string            // --response-mime, overrides responseMimeType
+	SchemaFile     string            // --schema-file, overrides responseSchema
+	SafetyFile     string            // --safety-file, policy under safetySettings
+	Safety         string            // --safety, threshold for every harm category
+	SafetyWarn     string            // --safety-warn, lowest rating level to warn about
+	Profile        string            // --profile
+	Count          int               // --count
+	JSONLines      bool              // --jsonl, or --output-format jsonl
+	OutputFormat   string            // --output-format ("text" or "jsonl"), "" when not given
+	Quiet          bool              // --quiet, -q
+	ErrorsJSON     bool              // --errors-json
+	Werror         bool              // --werror
+	Verbose        bool              // --verbose
+	FailOnEmpty    bool              // --fail-on-empty
+	MaxIncludes    int               // --max-includes, 0 when not given
+	MaxDepth       int               // --max-include-depth, 0 when not given
+	MaxIncludeSize int               // --max-include-size in bytes, 0 when not given
+	MaxPromptSize  int               // --max-prompt-size in bytes, 0 when not given
+
+	IncludeExtensions []string // --include-ext, normalized to lowercase ".ext"
+	NoTrailingNewline bool     // --no-trailing-newline
+	RegionFallback    []string // --region-fallback, locations tried in order
+	Format            string   // --format, error output format ("plain" or "editor")
+	ForbidBlockNone   bool     // --forbid-block-none
+	SplitOn           string   // --split-on, marker between output documents
+	SplitDir          string   // --split-dir, directory for the split documents
+	MaxPromptTokens   int32    // --max-prompt-tokens, 0 when not given
+	RetryEmpty        bool     // --retry-empty
+	RetryDeadline     bool     // --retry-deadline
+	Continue          bool     // --continue, or --max-continuations
+	MaxContinuations  int      // --max-continuations, 0 when not given
+	SaveConversation  string   // --save-conversation, file for prompt and response
+	StrictVars        bool     // --strict-vars
+	OnErrorOutput     string   // --on-error-output, file for partial output
+	AuditLog          string   // --audit-log, file audit records are appended to
+	IncludeKeyword    string   // --include-keyword, directive name instead of include
+	RequestID         string   // --request-id, "" to generate one
+	Extract           string   // --extract, dotted path of the JSON value to output
+	KeepGoing         bool     // --keep-going, run the remaining templates after a failure
+	CountTokens       bool     // --count-tokens, estimate the prompt tokens locally
+	SampleConfig      bool     // --sample-config, print annotated frontmatter and exit
+	Separator         *string  // --separator, line between outputs; nil when not given
+	NoDefaultSafety   bool     // --no-default-safety, send no safety settings by default
+	MetricsFile       string   // --metrics-file, Prometheus textfile for the summary
+	JSONIndent        *int     // --json-indent, spaces per level; nil when not given
+	NoSortKeys        bool     // --no-sort-keys, keep the key order of JSON responses
+	Citations         bool     // --citations, append cited sources as footnotes
 }
 
 func ParseCLIFlags(args []string) (*CLIOptions, []string, error) {
 	opts := &CLIOptions{
 		Variables: make(map[string]string),
+		Count:     1,
 	}
 	remaining := []string{}
 
@@ -177,6 +732,12 @@ func ParseCLIFlags(args []string) (*CLIOptions, []string, error) {
 	for i < len(args) {
 		arg := args[i]
 
+		// Everything after "--" is positional, even if it looks like a flag
+		if arg == "--" {
+			remaining = append(remaining, args[i+1:]...)
+			break
+		}
+
 		switch arg {
 		case "--var", "-v":
 			if i+1 >= len(args) {
@@ -192,6 +753,34 @@ func ParseCLIFlags(args []string) (*CLIOptions, []string, error) {
 				return nil, nil, fmt.Errorf("invalid --var format: %s (expected key=value)", varDef)
 			}
 
+			opts.Variables[parts[0]] = parts[1]
+		case "--echo-vars":
+			opts.EchoVars = true
+		case "--vars-stdin":
+			opts.VarsStdin = true
+		case "--vars-file":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--vars-file requires a file name")
+			}
+
+			i++
+			opts.VarsFiles = append(opts.VarsFiles, args[i])
+		case "--var-json":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--var-json requires an argument")
+			}
+
+			i++
+			varDef := args[i]
+
+			parts := strings.SplitN(varDef, "=", 2)
+			if len(parts) != 2 {
+				return nil, nil, fmt.Errorf("invalid --var-json format: %s (expected key=json)", varDef)
+			}
+			if !json.Valid([]byte(parts[1])) {
+				return nil, nil, fmt.Errorf("invalid --var-json value for %s: not valid JSON", parts[0])
+			}
+
 			opts.Variables[parts[0]] = parts[1]
 		case "-o", "--output":
 			if i+1 >= len(args) {
@@ -206,9 +795,438 @@ func ParseCLIFlags(args []string) (*CLIOptions, []string, error) {
 			opts.OutputFile = args[i]
 		case "--no-summary":
 			opts.NoSummary = true
+		case "--summary-first":
+			opts.SummaryFirst = true
+		case "--summary-stdout":
+			opts.SummaryDest = "stdout"
 		case "--show-prompt-only":
 			opts.ShowPromptOnly = true
+		case "--no-trailing-newline":
+			opts.NoTrailingNewline = true
+		case "--include-prompt":
+			opts.IncludePrompt = true
+		case "--no-frontmatter":
+			opts.NoFrontmatter = true
+		case "--no-placeholders":
+			opts.NoPlaceholders = true
+		case "--count-tokens":
+			opts.CountTokens = true
+		case "--separator":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--separator requires a value")
+			}
+
+			i++
+			separator := args[i]
+			opts.Separator = &separator
+		case "--keep-going", "-k":
+			opts.KeepGoing = true
+		case "--extract":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--extract requires a path")
+			}
+
+			i++
+			if slices.Contains(strings.Split(args[i], "."), "") {
+				return nil, nil, fmt.Errorf("invalid --extract path %q: expected field names or indexes separated by dots", args[i])
+			}
+			opts.Extract = args[i]
+		case "--request-id":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--request-id requires an ID")
+			}
+
+			i++
+			if args[i] == "" || strings.ContainsFunc(args[i], func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) {
+				return nil, nil, fmt.Errorf("invalid --request-id %q: must be non-empty without spaces or control characters", args[i])
+			}
+			opts.RequestID = args[i]
+		case "--include-keyword":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--include-keyword requires a keyword")
+			}
+
+			i++
+			opts.IncludeKeyword = args[i]
+		case "--no-includes":
+			opts.NoIncludes = true
+		case "--reject-includes":
+			opts.NoIncludes = true
+			opts.RejectIncludes = true
+		case "--strict-vars":
+			opts.StrictVars = true
+		case "--retry-empty":
+			opts.RetryEmpty = true
+		case "--retry-deadline":
+			opts.RetryDeadline = true
+		case "--continue":
+			opts.Continue = true
+		case "--max-continuations":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--max-continuations requires a number")
+			}
+
+			i++
+			limit, err := strconv.Atoi(args[i])
+			if err != nil || limit < 1 {
+				return nil, nil, fmt.Errorf("invalid --max-continuations value: %s (expected a positive integer)", args[i])
+			}
+			opts.Continue = true
+			opts.MaxContinuations = limit
+		case "--forbid-block-none":
+			opts.ForbidBlockNone = true
+		case "--explain":
+			opts.Explain = true
+		case "--check":
+			opts.Check = true
+		case "--check-dir":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--check-dir requires a directory")
+			}
+
+			i++
+			opts.CheckDir = args[i]
+		case "--manifest":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--manifest requires a filename")
+			}
+
+			i++
+			opts.Manifest = args[i]
+		case "--interactive":
+			opts.Interactive = true
+		case "--errors-json":
+			opts.ErrorsJSON = true
+		case "--werror":
+			opts.Werror = true
+		case "--schema-strict":
+			opts.SchemaStrict = true
+		case "--print-schema":
+			opts.PrintSchema = true
+		case "--print-schema-only":
+			opts.PrintSchema = true
+			opts.SchemaOnly = true
+		case "--profile":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--profile requires a profile name")
+			}
+
+			i++
+			opts.Profile = args[i]
+		case "--diff":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--diff requires a file name")
+			}
+
+			i++
+			opts.Diff = args[i]
+		case "--expect-match":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--expect-match requires a regex")
+			}
+
+			i++
+			re, err := regexp.Compile(args[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid --expect-match regex: %w", err)
+			}
+			opts.ExpectMatch = re
+		case "--replay":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--replay requires a file name")
+			}
+
+			i++
+			opts.Replay = args[i]
+		case "--redact":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--redact requires a regex=>replacement rule")
+			}
+
+			i++
+			redaction, err := ParseRedaction(args[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			opts.Redactions = append(opts.Redactions, redaction)
+		case "--body":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--body requires a file name")
+			}
+
+			i++
+			opts.Body = args[i]
+		case "--prompt":
+			if i+1 >= len(args) || args[i+1] == "" {
+				return nil, nil, fmt.Errorf("--prompt requires the prompt text")
+			}
+
+			i++
+			opts.Prompt = args[i]
+		case "--base-dir":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--base-dir requires a directory")
+			}
+
+			i++
+			opts.BaseDir = args[i]
+		case "--model":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--model requires a model name")
+			}
+
+			i++
+			opts.Model = args[i]
+		case "--locale":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--locale requires a locale")
+			}
+
+			i++
+			opts.Locale = args[i]
+		case "--no-locale-hint":
+			opts.NoLocaleHint = true
+		case "--split-on":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--split-on requires a marker")
+			}
+
+			i++
+			opts.SplitOn = args[i]
+		case "--split-dir":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--split-dir requires a directory")
+			}
+
+			i++
+			opts.SplitDir = args[i]
+		case "--save-conversation":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--save-conversation requires a file name")
+			}
+
+			i++
+			opts.SaveConversation = args[i]
+		case "--on-error-output":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--on-error-output requires a file name")
+			}
+
+			i++
+			opts.OnErrorOutput = args[i]
+		case "--audit-log":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--audit-log requires a file name")
+			}
+
+			i++
+			opts.AuditLog = args[i]
+		case "--sample-config":
+			opts.SampleConfig = true
+		case "--response-mime":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--response-mime requires a MIME type")
+			}
+
+			i++
+			opts.ResponseMime = args[i]
+		case "--schema-file":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--schema-file requires a file name")
+			}
+
+			i++
+			opts.SchemaFile = args[i]
+		case "--safety-file":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--safety-file requires a file name")
+			}
+
+			i++
+			opts.SafetyFile = args[i]
+		case "--metrics-file":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--metrics-file requires a file name")
+			}
+
+			i++
+			opts.MetricsFile = args[i]
+		case "--no-default-safety":
+			opts.NoDefaultSafety = true
+		case "--json-indent":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--json-indent requires a number")
+			}
+
+			i++
+			indent, err := strconv.Atoi(args[i])
+			if err != nil || indent < 0 || indent > 8 {
+				return nil, nil, fmt.Errorf("invalid --json-indent value: %s (expected 0 to 8)", args[i])
+			}
+			opts.JSONIndent = &indent
+		case "--no-sort-keys":
+			opts.NoSortKeys = true
+		case "--citations":
+			opts.Citations = true
+		case "--safety":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--safety requires a threshold")
+			}
+
+			i++
+			opts.Safety = args[i]
+		case "--safety-warn":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--safety-warn requires a level")
+			}
+
+			i++
+			opts.SafetyWarn = args[i]
+		case "--include-ext":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--include-ext requires a comma-separated list of extensions")
+			}
+
+			i++
+			for _, ext := range strings.Split(args[i], ",") {
+				ext = strings.ToLower(strings.TrimSpace(ext))
+				if ext == "" {
+					continue
+				}
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				opts.IncludeExtensions = append(opts.IncludeExtensions, ext)
+			}
+		case "--region-fallback":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--region-fallback requires a comma-separated list of locations")
+			}
+
+			i++
+			for _, location := range strings.Split(args[i], ",") {
+				if location = strings.TrimSpace(location); location != "" {
+					opts.RegionFallback = append(opts.RegionFallback, location)
+				}
+			}
+		case "--max-includes":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--max-includes requires a number")
+			}
+
+			i++
+			limit, err := strconv.Atoi(args[i])
+			if err != nil || limit < 1 {
+				return nil, nil, fmt.Errorf("invalid --max-includes value: %s (expected a positive integer)", args[i])
+			}
+			opts.MaxIncludes = limit
+		case "--max-include-depth":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--max-include-depth requires a number")
+			}
+
+			i++
+			limit, err := strconv.Atoi(args[i])
+			if err != nil || limit < 1 {
+				return nil, nil, fmt.Errorf("invalid --max-include-depth value: %s (expected a positive integer)", args[i])
+			}
+			opts.MaxDepth = limit
+		case "--max-include-size":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--max-include-size requires a number of bytes")
+			}
+
+			i++
+			limit, err := strconv.Atoi(args[i])
+			if err != nil || limit < 1 {
+				return nil, nil, fmt.Errorf("invalid --max-include-size value: %s (expected a positive integer)", args[i])
+			}
+			opts.MaxIncludeSize = limit
+		case "--max-prompt-size":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--max-prompt-size requires a number of bytes")
+			}
+
+			i++
+			limit, err := strconv.Atoi(args[i])
+			if err != nil || limit < 1 {
+				return nil, nil, fmt.Errorf("invalid --max-prompt-size value: %s (expected a positive integer)", args[i])
+			}
+			opts.MaxPromptSize = limit
+		case "--max-prompt-tokens":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--max-prompt-tokens requires a number of tokens")
+			}
+
+			i++
+			limit, err := strconv.ParseInt(args[i], 10, 32)
+			if err != nil || limit < 1 {
+				return nil, nil, fmt.Errorf("invalid --max-prompt-tokens value: %s (expected a positive integer)", args[i])
+			}
+			opts.MaxPromptTokens = int32(limit)
+		case "--fail-on-empty":
+			opts.FailOnEmpty = true
+		case "--verbose":
+			opts.Verbose = true
+		case "--quiet", "-q":
+			opts.Quiet = true
+		case "--jsonl", "--json-lines":
+			opts.JSONLines = true
+			opts.OutputFormat = "jsonl"
+		case "--output-format":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--output-format requires a format name")
+			}
+
+			i++
+			format, err := ParseOutputFormat(args[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid --output-format value: %w", err)
+			}
+			opts.OutputFormat = format
+			opts.JSONLines = format == "jsonl"
+		case "--count":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--count requires a number")
+			}
+
+			i++
+			count, err := strconv.Atoi(args[i])
+			if err != nil || count < 1 {
+				return nil, nil, fmt.Errorf("invalid --count value: %s (expected a positive integer)", args[i])
+			}
+			opts.Count = count
+		case "--summary-dest":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--summary-dest requires stderr, stdout or a file name")
+			}
+
+			i++
+			opts.SummaryDest = args[i]
+		case "--format":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--format requires a format name")
+			}
+
+			i++
+			format, err := parseFormat(args[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			opts.Format = format
 		default:
+			if value, ok := strings.CutPrefix(arg, "--format="); ok {
+				format, err := parseFormat(value)
+				if err != nil {
+					return nil, nil, err
+				}
+				opts.Format = format
+				break
+			}
+			if value, ok := strings.CutPrefix(arg, "--summary-dest="); ok {
+				opts.SummaryDest = value
+				break
+			}
 			remaining = append(remaining, arg)
 		}
 
@@ -218,17 +1236,249 @@ func ParseCLIFlags(args []string) (*CLIOptions, []string, error) {
 	return opts, remaining, nil
 }
 
-func GetEnvVariables() map[string]string {
+func parseFormat(format string) (string, error) {
+	switch format {
+	case "plain", "editor":
+		return format, nil
+	}
+	return "", fmt.Errorf("invalid --format value: %s (expected plain or editor)", format)
+}
+
+// ParseOutputFormat checks an output format name given to --output-format or
+// AIR_OUTPUT_FORMAT.
+func ParseOutputFormat(format string) (string, error) {
+	switch format {
+	case "text", "jsonl":
+		return format, nil
+	}
+	return "", fmt.Errorf("%s (expected text or jsonl)", format)
+}
+
+// GetEnvVariables returns the process environment as variables. Values that
+// are not valid UTF-8 or contain control characters other than tab and line
+// breaks are left out so they cannot corrupt the prompt; their keys are
+// returned sorted in skipped.
+func GetEnvVariables() (vars map[string]string, skipped []string) {
+	return parseEnvironment(os.Environ())
+}
+
+func parseEnvironment(environ []string) (map[string]string, []string) {
 	vars := make(map[string]string)
+	var skipped []string
 
-	for _, env := range os.Environ() {
+	for _, env := range environ {
 		parts := strings.SplitN(env, "=", 2)
-		if len(parts) == 2 {
-			vars[parts[0]] = parts[1]
+		if len(parts) != 2 {
+			continue
+		}
+		if !isSafeValue(parts[1]) {
+			skipped = append(skipped, parts[0])
+			continue
+		}
+		vars[parts[0]] = parts[1]
+	}
+
+	sort.Strings(skipped)
+	return vars, skipped
+}
+
+// isSafeValue reports whether s is valid UTF-8 without control characters,
+// allowing tabs and line breaks.
+func isSafeValue(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseVarsFile parses a YAML (or JSON) vars file mapping variable names to
+// scalar values. Nested maps and lists are rejected.
+func ParseVarsFile(content []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	return scalarVariables(raw)
+}
+
+// ParseVarLines parses key=value lines, as read by --vars-stdin. Blank lines
+// and lines starting with # are skipped; the value is everything after the
+// first =.
+func ParseVarLines(content []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: invalid variable %q (expected key=value)", i+1, line)
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
+
+// scalarVariables converts decoded YAML values to variables, rejecting nested
+// maps and lists.
+func scalarVariables(raw map[string]interface{}) (map[string]string, error) {
+	vars := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("variable %s: expected a scalar value", name)
+		case nil:
+			vars[name] = ""
+		default:
+			vars[name] = fmt.Sprint(v)
+		}
+	}
+	return vars, nil
+}
+
+// ManifestEntry is one template of a --manifest batch, with the variables
+// and output path used for it alone.
+type ManifestEntry struct {
+	Template string
+	Vars     map[string]string
+	Output   string
+}
+
+// ParseManifest parses a YAML (or JSON) list of {template, vars, output}
+// entries. Only template is required.
+func ParseManifest(content []byte) ([]ManifestEntry, error) {
+	var raw []struct {
+		Template string                 `yaml:"template"`
+		Vars     map[string]interface{} `yaml:"vars"`
+		Output   string                 `yaml:"output"`
+	}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("manifest has no entries")
+	}
+
+	entries := make([]ManifestEntry, len(raw))
+	for i, r := range raw {
+		if r.Template == "" {
+			return nil, fmt.Errorf("entry %d: missing template", i+1)
+		}
+		vars, err := scalarVariables(r.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		entries[i] = ManifestEntry{Template: r.Template, Vars: vars, Output: r.Output}
+	}
+	return entries, nil
+}
+
+// Redaction replaces every match of Pattern in a prompt with Replacement,
+// which may refer to capture groups as $1.
+type Redaction struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// ParseRedaction parses a "regex=>replacement" rule. The replacement may be
+// empty.
+func ParseRedaction(rule string) (Redaction, error) {
+	pattern, replacement, found := strings.Cut(rule, "=>")
+	if !found || pattern == "" {
+		return Redaction{}, fmt.Errorf("invalid --redact rule: %s (expected regex=>replacement)", rule)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Redaction{}, fmt.Errorf("invalid --redact pattern %q: %w", pattern, err)
+	}
+	return Redaction{Pattern: re, Replacement: replacement}, nil
+}
+
+// Redact applies the redactions to content in order and returns the result
+// with the total number of matches replaced.
+func Redact(content string, redactions []Redaction) (string, int) {
+	count := 0
+	for _, r := range redactions {
+		count += len(r.Pattern.FindAllStringIndex(content, -1))
+		content = r.Pattern.ReplaceAllString(content, r.Replacement)
+	}
+	return content, count
+}
+
+// VariableSource is a named set of variables, such as the frontmatter or a
+// vars file, used to trace where a variable was defined.
+type VariableSource struct {
+	Name      string
+	Variables map[string]string
+}
+
+// VariableConflict is a variable defined with different values by several
+// sources. Definitions are in source order, one per defining source.
+type VariableConflict struct {
+	Name        string
+	Definitions []VariableDefinition
+}
+
+// VariableDefinition is the value a source gives a variable.
+type VariableDefinition struct {
+	Source string
+	Value  string
+}
+
+func (c VariableConflict) String() string {
+	defs := make([]string, len(c.Definitions))
+	for i, def := range c.Definitions {
+		defs[i] = fmt.Sprintf("%s=%q", def.Source, def.Value)
+	}
+	return fmt.Sprintf("variable %q is defined with different values: %s", c.Name, strings.Join(defs, ", "))
+}
+
+// FindConflicts returns the variables that sources, given from lowest to
+// highest priority, define with different values, sorted by name. Sources
+// that agree on a value are not a conflict.
+func FindConflicts(sources []VariableSource) []VariableConflict {
+	definitions := make(map[string][]VariableDefinition)
+	for _, src := range sources {
+		for name, value := range src.Variables {
+			definitions[name] = append(definitions[name], VariableDefinition{Source: src.Name, Value: value})
 		}
 	}
 
-	return vars
+	var conflicts []VariableConflict
+	for name, defs := range definitions {
+		for _, def := range defs[1:] {
+			if def.Value != defs[0].Value {
+				conflicts = append(conflicts, VariableConflict{Name: name, Definitions: defs})
+				break
+			}
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Name < conflicts[j].Name })
+	return conflicts
+}
+
+// DefaultDateFormat is the layout of the built-in today variable.
+const DefaultDateFormat = "2006-01-02"
+
+// DateVariables returns the built-in date variables for now: today, formatted
+// with the Go layout dateFormat (DefaultDateFormat when empty), now in RFC 3339
+// and timestamp in Unix seconds.
+func DateVariables(now time.Time, dateFormat string) map[string]string {
+	if dateFormat == "" {
+		dateFormat = DefaultDateFormat
+	}
+	return map[string]string{
+		"today":     now.Format(dateFormat),
+		"now":       now.Format(time.RFC3339),
+		"timestamp": strconv.FormatInt(now.Unix(), 10),
+	}
 }
 
 func MergeVariables(sources ...map[string]string) map[string]string {
@@ -1,8 +1,12 @@
 package template
 
 import (
+	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -58,6 +62,45 @@ func TestProcessIncludes(t *testing.T) {
 	}
 }
 
+func TestSourceLine(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_sourceline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// three.md expands one line into three; nested.md's own include is not
+	// a line of the template
+	os.WriteFile(filepath.Join(tempDir, "three.md"), []byte("one\ntwo\nthree"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "nested.md"), []byte("a\n{{include \"three.md\"}}"), 0644)
+
+	ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+	ctx.BaseDir = tempDir
+	content := "first\n{{include \"three.md\"}}\nmiddle\n{{include \"nested.md\"}}\nlast"
+	if _, err := ProcessIncludes(content, ctx); err != nil {
+		t.Fatalf("ProcessIncludes() error = %v", err)
+	}
+
+	// Expanded: first, one, two, three, middle, a, one, two, three, last
+	tests := []struct {
+		line int
+		want int
+	}{
+		{1, 1},
+		{2, 2},
+		{4, 2},
+		{5, 3},
+		{6, 4},
+		{9, 4},
+		{10, 5},
+	}
+	for _, tt := range tests {
+		if got := ctx.SourceLine(tt.line); got != tt.want {
+			t.Errorf("SourceLine(%d) = %d, want %d", tt.line, got, tt.want)
+		}
+	}
+}
+
 func TestProcessIncludesCircular(t *testing.T) {
 	tempDir := t.TempDir()
 	fileA := filepath.Join(tempDir, "a.md")
@@ -74,6 +117,443 @@ func TestProcessIncludesCircular(t *testing.T) {
 	}
 }
 
+func TestProcessIncludesMissingFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	baseFile := filepath.Join(tempDir, "base.md")
+	content := "Line one\nLine two {{include \"missing.md\"}}\nLine three"
+
+	ctx := NewInclusionContext(baseFile)
+
+	_, err = ProcessIncludes(content, ctx)
+	if err == nil {
+		t.Fatal("ProcessIncludes() expected error for missing include")
+	}
+
+	var readErr *IncludeReadError
+	if !errors.As(err, &readErr) {
+		t.Fatalf("ProcessIncludes() error = %v, want *IncludeReadError", err)
+	}
+	if readErr.IncludePath != "missing.md" {
+		t.Errorf("IncludeReadError.IncludePath = %v, want missing.md", readErr.IncludePath)
+	}
+	if readErr.Line != 2 {
+		t.Errorf("IncludeReadError.Line = %v, want 2", readErr.Line)
+	}
+	if !strings.Contains(err.Error(), "base.md:2") || !strings.Contains(err.Error(), "missing.md") {
+		t.Errorf("ProcessIncludes() error = %v, want file, line and include path", err)
+	}
+}
+
+func TestProcessIncludesMissingNestedFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	baseFile := filepath.Join(tempDir, "base.md")
+	middleFile := filepath.Join(tempDir, "middle.md")
+
+	os.WriteFile(middleFile, []byte("Middle\n\n{{include \"gone.md\"}}"), 0644)
+
+	ctx := NewInclusionContext(baseFile)
+
+	_, err = ProcessIncludes("{{include \"middle.md\"}}", ctx)
+	if err == nil {
+		t.Fatal("ProcessIncludes() expected error for missing nested include")
+	}
+	if !strings.Contains(err.Error(), "middle.md:3") || !strings.Contains(err.Error(), "gone.md") {
+		t.Errorf("ProcessIncludes() error = %v, want position in middle.md", err)
+	}
+}
+
+func TestProcessIncludesBinaryAndExtensions(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "text.md"), []byte("Plain text"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "image.png"), []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe}, 0644)
+	os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte("Notes"), 0644)
+
+	tests := []struct {
+		name       string
+		content    string
+		extensions []string
+		want       string
+		wantErr    bool
+	}{
+		{"text file accepted", `{{include "text.md"}}`, nil, "Plain text", false},
+		{"binary file rejected", `{{include "image.png"}}`, nil, "", true},
+		{"allowed extension", `{{include "text.md"}}`, []string{".md"}, "Plain text", false},
+		{"disallowed extension", `{{include "notes.txt"}}`, []string{".md"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+			ctx.AllowedExtensions = tt.extensions
+
+			got, err := ProcessIncludes(tt.content, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessIncludes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ProcessIncludes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessIncludesMaxIncludes(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "leaf.md"), []byte("leaf"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "branch.md"), []byte(strings.Repeat(`{{include "leaf.md"}}`, 3)), 0644)
+	content := strings.Repeat(`{{include "branch.md"}}`, 3)
+
+	ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+	ctx.MaxIncludes = 12
+	if _, err := ProcessIncludes(content, ctx); err != nil {
+		t.Fatalf("ProcessIncludes() error = %v with 12 includes and limit 12", err)
+	}
+
+	ctx = NewInclusionContext(filepath.Join(tempDir, "base.md"))
+	ctx.MaxIncludes = 10
+	_, err = ProcessIncludes(content, ctx)
+	if err == nil {
+		t.Fatal("ProcessIncludes() expected error when exceeding the include limit")
+	}
+	if !strings.Contains(err.Error(), "#11") || !strings.Contains(err.Error(), "limit of 10") {
+		t.Errorf("ProcessIncludes() error = %v, want count and limit", err)
+	}
+}
+
+func TestProcessIncludesMaxDepth(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// level1.md includes level2.md, which includes level3.md
+	os.WriteFile(filepath.Join(tempDir, "level1.md"), []byte(`1 {{include "level2.md"}}`), 0644)
+	os.WriteFile(filepath.Join(tempDir, "level2.md"), []byte(`2 {{include "level3.md"}}`), 0644)
+	os.WriteFile(filepath.Join(tempDir, "level3.md"), []byte("3"), 0644)
+	content := `{{include "level1.md"}} {{include "level3.md"}}`
+
+	ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+	ctx.MaxDepth = 3
+	got, err := ProcessIncludes(content, ctx)
+	if err != nil {
+		t.Fatalf("ProcessIncludes() error = %v with depth 3 and limit 3", err)
+	}
+	if got != "1 2 3 3" {
+		t.Errorf("ProcessIncludes() = %q, want %q", got, "1 2 3 3")
+	}
+
+	ctx = NewInclusionContext(filepath.Join(tempDir, "base.md"))
+	ctx.MaxDepth = 2
+	_, err = ProcessIncludes(content, ctx)
+	if err == nil {
+		t.Fatal("ProcessIncludes() expected error when exceeding the depth limit")
+	}
+	if !strings.Contains(err.Error(), "include depth exceeded") || !strings.Contains(err.Error(), "level3.md") || !strings.Contains(err.Error(), "limit 2") {
+		t.Errorf("ProcessIncludes() error = %v, want file and limit", err)
+	}
+}
+
+func TestProcessIncludesFrontmatterWarning(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "config.md"), []byte("---\nmodel: gemini-1.5-pro-002\n---\nBody"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "toml.md"), []byte("+++\nmodel = \"gemini-1.5-pro-002\"\n+++\nBody"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "rule.md"), []byte("---\nA section after a rule"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "wrapper.md"), []byte(`{{include "config.md"}}`), 0644)
+
+	tests := []struct {
+		name        string
+		content     string
+		wantWarning string
+	}{
+		{"at the start becomes the frontmatter", `{{include "config.md"}}`, ""},
+		{"nested at the start", `{{include "wrapper.md"}}`, ""},
+		{"after text", `Intro {{include "config.md"}}`, "config.md starts with frontmatter"},
+		{"nested after text", `Intro {{include "wrapper.md"}}`, "config.md starts with frontmatter"},
+		{"toml", `Intro {{include "toml.md"}}`, "toml.md starts with frontmatter"},
+		{"horizontal rule", `Intro {{include "rule.md"}}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+			if _, err := ProcessIncludes(tt.content, ctx); err != nil {
+				t.Fatalf("ProcessIncludes() error = %v", err)
+			}
+			if tt.wantWarning == "" {
+				if len(ctx.Warnings) != 0 {
+					t.Errorf("ProcessIncludes() warnings = %q, want none", ctx.Warnings)
+				}
+				return
+			}
+			if len(ctx.Warnings) != 1 || !strings.Contains(ctx.Warnings[0], tt.wantWarning) {
+				t.Errorf("ProcessIncludes() warnings = %q, want one containing %q", ctx.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestProcessIncludesSections(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	lib := "Preamble\n## section:intro\nYou are a reviewer.\n\n## section:rules\n- Be brief\n{{include \"lib.md#intro\"}}\n## section:loop\n{{include \"lib.md#loop\"}}\n"
+	os.WriteFile(filepath.Join(tempDir, "lib.md"), []byte(lib), 0644)
+	os.WriteFile(filepath.Join(tempDir, "plain.md"), []byte("No sections"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "twice.md"), []byte("## section:a\nOne\n## section:a\nTwo"), 0644)
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr string
+	}{
+		{"named section", `Start {{include "lib.md#intro"}} end`, "Start You are a reviewer. end", ""},
+		{"section with nested section include", `{{include "lib.md#rules"}}`, "- Be brief\nYou are a reviewer.", ""},
+		{"whole file", `{{include "plain.md"}}`, "No sections", ""},
+		{"unknown section", `{{include "lib.md#outro"}}`, "", `section "outro" not found (sections: intro, rules, loop)`},
+		{"file without sections", `{{include "plain.md#intro"}}`, "", `section "intro" not found: the file has no`},
+		{"empty section name", `{{include "lib.md#"}}`, "", "missing section name after #"},
+		{"duplicate section", `{{include "twice.md#a"}}`, "", `section "a" is defined more than once`},
+		{"circular section", `{{include "lib.md#loop"}}`, "", "circular include detected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+			got, err := ProcessIncludes(tt.content, ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ProcessIncludes() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessIncludes() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ProcessIncludes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessIncludesMaxFileSize(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "small.md"), []byte("small"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "huge.md"), bytes.Repeat([]byte("x"), 2048), 0644)
+
+	ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+	if ctx.MaxFileSize != DefaultMaxIncludeSize {
+		t.Errorf("NewInclusionContext() MaxFileSize = %d, want %d", ctx.MaxFileSize, DefaultMaxIncludeSize)
+	}
+	ctx.MaxFileSize = 1024
+	if got, err := ProcessIncludes(`{{include "small.md"}}`, ctx); err != nil || got != "small" {
+		t.Errorf("ProcessIncludes() = %q, %v; want the small file", got, err)
+	}
+
+	_, err = ProcessIncludes(`{{include "small.md"}} {{include "huge.md"}}`, ctx)
+	if err == nil {
+		t.Fatal("ProcessIncludes() expected error for an oversized include")
+	}
+	if !strings.Contains(err.Error(), "huge.md is too large: 2048 bytes (limit 1024)") {
+		t.Errorf("ProcessIncludes() error = %v, want the file name, size and limit", err)
+	}
+
+	ctx.MaxFileSize = 0
+	if _, err := ProcessIncludes(`{{include "huge.md"}}`, ctx); err != nil {
+		t.Errorf("ProcessIncludes() error = %v without a size limit", err)
+	}
+}
+
+func TestExpandIncludes(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// intro.md is found next to the template; shared.md only in lib/
+	libDir := filepath.Join(tempDir, "lib")
+	os.Mkdir(libDir, 0755)
+	os.WriteFile(filepath.Join(tempDir, "intro.md"), []byte(`intro {{include "shared.md"}}`), 0644)
+	os.WriteFile(filepath.Join(libDir, "shared.md"), []byte("shared"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "outside.md"), []byte("outside"), 0644)
+	content := `{{include "intro.md"}} / {{include "intro.md"}}`
+
+	got, files, err := ExpandIncludes(content, IncludeOptions{
+		File:       filepath.Join(tempDir, "base.md"),
+		SearchPath: []string{libDir},
+	})
+	if err != nil {
+		t.Fatalf("ExpandIncludes() error = %v", err)
+	}
+	if want := "intro shared / intro shared"; got != want {
+		t.Errorf("ExpandIncludes() = %q, want %q", got, want)
+	}
+	intro, _ := filepath.Abs(filepath.Join(tempDir, "intro.md"))
+	shared, _ := filepath.Abs(filepath.Join(libDir, "shared.md"))
+	if want := []string{intro, shared}; !reflect.DeepEqual(files, want) {
+		t.Errorf("ExpandIncludes() files = %v, want %v", files, want)
+	}
+
+	_, _, err = ExpandIncludes(content, IncludeOptions{
+		File:       filepath.Join(tempDir, "base.md"),
+		SearchPath: []string{libDir},
+		MaxDepth:   1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "include depth exceeded") {
+		t.Errorf("ExpandIncludes() error = %v, want depth limit error", err)
+	}
+
+	_, _, err = ExpandIncludes(`{{include "../outside.md"}}`, IncludeOptions{
+		File: filepath.Join(libDir, "base.md"),
+		Root: libDir,
+	})
+	if err == nil || !strings.Contains(err.Error(), "outside the project directory") {
+		t.Errorf("ExpandIncludes() error = %v, want root error", err)
+	}
+}
+
+func TestProcessIncludesConditional(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "debug.md"), []byte("debug notes"), 0644)
+	content := `Prompt{{include-if "debug.md" when=debug}}{{include-if "missing.md" when=extra}}`
+
+	tests := []struct {
+		name      string
+		variables map[string]string
+		want      string
+		wantErr   bool
+	}{
+		{"condition unset", nil, "Prompt", false},
+		{"condition empty", map[string]string{"debug": ""}, "Prompt", false},
+		{"condition set", map[string]string{"debug": "1"}, "Promptdebug notes", false},
+		// missing.md does not exist, so a read proves the include was attempted
+		{"skipped file not read", map[string]string{"debug": "1", "extra": "yes"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+			ctx.Variables = tt.variables
+			got, err := ProcessIncludes(content, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProcessIncludes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ProcessIncludes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{`{{include-if "debug.md"}}`, `{{include "debug.md" when=debug}}`} {
+		if _, err := ProcessIncludes(bad, NewInclusionContext(filepath.Join(tempDir, "base.md"))); err == nil {
+			t.Errorf("ProcessIncludes(%s) expected error", bad)
+		}
+	}
+}
+
+func TestProcessIncludesCustomKeyword(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "part.md"), []byte("part"), 0644)
+
+	tests := []struct {
+		name    string
+		keyword string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"default keyword", "", `A {{include "part.md"}}`, "A part", false},
+		{"custom keyword", "import", `A {{import "part.md"}}`, "A part", false},
+		{"custom conditional", "import", `A {{import-if "part.md" when=on}}`, "A part", false},
+		{"include is literal with a custom keyword", "import", `Use {{include "x"}} syntax`, `Use {{include "x"}} syntax`, false},
+		{"keyword is not a prefix match", "import", `{{imports "part.md"}}`, `{{imports "part.md"}}`, false},
+		{"invalid keyword", "im port", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := IncludePatternFor(tt.keyword)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IncludePatternFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			ctx := NewInclusionContext(filepath.Join(tempDir, "base.md"))
+			ctx.Pattern = pattern
+			ctx.Variables = map[string]string{"on": "1"}
+			got, err := ProcessIncludes(tt.content, ctx)
+			if err != nil {
+				t.Fatalf("ProcessIncludes() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ProcessIncludes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectIncludes(t *testing.T) {
+	if err := RejectIncludes("No includes here {{name}}", "base.md"); err != nil {
+		t.Errorf("RejectIncludes() error = %v, want nil", err)
+	}
+
+	err := RejectIncludes("Line one\nSee {{include \"secret.txt\"}}", "base.md")
+	if err == nil {
+		t.Fatal("RejectIncludes() expected error for include directive")
+	}
+	if want := `base.md:2: include "secret.txt": includes are disabled`; err.Error() != want {
+		t.Errorf("RejectIncludes() error = %q, want %q", err.Error(), want)
+	}
+}
+
 func TestReplacePlaceholders(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -118,6 +598,22 @@ func TestReplacePlaceholders(t *testing.T) {
 	}
 }
 
+func TestRequiredVariables(t *testing.T) {
+	content := "Hello {{name}}, {{task|coding}} for {{name}} and {{project}}"
+
+	got := RequiredVariables(content)
+	want := []string{"name", "project"}
+
+	if len(got) != len(want) {
+		t.Fatalf("RequiredVariables() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("RequiredVariables()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
 func TestMergeVariables(t *testing.T) {
 	src1 := map[string]string{"a": "1", "b": "2"}
 	src2 := map[string]string{"b": "3", "c": "4"}
@@ -135,6 +631,89 @@ func TestMergeVariables(t *testing.T) {
 	}
 }
 
+func TestParseEnvironment(t *testing.T) {
+	vars, skipped := parseEnvironment([]string{
+		"NAME=Alice",
+		"MULTILINE=line one\nline two\tend",
+		"INVALID_UTF8=caf\xe9",
+		"CONTROL=bell\x07",
+		"NO_EQUALS",
+	})
+
+	want := map[string]string{
+		"NAME":      "Alice",
+		"MULTILINE": "line one\nline two\tend",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("parseEnvironment() vars = %v, want %v", vars, want)
+	}
+	if wantSkipped := []string{"CONTROL", "INVALID_UTF8"}; !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("parseEnvironment() skipped = %v, want %v", skipped, wantSkipped)
+	}
+}
+
+func TestParseVarsFile(t *testing.T) {
+	vars, err := ParseVarsFile([]byte("name: Alice\ncount: 3\nratio: 0.5\nenabled: true\nempty:\n"))
+	if err != nil {
+		t.Fatalf("ParseVarsFile() error = %v", err)
+	}
+	want := map[string]string{"name": "Alice", "count": "3", "ratio": "0.5", "enabled": "true", "empty": ""}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("ParseVarsFile() = %v, want %v", vars, want)
+	}
+
+	for _, content := range []string{"name: [a, b]", "name:\n  first: Alice", "- just a list"} {
+		if _, err := ParseVarsFile([]byte(content)); err == nil {
+			t.Errorf("ParseVarsFile(%q) expected error", content)
+		}
+	}
+}
+
+func TestParseVarLines(t *testing.T) {
+	vars, err := ParseVarLines([]byte("name=Alice\r\n\n# a comment\nquery=a=b\nempty=\n"))
+	if err != nil {
+		t.Fatalf("ParseVarLines() error = %v", err)
+	}
+	want := map[string]string{"name": "Alice", "query": "a=b", "empty": ""}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("ParseVarLines() = %v, want %v", vars, want)
+	}
+
+	for _, content := range []string{"name", "name=Alice\n=value"} {
+		if _, err := ParseVarLines([]byte(content)); err == nil {
+			t.Errorf("ParseVarLines(%q) expected error", content)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	content := `
+- template: summary.md
+  vars:
+    topic: rust
+    limit: 3
+  output: out/rust.txt
+- {"template": "summary.md"}
+`
+	entries, err := ParseManifest([]byte(content))
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	want := []ManifestEntry{
+		{Template: "summary.md", Vars: map[string]string{"topic": "rust", "limit": "3"}, Output: "out/rust.txt"},
+		{Template: "summary.md", Vars: map[string]string{}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("ParseManifest() = %+v, want %+v", entries, want)
+	}
+
+	for _, content := range []string{"", "template: a.md", "- output: out.txt", "- template: a.md\n  vars:\n    topic: [a, b]"} {
+		if _, err := ParseManifest([]byte(content)); err == nil {
+			t.Errorf("ParseManifest(%q) expected error", content)
+		}
+	}
+}
+
 func TestParseCLIFlags(t *testing.T) {
 	tests := []struct {
 		name              string
@@ -260,3 +839,271 @@ func TestParseCLIFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCLIFlags_Profile(t *testing.T) {
+	opts, args, err := ParseCLIFlags([]string{"--profile", "dev", "file.md"})
+	if err != nil {
+		t.Fatalf("ParseCLIFlags() error = %v", err)
+	}
+	if opts.Profile != "dev" {
+		t.Errorf("ParseCLIFlags() Profile = %v, want dev", opts.Profile)
+	}
+	if len(args) != 1 || args[0] != "file.md" {
+		t.Errorf("ParseCLIFlags() args = %v, want [file.md]", args)
+	}
+
+	if _, _, err := ParseCLIFlags([]string{"--profile"}); err == nil {
+		t.Error("ParseCLIFlags() expected error for --profile without a name")
+	}
+}
+
+func TestParseCLIFlags_DiffReplay(t *testing.T) {
+	opts, args, err := ParseCLIFlags([]string{"--diff", "expected.txt", "--replay", "response.txt", "file.md"})
+	if err != nil {
+		t.Fatalf("ParseCLIFlags() error = %v", err)
+	}
+	if opts.Diff != "expected.txt" || opts.Replay != "response.txt" {
+		t.Errorf("ParseCLIFlags() Diff = %v, Replay = %v", opts.Diff, opts.Replay)
+	}
+	if len(args) != 1 || args[0] != "file.md" {
+		t.Errorf("ParseCLIFlags() args = %v, want [file.md]", args)
+	}
+
+	for _, flag := range []string{"--diff", "--replay"} {
+		if _, _, err := ParseCLIFlags([]string{flag}); err == nil {
+			t.Errorf("ParseCLIFlags() expected error for %s without a file", flag)
+		}
+	}
+}
+
+func TestParseCLIFlags_EndOfFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantArgs  []string
+		wantQuiet bool
+	}{
+		{"dash file name", []string{"--", "-weird-name.md"}, []string{"-weird-name.md"}, false},
+		{"flag-like file name", []string{"--quiet", "--", "-q"}, []string{"-q"}, true},
+		{"flags after separator", []string{"--", "file.md", "--count", "3"}, []string{"file.md", "--count", "3"}, false},
+		{"trailing separator", []string{"file.md", "--"}, []string{"file.md"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, args, err := ParseCLIFlags(tt.args)
+			if err != nil {
+				t.Fatalf("ParseCLIFlags() error = %v", err)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("ParseCLIFlags() args = %q, want %q", args, tt.wantArgs)
+			}
+			if opts.Quiet != tt.wantQuiet || opts.Count != 1 {
+				t.Errorf("ParseCLIFlags() Quiet = %v, Count = %d, want %v, 1", opts.Quiet, opts.Count, tt.wantQuiet)
+			}
+		})
+	}
+}
+
+func TestParseRedaction(t *testing.T) {
+	tests := []struct {
+		name            string
+		rule            string
+		wantPattern     string
+		wantReplacement string
+		wantErr         bool
+	}{
+		{"pattern and replacement", `\d{4}=>####`, `\d{4}`, "####", false},
+		{"empty replacement", `secret=>`, `secret`, "", false},
+		{"arrow in replacement", `a=>b=>c`, `a`, "b=>c", false},
+		{"missing arrow", `secret`, "", "", true},
+		{"empty pattern", `=>x`, "", "", true},
+		{"invalid regex", `[a-=>x`, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRedaction(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRedaction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Pattern.String() != tt.wantPattern || got.Replacement != tt.wantReplacement {
+				t.Errorf("ParseRedaction() = %q => %q, want %q => %q", got.Pattern, got.Replacement, tt.wantPattern, tt.wantReplacement)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var redactions []Redaction
+	for _, rule := range []string{`[\w.]+@[\w.]+=>[email]`, `\b(\d{4})[ -]?\d{4}[ -]?\d{4}[ -]?(\d{4})\b=>$1-XXXX-XXXX-$2`} {
+		r, err := ParseRedaction(rule)
+		if err != nil {
+			t.Fatalf("ParseRedaction(%q) error = %v", rule, err)
+		}
+		redactions = append(redactions, r)
+	}
+
+	got, count := Redact("Mail ann@example.com or bob@example.org, card 4111 1111 1111 1234.", redactions)
+	want := "Mail [email] or [email], card 4111-XXXX-XXXX-1234."
+	if got != want || count != 3 {
+		t.Errorf("Redact() = %q, %d, want %q, 3", got, count, want)
+	}
+}
+
+func TestParseCLIFlags_Format(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{"default", []string{"file.md"}, "", false},
+		{"separate value", []string{"--format", "editor", "file.md"}, "editor", false},
+		{"equals form", []string{"--format=editor", "file.md"}, "editor", false},
+		{"plain", []string{"--format=plain", "file.md"}, "plain", false},
+		{"unknown format", []string{"--format=json", "file.md"}, "", true},
+		{"missing value", []string{"--format"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, args, err := ParseCLIFlags(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCLIFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if opts.Format != tt.want {
+				t.Errorf("ParseCLIFlags() Format = %q, want %q", opts.Format, tt.want)
+			}
+			if len(args) != 1 || args[0] != "file.md" {
+				t.Errorf("ParseCLIFlags() args = %v, want [file.md]", args)
+			}
+		})
+	}
+}
+
+func TestParseCLIFlags_Count(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantCount int
+		wantErr   bool
+	}{
+		{"default", []string{"file.md"}, 1, false},
+		{"explicit", []string{"--count", "4", "file.md"}, 4, false},
+		{"missing value", []string{"--count"}, 0, true},
+		{"not a number", []string{"--count", "many", "file.md"}, 0, true},
+		{"zero", []string{"--count", "0", "file.md"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, _, err := ParseCLIFlags(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCLIFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && opts.Count != tt.wantCount {
+				t.Errorf("ParseCLIFlags() Count = %v, want %v", opts.Count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestParseCLIFlags_IncludeExtensions(t *testing.T) {
+	opts, _, err := ParseCLIFlags([]string{"--include-ext", "md, .TXT,", "file.md"})
+	if err != nil {
+		t.Fatalf("ParseCLIFlags() error = %v", err)
+	}
+
+	want := []string{".md", ".txt"}
+	if len(opts.IncludeExtensions) != len(want) {
+		t.Fatalf("ParseCLIFlags() IncludeExtensions = %v, want %v", opts.IncludeExtensions, want)
+	}
+	for i := range want {
+		if opts.IncludeExtensions[i] != want[i] {
+			t.Errorf("ParseCLIFlags() IncludeExtensions[%d] = %v, want %v", i, opts.IncludeExtensions[i], want[i])
+		}
+	}
+}
+
+func TestParseCLIFlags_FailOnEmpty(t *testing.T) {
+	opts, _, err := ParseCLIFlags([]string{"--fail-on-empty", "file.md"})
+	if err != nil {
+		t.Fatalf("ParseCLIFlags() error = %v", err)
+	}
+	if !opts.FailOnEmpty {
+		t.Error("ParseCLIFlags() FailOnEmpty = false, want true")
+	}
+}
+
+func TestParseCLIFlags_VarJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{"object", []string{"--var-json", `example={"input": "hi", "output": [1, 2]}`, "file.md"}, `{"input": "hi", "output": [1, 2]}`, false},
+		{"string", []string{"--var-json", `example="quoted"`, "file.md"}, `"quoted"`, false},
+		{"invalid JSON", []string{"--var-json", `example={"input": }`, "file.md"}, "", true},
+		{"missing equals", []string{"--var-json", `{"a":1}`, "file.md"}, "", true},
+		{"missing argument", []string{"--var-json"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, _, err := ParseCLIFlags(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCLIFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && opts.Variables["example"] != tt.want {
+				t.Errorf("ParseCLIFlags() Variables[example] = %v, want %v", opts.Variables["example"], tt.want)
+			}
+		})
+	}
+}
+
+func TestFindConflicts(t *testing.T) {
+	sources := []VariableSource{
+		{Name: "environment", Variables: map[string]string{"region": "us", "user": "ann"}},
+		{Name: "frontmatter", Variables: map[string]string{"region": "eu", "tone": "formal"}},
+		{Name: "--var", Variables: map[string]string{"region": "eu", "tone": "formal"}},
+	}
+
+	got := FindConflicts(sources)
+	want := []VariableConflict{{
+		Name: "region",
+		Definitions: []VariableDefinition{
+			{Source: "environment", Value: "us"},
+			{Source: "frontmatter", Value: "eu"},
+			{Source: "--var", Value: "eu"},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("FindConflicts() = %+v, want %+v", got, want)
+	}
+	wantMsg := `variable "region" is defined with different values: environment="us", frontmatter="eu", --var="eu"`
+	if got[0].String() != wantMsg {
+		t.Errorf("String() = %q, want %q", got[0].String(), wantMsg)
+	}
+}
+
+func TestParseCLIFlags_OutputFormat(t *testing.T) {
+	opts, _, err := ParseCLIFlags([]string{"--jsonl", "--output-format", "text", "file.md"})
+	if err != nil {
+		t.Fatalf("ParseCLIFlags() error = %v", err)
+	}
+	if opts.OutputFormat != "text" || opts.JSONLines {
+		t.Errorf("ParseCLIFlags() OutputFormat = %q, JSONLines = %v; want the last flag to win", opts.OutputFormat, opts.JSONLines)
+	}
+
+	if _, _, err := ParseCLIFlags([]string{"--output-format", "xml", "file.md"}); err == nil {
+		t.Error("ParseCLIFlags() expected error for an unknown output format")
+	}
+}
@@ -0,0 +1,83 @@
+package warnings
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Warnings collects non-fatal problems found while processing a template so
+// they can be reported together, suppressed or serialized.
+type Warnings struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// Add records a warning. It is safe to call on a nil *Warnings, which
+// discards the warning.
+func (w *Warnings) Add(format string, args ...any) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, fmt.Sprintf(format, args...))
+}
+
+// Messages returns the collected warnings in the order they were added.
+func (w *Warnings) Messages() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.messages...)
+}
+
+// Write prints each warning on its own "Warning: ..." line.
+func (w *Warnings) Write(out io.Writer) {
+	for _, message := range w.Messages() {
+		fmt.Fprintf(out, "Warning: %s\n", message)
+	}
+}
+
+// Record is the JSON form of a warning or error written by WriteJSON and
+// WriteJSONError.
+type Record struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// WriteJSON prints each warning as a JSON record on its own line.
+func (w *Warnings) WriteJSON(out io.Writer) {
+	for _, message := range w.Messages() {
+		writeRecord(out, Record{Level: "warning", Message: message})
+	}
+}
+
+// WriteJSONError prints err as a JSON record with its exit code.
+func WriteJSONError(out io.Writer, err error, code int) {
+	writeRecord(out, Record{Level: "error", Message: err.Error(), Code: code})
+}
+
+func writeRecord(out io.Writer, record Record) {
+	line, _ := json.Marshal(record)
+	fmt.Fprintln(out, string(line))
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying w, so code deeper in the pipeline
+// (such as the AI call) can report warnings.
+func NewContext(ctx context.Context, w *Warnings) context.Context {
+	return context.WithValue(ctx, contextKey{}, w)
+}
+
+// FromContext returns the collector carried by ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Warnings {
+	w, _ := ctx.Value(contextKey{}).(*Warnings)
+	return w
+}
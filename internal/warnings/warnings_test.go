@@ -0,0 +1,49 @@
+package warnings
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWarnings(t *testing.T) {
+	w := &Warnings{}
+	w.Add("first %d", 1)
+	w.Add("second")
+
+	if got, want := w.Messages(), []string{"first 1", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Messages() = %v, want %v", got, want)
+	}
+
+	var text bytes.Buffer
+	w.Write(&text)
+	if want := "Warning: first 1\nWarning: second\n"; text.String() != want {
+		t.Errorf("Write() = %q, want %q", text.String(), want)
+	}
+
+	var jsonOut bytes.Buffer
+	w.WriteJSON(&jsonOut)
+	WriteJSONError(&jsonOut, errors.New("boom"), 5)
+	want := `{"level":"warning","message":"first 1"}` + "\n" +
+		`{"level":"warning","message":"second"}` + "\n" +
+		`{"level":"error","message":"boom","code":5}` + "\n"
+	if jsonOut.String() != want {
+		t.Errorf("WriteJSON() = %q, want %q", jsonOut.String(), want)
+	}
+}
+
+func TestWarningsContext(t *testing.T) {
+	if w := FromContext(context.Background()); w != nil {
+		t.Errorf("FromContext() = %v, want nil", w)
+	}
+	// Adding to a missing collector is a no-op
+	FromContext(context.Background()).Add("dropped")
+
+	w := &Warnings{}
+	FromContext(NewContext(context.Background(), w)).Add("kept")
+	if got := w.Messages(); len(got) != 1 || got[0] != "kept" {
+		t.Errorf("Messages() = %v, want [kept]", got)
+	}
+}
@@ -1,40 +1,76 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"mime"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"air/internal/ai"
 	"air/internal/config"
+	"air/internal/diff"
+	"air/internal/progress"
 	"air/internal/schema"
 	"air/internal/summary"
 	"air/internal/template"
+	"air/internal/warnings"
+	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	DefaultFileMode = 0644
 
+	// DefaultMaxPromptSize is the largest final prompt, in bytes, sent to the AI.
+	DefaultMaxPromptSize = 4 << 20
+
 	ExitSuccess       = 0
 	ExitInvalidArgs   = 2
 	ExitFileError     = 3
 	ExitConfigError   = 4
 	ExitTemplateError = 5
 	ExitAIError       = 6
+	ExitEmptyResponse = 7
+	ExitDiffMismatch  = 8
+	ExitWarnings      = 9
+	ExitNoMatch       = 10
 )
 
+// inlinePromptName stands in for the template file name of a --prompt, e.g.
+// in error messages and the {{basename}} of -o.
+const inlinePromptName = "prompt"
+
 type runOptions struct {
+	ctx             context.Context
 	args            []string
+	stdin           io.Reader
 	stdout          io.Writer
 	stderr          io.Writer
 	readFile        func(string) ([]byte, error)
+	fileExists      func(string) bool
 	writeFile       func(string, string) error
-	getEnvVariables func() map[string]string
-	callAI          func(context.Context, config.Config, string) (*ai.Response, error)
+	mkdirAll        func(string) error
+	openAppend      func(string) (io.WriteCloser, error)
+	walkDir         func(string, fs.WalkDirFunc) error
+	getEnvVariables func() (map[string]string, []string)
+	now             func() time.Time
+	callAI          ai.CallFunc
+	auditLogger     ai.AuditLogger
+	countTokens     ai.CountFunc
+	contentCache    ai.ContentCache
 }
 
 func loadEnv() {
@@ -72,81 +108,1585 @@ func writeOutputToFile(filename, content string) error {
 	return nil
 }
 
-func (opts runOptions) writeOutput(cliOpts *template.CLIOptions, content string) error {
-	if cliOpts.OutputFile != "" {
-		return opts.writeFile(cliOpts.OutputFile, content)
+// makeDir creates the directory at path along with any missing parents.
+func makeDir(path string) error {
+	return os.MkdirAll(path, 0o755)
+}
+
+// writeOutput writes content to the file at path, or to stdout when path is
+// empty. Both end with a newline unless trailingNewline is false.
+func (opts runOptions) writeOutput(path, content string, trailingNewline bool) error {
+	if trailingNewline {
+		content += "\n"
 	}
-	fmt.Fprintln(opts.stdout, content)
+	if path != "" {
+		return opts.writeFile(path, content)
+	}
+	fmt.Fprint(opts.stdout, content)
 	return nil
 }
 
+// loadSidecar reads the optional sidecar config file next to the template
+// (e.g. prompt.md.air.yaml). Like includes, it must be inside the project
+// directory.
+func (opts runOptions) loadSidecar(templateFile string) (config.Config, error) {
+	sidecarFile := templateFile + config.SidecarSuffix
+	if !opts.fileExists(sidecarFile) {
+		return config.Config{}, nil
+	}
+
+	absPath, err := template.ResolveAbsolutePath(sidecarFile, ".")
+	if err != nil {
+		return config.Config{}, fmt.Errorf("resolving sidecar %s: %w", sidecarFile, err)
+	}
+	if err := template.ValidatePathSecurity(absPath); err != nil {
+		return config.Config{}, fmt.Errorf("sidecar %s is outside the project directory", sidecarFile)
+	}
+
+	content, err := opts.readFile(sidecarFile)
+	if err != nil {
+		return config.Config{}, fmt.Errorf("reading sidecar %s: %w", sidecarFile, err)
+	}
+
+	sidecar, err := config.ParseSidecar(content)
+	if err != nil {
+		return config.Config{}, fmt.Errorf("parsing sidecar %s: %w", sidecarFile, err)
+	}
+	return sidecar, nil
+}
+
+// readSettingFile reads a file named by a config setting, resolved relative
+// to the template. Like includes, it must be inside the project directory.
+func (opts runOptions) readSettingFile(templateFile, setting, file string) ([]byte, error) {
+	absPath, err := template.ResolveAbsolutePath(file, filepath.Dir(templateFile))
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s %s: %w", setting, file, err)
+	}
+	if err := template.ValidatePathSecurity(absPath); err != nil {
+		return nil, fmt.Errorf("%s %s is outside the project directory", setting, file)
+	}
+
+	content, err := opts.readFile(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s %s: %w", setting, file, err)
+	}
+	return content, nil
+}
+
+// loadCachePrefix reads the cachePrefix file.
+func (opts runOptions) loadCachePrefix(templateFile, prefixFile string) (string, error) {
+	content, err := opts.readSettingFile(templateFile, "cachePrefix", prefixFile)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// loadHistory reads the turns of the history conversation file.
+func (opts runOptions) loadHistory(templateFile, historyFile string) ([]ai.Turn, error) {
+	content, err := opts.readSettingFile(templateFile, "history", historyFile)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := ai.ParseConversation(content)
+	if err != nil {
+		return nil, fmt.Errorf("history %s: %w", historyFile, err)
+	}
+	return conv.Turns, nil
+}
+
+// saveConversation writes the history, the prompt and the response to the
+// --save-conversation file, so a later run can use it as its history.
+func (opts runOptions) saveConversation(path string, history []ai.Turn, prompt, response string) error {
+	turns := append([]ai.Turn{}, history...)
+	turns = append(turns, ai.Turn{Role: ai.RoleUser, Text: prompt}, ai.Turn{Role: ai.RoleModel, Text: response})
+	data, err := ai.Conversation{Turns: turns}.Marshal()
+	if err != nil {
+		return err
+	}
+	return opts.writeFile(path, string(data))
+}
+
+// fileExists reports whether path exists and is a regular file.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// limitSetting returns a limit given by flag (when positive), falling back to
+// the envKey environment variable and then to def.
+func limitSetting(flag int, envVars map[string]string, envKey string, def int) (int, error) {
+	if flag > 0 {
+		return flag, nil
+	}
+	if value, ok := envVars[envKey]; ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return 0, fmt.Errorf("invalid %s value: %s (expected a positive integer)", envKey, value)
+		}
+		return limit, nil
+	}
+	return def, nil
+}
+
+// maxIncludes returns the include limit from --max-includes, falling back to
+// AIR_MAX_INCLUDES and then the default.
+func maxIncludes(cliOpts *template.CLIOptions, envVars map[string]string) (int, error) {
+	return limitSetting(cliOpts.MaxIncludes, envVars, "AIR_MAX_INCLUDES", template.DefaultMaxIncludes)
+}
+
+// maxIncludeDepth returns the include nesting limit from --max-include-depth,
+// falling back to AIR_MAX_INCLUDE_DEPTH and then the default.
+func maxIncludeDepth(cliOpts *template.CLIOptions, envVars map[string]string) (int, error) {
+	return limitSetting(cliOpts.MaxDepth, envVars, "AIR_MAX_INCLUDE_DEPTH", template.DefaultMaxIncludeDepth)
+}
+
+// maxIncludeSize returns the per-file include size cap from
+// --max-include-size, falling back to AIR_MAX_INCLUDE_SIZE and then the
+// default.
+func maxIncludeSize(cliOpts *template.CLIOptions, envVars map[string]string) (int, error) {
+	return limitSetting(cliOpts.MaxIncludeSize, envVars, "AIR_MAX_INCLUDE_SIZE", template.DefaultMaxIncludeSize)
+}
+
+// maxPromptSize returns the prompt size cap from --max-prompt-size, falling
+// back to AIR_MAX_PROMPT_SIZE and then the default.
+func maxPromptSize(cliOpts *template.CLIOptions, envVars map[string]string) (int, error) {
+	return limitSetting(cliOpts.MaxPromptSize, envVars, "AIR_MAX_PROMPT_SIZE", DefaultMaxPromptSize)
+}
+
+// includeKeyword returns the include directive name from --include-keyword,
+// falling back to includeKeyword in the template's frontmatter. The
+// frontmatter is read ahead of includes for this; errors in it are reported
+// when it is parsed for real.
+func includeKeyword(cliOpts *template.CLIOptions, content []byte) string {
+	if cliOpts.IncludeKeyword != "" {
+		return cliOpts.IncludeKeyword
+	}
+	if cliOpts.NoFrontmatter {
+		return ""
+	}
+	cfg, _, err := config.ParseFrontmatter(content)
+	if err != nil {
+		return ""
+	}
+	return cfg.IncludeKeyword
+}
+
+// outputFormat returns the output format from --output-format or --jsonl,
+// falling back to AIR_OUTPUT_FORMAT and then to text.
+func outputFormat(cliOpts *template.CLIOptions, envVars map[string]string) (string, error) {
+	if cliOpts.OutputFormat != "" {
+		return cliOpts.OutputFormat, nil
+	}
+	if value, ok := envVars["AIR_OUTPUT_FORMAT"]; ok {
+		format, err := template.ParseOutputFormat(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid AIR_OUTPUT_FORMAT value: %w", err)
+		}
+		return format, nil
+	}
+	return "text", nil
+}
+
+// outputPath resolves placeholders in the -o value using the template
+// variables plus the built-in index (1-based run number) and basename
+// (template file name without extension) variables.
+func outputPath(pattern, templateFile string, variables map[string]string, index int) (string, error) {
+	builtins := map[string]string{
+		"index":    strconv.Itoa(index),
+		"basename": strings.TrimSuffix(filepath.Base(templateFile), filepath.Ext(templateFile)),
+	}
+	path, err := template.ReplacePlaceholders(pattern, template.MergeVariables(variables, builtins))
+	if err != nil {
+		return "", fmt.Errorf("resolving output path %s: %w", pattern, err)
+	}
+	return path, nil
+}
+
+// writeOutputs writes the output of each run to its destination. Runs whose
+// output paths resolve to the same file are combined in order.
+func (opts runOptions) writeOutputs(cliOpts *template.CLIOptions, templateFile string, variables map[string]string, outputs []string) error {
+	combine := combiner(cliOpts)
+
+	var paths []string
+	groups := make(map[string][]string)
+	for i, output := range outputs {
+		path := ""
+		if cliOpts.OutputFile != "" {
+			var err error
+			path, err = outputPath(cliOpts.OutputFile, templateFile, variables, i+1)
+			if err != nil {
+				return err
+			}
+		}
+		if _, ok := groups[path]; !ok {
+			paths = append(paths, path)
+		}
+		groups[path] = append(groups[path], output)
+	}
+
+	for _, path := range paths {
+		if err := opts.writeOutput(path, combine(groups[path]), !cliOpts.NoTrailingNewline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileExtensions maps common inline data MIME types to file extensions.
+var fileExtensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"audio/wav":       ".wav",
+	"audio/mpeg":      ".mp3",
+	"application/pdf": ".pdf",
+}
+
+// inlineFilePath returns the path for the n-th inline file of a run written
+// to outputPath, e.g. out-1.png for out.txt.
+func inlineFilePath(outputPath string, n int, mimeType string) string {
+	ext, ok := fileExtensions[mimeType]
+	if !ok {
+		ext = ".bin"
+		if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(outputPath, filepath.Ext(outputPath)), n, ext)
+}
+
+// writeFiles writes the inline data parts of each run next to its output
+// file, numbered across runs that share it. Without -o there is nowhere to
+// put them, so they are only reported.
+func (opts runOptions) writeFiles(cliOpts *template.CLIOptions, templateFile string, variables map[string]string, files [][]ai.File, warns *warnings.Warnings) error {
+	written := make(map[string]int)
+	for i, runFiles := range files {
+		if len(runFiles) == 0 {
+			continue
+		}
+		if cliOpts.OutputFile == "" {
+			warns.Add("response contains %d inline file(s); use -o to save them", len(runFiles))
+			continue
+		}
+		path, err := outputPath(cliOpts.OutputFile, templateFile, variables, i+1)
+		if err != nil {
+			return err
+		}
+		for _, file := range runFiles {
+			written[path]++
+			if err := opts.writeFile(inlineFilePath(path, written[path], file.MimeType), string(file.Data)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeSplit splits each response on the --split-on marker and writes the
+// non-empty chunks to numbered files in the --split-dir directory, named after
+// the template. It returns the number of files written.
+func (opts runOptions) writeSplit(cliOpts *template.CLIOptions, templateFile string, texts []string) (int, error) {
+	if err := opts.mkdirAll(cliOpts.SplitDir); err != nil {
+		return 0, fmt.Errorf("creating split directory: %w", err)
+	}
+
+	basename := strings.TrimSuffix(filepath.Base(templateFile), filepath.Ext(templateFile))
+	n := 0
+	for _, text := range texts {
+		for _, chunk := range strings.Split(text, cliOpts.SplitOn) {
+			chunk = strings.TrimSpace(chunk)
+			if chunk == "" {
+				continue
+			}
+			n++
+			path := filepath.Join(cliOpts.SplitDir, fmt.Sprintf("%s-%d.txt", basename, n))
+			if err := opts.writeOutput(path, chunk, !cliOpts.NoTrailingNewline); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// appendToFile opens the file at path for appending, creating it if needed.
+func appendToFile(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, DefaultFileMode)
+}
+
+// openAuditLog opens the --audit-log file for appending.
+func (opts runOptions) openAuditLog(path string) (io.WriteCloser, error) {
+	if strings.Contains(path, "..") {
+		return nil, fmt.Errorf("invalid audit log path: path traversal not allowed")
+	}
+	file, err := opts.openAppend(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return file, nil
+}
+
+// salvagePartial writes the text streamed before a failed call to the
+// --on-error-output file, if one was given and any text was received.
+func (opts runOptions) salvagePartial(path string, err error, warns *warnings.Warnings) {
+	var streamErr *ai.StreamError
+	if path == "" || !errors.As(err, &streamErr) || streamErr.Partial == "" {
+		return
+	}
+	if writeErr := opts.writeFile(path, streamErr.Partial); writeErr != nil {
+		warns.Add("writing partial output to %s: %v", path, writeErr)
+		return
+	}
+	warns.Add("wrote %d bytes of partial output to %s", len(streamErr.Partial), path)
+}
+
+// isTerminal reports whether w is an interactive terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// jsonlRecord is a single line of --jsonl output, describing one AI call.
+type jsonlRecord struct {
+	Template     string `json:"template"`
+	RequestID    string `json:"requestId"`
+	Run          int    `json:"run"`
+	Model        string `json:"model"`
+	Prompt       string `json:"prompt,omitempty"`
+	Output       string `json:"output"`
+	InputTokens  int32  `json:"inputTokens"`
+	OutputTokens int32  `json:"outputTokens"`
+	TotalTokens  int32  `json:"totalTokens"`
+}
+
+// withPrompt prepends the final prompt to a response for --include-prompt.
+func withPrompt(prompt, response string) string {
+	return fmt.Sprintf("--- Prompt ---\n%s\n\n--- Response ---\n%s", strings.TrimRight(prompt, "\n"), response)
+}
+
+// withCitations appends the sources a response cites as numbered footnotes
+// for --citations. A response without citations is returned unchanged.
+func withCitations(response string, citations []ai.Citation) string {
+	if len(citations) == 0 {
+		return response
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(response, "\n"))
+	b.WriteString("\n\nSources:")
+	for i, c := range citations {
+		source := c.Title
+		if c.URI != "" {
+			if source != "" {
+				source += " "
+			}
+			source += "<" + c.URI + ">"
+		}
+		if c.License != "" {
+			source += " (license: " + c.License + ")"
+		}
+		fmt.Fprintf(&b, "\n[%d] %s", i+1, source)
+	}
+	return b.String()
+}
+
+// combiner returns how the outputs of repeated runs are combined into one
+// file: numbered sections, one record per line with --jsonl, or the
+// --separator line between them.
+func combiner(cliOpts *template.CLIOptions) func([]string) string {
+	if cliOpts.JSONLines {
+		return func(outputs []string) string { return strings.Join(outputs, "\n") }
+	}
+	if cliOpts.Separator != nil {
+		separator := outputSeparator(*cliOpts.Separator)
+		return func(outputs []string) string { return strings.Join(outputs, separator) }
+	}
+	return joinOutputs
+}
+
+// defaultSeparator is the line between the stdout outputs of the templates
+// of a batch when --separator is not given.
+const defaultSeparator = "----------------------------------------"
+
+// outputSeparator returns what is written between two outputs for the
+// --separator value: the value on its own line, or nothing when it is empty.
+func outputSeparator(separator string) string {
+	if separator == "" {
+		return ""
+	}
+	return "\n" + separator + "\n"
+}
+
+// formatOptions returns how schema responses are laid out: the defaults of
+// FormatResponse, adjusted by --json-indent and --no-sort-keys.
+func formatOptions(cliOpts *template.CLIOptions) schema.FormatOptions {
+	opts := schema.DefaultFormatOptions
+	if cliOpts.JSONIndent != nil {
+		opts.Indent = *cliOpts.JSONIndent
+	}
+	opts.KeepOrder = cliOpts.NoSortKeys
+	return opts
+}
+
+// separatedWriter writes separator before the first write of each template
+// of a batch but the first one that writes, so outputs on stdout are
+// delimited.
+type separatedWriter struct {
+	w         io.Writer
+	separator string
+	written   bool
+	next      bool
+	last      byte // last byte written, to start the separator on a new line
+}
+
+// nextTemplate marks the start of the output of another template.
+func (s *separatedWriter) nextTemplate() {
+	s.next = true
+}
+
+func (s *separatedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if s.next && s.written {
+		separator := s.separator
+		if s.last != '\n' {
+			separator = "\n" + separator
+		}
+		if _, err := io.WriteString(s.w, separator); err != nil {
+			return 0, err
+		}
+	}
+	s.next = false
+	s.written = true
+	s.last = p[len(p)-1]
+	return s.w.Write(p)
+}
+
+// diffOutput compares the combined outputs with the --diff expected file and
+// reports a unified diff on stderr when they differ. A trailing newline in the
+// expected file is ignored.
+func (opts runOptions) diffOutput(cliOpts *template.CLIOptions, outputs []string) error {
+	expected, err := opts.readFile(cliOpts.Diff)
+	if err != nil {
+		return &exitError{code: ExitFileError, err: fmt.Errorf("reading expected output %s: %w", cliOpts.Diff, err)}
+	}
+
+	want := strings.TrimSuffix(string(expected), "\n")
+	got := combiner(cliOpts)(outputs)
+	if got == want {
+		return nil
+	}
+
+	fmt.Fprint(opts.stderr, diff.Unified(cliOpts.Diff, "output", want+"\n", got+"\n"))
+	return &exitError{code: ExitDiffMismatch, err: fmt.Errorf("output does not match %s", cliOpts.Diff)}
+}
+
+// joinOutputs combines the outputs of repeated runs, numbering each one. A
+// single output is returned unchanged.
+func joinOutputs(outputs []string) string {
+	if len(outputs) == 1 {
+		return outputs[0]
+	}
+
+	var b strings.Builder
+	for i, output := range outputs {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "--- Output %d of %d ---\n%s", i+1, len(outputs), output)
+	}
+	return b.String()
+}
+
+// explain writes a step-by-step description of what run would do for the
+// resolved template, without calling the AI.
+func explain(w io.Writer, templateFile string, included []string, cfg config.Config, markdown string, variables map[string]string, fallbacks []string) {
+	step := 1
+	printStep := func(format string, args ...any) {
+		fmt.Fprintf(w, "%d. "+format+"\n", append([]any{step}, args...)...)
+		step++
+	}
+
+	printStep("Read template %s", templateFile)
+
+	if len(included) == 0 {
+		printStep("Expand includes: none")
+	} else {
+		printStep("Expand %d include(s):", len(included))
+		baseDir, _ := filepath.Abs(filepath.Dir(templateFile))
+		for _, path := range included {
+			if rel, err := filepath.Rel(baseDir, path); err == nil {
+				path = rel
+			}
+			fmt.Fprintf(w, "   - %s\n", path)
+		}
+	}
+
+	printStep("Parse frontmatter and validate configuration")
+
+	required := template.RequiredVariables(markdown)
+	if len(required) == 0 {
+		printStep("Replace placeholders: no required variables")
+	} else {
+		printStep("Replace placeholders, required variables:")
+		for _, name := range required {
+			status := "missing"
+			if _, ok := variables[name]; ok {
+				status = "provided"
+			}
+			fmt.Fprintf(w, "   - %s (%s)\n", name, status)
+		}
+	}
+
+	if cfg.CacheKey != "" {
+		printStep("Reuse or create cached content %q holding %s", cfg.CacheKey, cfg.CachePrefix)
+	}
+
+	if len(fallbacks) == 0 {
+		printStep("Call model %s in location %s", cfg.ModelOrDefault(), ai.Location())
+	} else {
+		printStep("Call model %s in location %s (falling back to %s)", cfg.ModelOrDefault(), ai.Location(), strings.Join(fallbacks, ", "))
+	}
+
+	switch {
+	case cfg.SchemaEnabled():
+		printStep("Validate the response against responseSchema and pretty-print it as JSON")
+	case cfg.ResponseSchema != nil:
+		printStep("Output the response as returned (responseSchema is ignored for text/plain)")
+	default:
+		printStep("Output the response as returned (no responseSchema)")
+	}
+
+	fmt.Fprintln(w, "Nothing was sent: --explain does not call the AI.")
+}
+
 func run(opts runOptions) error {
 	cliOpts, args, err := template.ParseCLIFlags(opts.args)
 	if err != nil {
 		return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("parsing flags: %w", err)}
 	}
 
-	if len(args) < 1 {
-		return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("missing template file argument")}
+	// Warnings from every stage are collected and reported once at the end
+	warns := &warnings.Warnings{}
+	opts.ctx = warnings.NewContext(opts.ctx, warns)
+	err = runTemplates(opts, cliOpts, args, warns)
+	if err == nil && cliOpts.Werror {
+		if n := len(warns.Messages()); n > 0 {
+			err = &exitError{code: ExitWarnings, err: fmt.Errorf("%d warning(s) treated as errors (--werror)", n)}
+		}
+	}
+
+	if cliOpts.ErrorsJSON {
+		if !cliOpts.Quiet {
+			warns.WriteJSON(opts.stderr)
+		}
+		if err != nil {
+			code := ExitAIError
+			if exitErr, ok := err.(*exitError); ok {
+				code = exitErr.code
+			}
+			warnings.WriteJSONError(opts.stderr, err, code)
+			return &exitError{code: code, err: err, reported: true}
+		}
+		return nil
+	}
+
+	if !cliOpts.Quiet {
+		warns.Write(opts.stderr)
+	}
+	if err != nil && cliOpts.Format == "editor" {
+		templateFile := ""
+		if len(args) > 0 {
+			templateFile = args[0]
+		}
+		if located, ok := editorError(err, templateFile); ok {
+			code := ExitAIError
+			if exitErr, ok := err.(*exitError); ok {
+				code = exitErr.code
+			}
+			fmt.Fprintln(opts.stderr, located)
+			return &exitError{code: code, err: err, reported: true}
+		}
+	}
+	return err
+}
+
+// lineError is implemented by errors that know the template line they refer
+// to, such as frontmatter parse errors.
+type lineError interface {
+	error
+	Line() int
+}
+
+// editorError renders err as "file:line: message" for editors that jump to
+// error locations. It reports false when err carries no location.
+func editorError(err error, templateFile string) (string, bool) {
+	var locErr *template.LocationError
+	if errors.As(err, &locErr) {
+		return fmt.Sprintf("%s:%d: %v", locErr.File, locErr.Line, locErr.Err), true
+	}
+	var lineErr lineError
+	if errors.As(err, &lineErr) && lineErr.Line() > 0 && templateFile != "" {
+		return fmt.Sprintf("%s:%d: %v", templateFile, lineErr.Line(), err), true
+	}
+	return "", false
+}
+
+// runTemplates runs each template given in turn. The first failure stops the
+// batch unless --keep-going is set, in which case the remaining templates
+// still run and the batch fails at the end with the exit code of the first
+// failure. Batches of more than one template end with a summary of which
+// files succeeded and failed.
+func runTemplates(opts runOptions, cliOpts *template.CLIOptions, args []string, warns *warnings.Warnings) error {
+	// stdin is read once, so its variables are shared by every template
+	if cliOpts.VarsStdin {
+		if cliOpts.Interactive {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--vars-stdin cannot be used with --interactive, which reads commands from stdin")}
+		}
+		data, err := io.ReadAll(opts.stdin)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("reading variables from stdin: %w", err)}
+		}
+		vars, err := template.ParseVarLines(data)
+		if err != nil {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("parsing variables from stdin: %w", err)}
+		}
+		// --var on the command line wins over the same variable on stdin
+		cliOpts.Variables = template.MergeVariables(vars, cliOpts.Variables)
+	}
+
+	if cliOpts.Interactive {
+		return runInteractive(opts, cliOpts, args)
+	}
+
+	// --check-dir checks every template of a tree, reporting all failures
+	if cliOpts.CheckDir != "" {
+		files, err := opts.findTemplates(cliOpts.CheckDir)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("--check-dir: %w", err)}
+		}
+		if len(files) == 0 {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("--check-dir: no .md templates in %s", cliOpts.CheckDir)}
+		}
+		cliOpts.Check = true
+		cliOpts.KeepGoing = true
+		args = append(files, args...)
+	}
+
+	if len(args) <= 1 && cliOpts.Manifest == "" {
+		return runTemplate(opts, cliOpts, args, warns)
+	}
+
+	jobs := make([]batchJob, 0, len(args))
+	for _, templateFile := range args {
+		jobs = append(jobs, batchJob{templateFile: templateFile, cliOpts: cliOpts})
+	}
+	if cliOpts.Manifest != "" {
+		manifestJobs, err := opts.loadManifest(cliOpts)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, manifestJobs...)
+	}
+
+	// JSONL records and --check results are line-based and stay undelimited
+	envVars, _ := opts.getEnvVariables()
+	format, err := outputFormat(cliOpts, envVars)
+	if err != nil {
+		return &exitError{code: ExitInvalidArgs, err: err}
+	}
+	separator := defaultSeparator
+	if cliOpts.Separator != nil {
+		separator = *cliOpts.Separator
+	}
+	var stdout *separatedWriter
+	if separator != "" && format != "jsonl" && !cliOpts.Check {
+		stdout = &separatedWriter{w: opts.stdout, separator: separator + "\n"}
+		opts.stdout = stdout
+	}
+
+	var succeeded, failed []string
+	var firstErr *exitError
+	for i, job := range jobs {
+		if err := opts.ctx.Err(); err != nil {
+			return &exitError{code: ExitAIError, err: fmt.Errorf("stopped after %d of %d templates: %w", i, len(jobs), err)}
+		}
+		if stdout != nil {
+			stdout.nextTemplate()
+		}
+
+		templateFile := job.templateFile
+		err := runTemplate(opts, job.cliOpts, []string{templateFile}, warns)
+		if err == nil {
+			succeeded = append(succeeded, templateFile)
+			continue
+		}
+		if !cliOpts.KeepGoing {
+			return err
+		}
+
+		exitErr, ok := err.(*exitError)
+		if !ok {
+			exitErr = &exitError{code: ExitAIError, err: err}
+		}
+		if firstErr == nil {
+			firstErr = exitErr
+		}
+		failed = append(failed, templateFile)
+		fmt.Fprintf(opts.stderr, "Error: %s: %v\n", templateFile, err)
+	}
+
+	if !cliOpts.NoSummary {
+		fmt.Fprintln(opts.stderr, formatBatchSummary(succeeded, failed))
+	}
+	if firstErr != nil {
+		return &exitError{code: firstErr.code, err: fmt.Errorf("%d of %d templates failed: %s", len(failed), len(jobs), strings.Join(failed, ", "))}
+	}
+	return nil
+}
+
+// batchJob is one template of a batch with the options it runs with.
+type batchJob struct {
+	templateFile string
+	cliOpts      *template.CLIOptions
+}
+
+// loadManifest reads the --manifest file into batch jobs. Paths in the
+// manifest are relative to it; the vars of an entry override --var, and its
+// output overrides -o.
+func (opts runOptions) loadManifest(cliOpts *template.CLIOptions) ([]batchJob, error) {
+	data, err := opts.readFile(cliOpts.Manifest)
+	if err != nil {
+		return nil, &exitError{code: ExitFileError, err: fmt.Errorf("reading manifest %s: %w", cliOpts.Manifest, err)}
+	}
+	entries, err := template.ParseManifest(data)
+	if err != nil {
+		return nil, &exitError{code: ExitConfigError, err: fmt.Errorf("parsing manifest %s: %w", cliOpts.Manifest, err)}
+	}
+
+	dir := filepath.Dir(cliOpts.Manifest)
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	jobs := make([]batchJob, len(entries))
+	for i, entry := range entries {
+		entryOpts := *cliOpts
+		entryOpts.Variables = template.MergeVariables(cliOpts.Variables, entry.Vars)
+		if entry.Output != "" {
+			entryOpts.OutputFile = resolve(entry.Output)
+		}
+		jobs[i] = batchJob{templateFile: resolve(entry.Template), cliOpts: &entryOpts}
+	}
+	return jobs, nil
+}
+
+// interactiveHelp lists the commands of --interactive.
+const interactiveHelp = `Commands:
+  set name=value  set a variable for the following runs
+  unset name      remove a variable
+  vars            list the variables
+  reload [file]   re-read the template, or switch to file, and check it
+  run             send the template and print the response
+  help            show this help
+  quit            end the session`
+
+// runInteractive reads commands from stdin until quit or the end of input,
+// keeping the template and variables between runs. A failing command is
+// reported and the session goes on.
+func runInteractive(opts runOptions, cliOpts *template.CLIOptions, args []string) error {
+	if cliOpts.Manifest != "" || cliOpts.CheckDir != "" {
+		return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--interactive cannot be used with --manifest or --check-dir")}
+	}
+	if len(args) != 1 {
+		return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--interactive requires exactly one template file")}
 	}
 
 	templateFile := args[0]
+	vars := template.MergeVariables(cliOpts.Variables)
+	scanner := bufio.NewScanner(opts.stdin)
+	for {
+		if err := opts.ctx.Err(); err != nil {
+			return &exitError{code: ExitAIError, err: fmt.Errorf("session interrupted: %w", err)}
+		}
+
+		fmt.Fprint(opts.stderr, "air> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(opts.stderr)
+			break
+		}
+
+		command, arg, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		arg = strings.TrimSpace(arg)
+		switch command {
+		case "":
+		case "set":
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				fmt.Fprintln(opts.stderr, "Error: usage: set name=value")
+				continue
+			}
+			vars[name] = value
+		case "unset":
+			delete(vars, arg)
+		case "vars":
+			names := make([]string, 0, len(vars))
+			for name := range vars {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(opts.stdout, "%s=%s\n", name, vars[name])
+			}
+		case "reload":
+			if arg != "" {
+				templateFile = arg
+			}
+			opts.runSession(cliOpts, templateFile, vars, true)
+		case "run":
+			opts.runSession(cliOpts, templateFile, vars, false)
+		case "help":
+			fmt.Fprintln(opts.stdout, interactiveHelp)
+		case "quit", "exit":
+			return nil
+		default:
+			fmt.Fprintf(opts.stderr, "Error: unknown command %q, type help for the list of commands\n", command)
+		}
+	}
 
-	content, err := opts.readFile(templateFile)
+	if err := scanner.Err(); err != nil {
+		return &exitError{code: ExitFileError, err: fmt.Errorf("reading commands: %w", err)}
+	}
+	return nil
+}
+
+// runSession runs the template of an interactive session once with its
+// variables, or only checks it. Warnings and errors are printed right away.
+func (opts runOptions) runSession(cliOpts *template.CLIOptions, templateFile string, vars map[string]string, check bool) {
+	runOpts := *cliOpts
+	runOpts.Variables = template.MergeVariables(vars)
+	runOpts.Check = runOpts.Check || check
+
+	warns := &warnings.Warnings{}
+	opts.ctx = warnings.NewContext(opts.ctx, warns)
+	err := runTemplate(opts, &runOpts, []string{templateFile}, warns)
+	if !cliOpts.Quiet {
+		warns.Write(opts.stderr)
+	}
 	if err != nil {
-		return &exitError{code: ExitFileError, err: fmt.Errorf("reading file %s: %w", templateFile, err)}
+		fmt.Fprintf(opts.stderr, "Error: %v\n", err)
 	}
+}
 
-	includeCtx := template.NewInclusionContext(templateFile)
-	contentWithIncludes, err := template.ProcessIncludes(string(content), includeCtx)
+// findTemplates returns the .md files under dir in lexical order, skipping
+// hidden files and directories.
+func (opts runOptions) findTemplates(dir string) ([]string, error) {
+	var files []string
+	err := opts.walkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(path), ".md") {
+			files = append(files, path)
+		}
+		return nil
+	})
 	if err != nil {
-		return &exitError{code: ExitTemplateError, err: fmt.Errorf("processing includes: %w", err)}
+		return nil, fmt.Errorf("walking %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// formatBatchSummary lists the templates of a batch by outcome.
+func formatBatchSummary(succeeded, failed []string) string {
+	var b strings.Builder
+	b.WriteString("---\nBatch Summary\n")
+	for _, file := range succeeded {
+		fmt.Fprintf(&b, "OK: %s\n", file)
+	}
+	for _, file := range failed {
+		fmt.Fprintf(&b, "FAILED: %s\n", file)
+	}
+	fmt.Fprintf(&b, "Succeeded: %d, failed: %d\n---", len(succeeded), len(failed))
+	return b.String()
+}
+
+// runTemplate processes the template and calls the AI as configured by
+// cliOpts, adding non-fatal problems to warns.
+func runTemplate(opts runOptions, cliOpts *template.CLIOptions, args []string, warns *warnings.Warnings) error {
+	if cliOpts.SampleConfig {
+		fmt.Fprint(opts.stdout, config.SampleConfig())
+		return nil
+	}
+
+	// An inline --prompt takes the place of the template file
+	inline := cliOpts.Prompt != ""
+	if inline {
+		if len(args) > 0 {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--prompt cannot be used with a template file (%s)", args[0])}
+		}
+		if cliOpts.Body != "" {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--prompt cannot be used with --body")}
+		}
+	} else if len(args) < 1 {
+		return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("missing template file argument")}
+	}
+
+	var templateFile string
+	if inline {
+		templateFile = filepath.Join(cliOpts.BaseDir, inlinePromptName)
+	} else {
+		templateFile = args[0]
+	}
+
+	envVars, skippedEnv := opts.getEnvVariables()
+	if cliOpts.Verbose {
+		for _, key := range skippedEnv {
+			warns.Add("skipped environment variable %s: value contains invalid UTF-8 or control characters", key)
+		}
 	}
 
-	cfg, markdown, err := config.ParseFrontmatter([]byte(contentWithIncludes))
+	// One ID correlates every request of the run
+	requestID := cliOpts.RequestID
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	opts.ctx = ai.WithRequestID(opts.ctx, requestID)
+	opts.ctx = ai.WithProject(opts.ctx, envVars["GOOGLE_CLOUD_PROJECT"])
+
+	format, err := outputFormat(cliOpts, envVars)
 	if err != nil {
-		return &exitError{code: ExitConfigError, err: fmt.Errorf("parsing template: %w", err)}
+		return &exitError{code: ExitInvalidArgs, err: err}
+	}
+	cliOpts.JSONLines = format == "jsonl"
+
+	var safetyWarn aiplatformpb.SafetyRating_HarmProbability
+	if cliOpts.SafetyWarn != "" {
+		safetyWarn, err = config.ParseHarmProbability(cliOpts.SafetyWarn)
+		if err != nil {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--safety-warn: %w", err)}
+		}
+	}
+
+	var uniformSafety map[string]string
+	if cliOpts.Safety != "" {
+		uniformSafety, err = config.UniformSafetySettings(cliOpts.Safety)
+		if err != nil {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--safety: %w", err)}
+		}
+	}
+
+	if (cliOpts.SplitOn == "") != (cliOpts.SplitDir == "") {
+		return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--split-on and --split-dir must be used together")}
+	}
+	if cliOpts.SaveConversation != "" && cliOpts.Count > 1 {
+		return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--save-conversation cannot be used with --count: a conversation holds one response")}
+	}
+	if cliOpts.SplitDir != "" {
+		if cliOpts.OutputFile != "" || cliOpts.JSONLines {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--split-on cannot be used with -o or --jsonl")}
+		}
+		absPath, err := template.ResolveAbsolutePath(cliOpts.SplitDir, ".")
+		if err != nil {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("resolving --split-dir %s: %w", cliOpts.SplitDir, err)}
+		}
+		if err := template.ValidatePathSecurity(absPath); err != nil {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--split-dir %s is outside the project directory", cliOpts.SplitDir)}
+		}
+	}
+
+	content := []byte(cliOpts.Prompt)
+	if !inline {
+		content, err = opts.readFile(templateFile)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("reading file %s: %w", templateFile, err)}
+		}
+	}
+
+	// Vars files are merged in order, later files winning
+	fileVars := map[string]string{}
+	var fileSources []template.VariableSource
+	for _, varsFile := range cliOpts.VarsFiles {
+		data, err := opts.readFile(varsFile)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("reading vars file %s: %w", varsFile, err)}
+		}
+		vars, err := template.ParseVarsFile(data)
+		if err != nil {
+			return &exitError{code: ExitConfigError, err: fmt.Errorf("parsing vars file %s: %w", varsFile, err)}
+		}
+		fileVars = template.MergeVariables(fileVars, vars)
+		fileSources = append(fileSources, template.VariableSource{Name: varsFile, Variables: vars})
+	}
+
+	includeCtx := template.NewInclusionContext(templateFile)
+	// Frontmatter is parsed after includes, so include-if conditions can
+	// only see environment, vars file and --var variables
+	includeCtx.Variables = template.MergeVariables(envVars, fileVars, cliOpts.Variables)
+	includeCtx.AllowedExtensions = cliOpts.IncludeExtensions
+	includeCtx.MaxIncludes, err = maxIncludes(cliOpts, envVars)
+	if err != nil {
+		return &exitError{code: ExitInvalidArgs, err: err}
+	}
+	includeCtx.MaxDepth, err = maxIncludeDepth(cliOpts, envVars)
+	if err != nil {
+		return &exitError{code: ExitInvalidArgs, err: err}
+	}
+	includeSize, err := maxIncludeSize(cliOpts, envVars)
+	if err != nil {
+		return &exitError{code: ExitInvalidArgs, err: err}
+	}
+	includeCtx.MaxFileSize = int64(includeSize)
+	includeCtx.Pattern, err = template.IncludePatternFor(includeKeyword(cliOpts, content))
+	if err != nil {
+		return &exitError{code: ExitConfigError, err: err}
+	}
+	// Includes can be disabled for untrusted templates, leaving the
+	// directives as literal text or rejecting them
+	expandIncludes := func(content, file string) (string, error) {
+		switch {
+		case cliOpts.RejectIncludes:
+			return content, template.RejectIncludesPattern(content, file, includeCtx.Pattern)
+		case cliOpts.NoIncludes:
+			return content, nil
+		case inline && cliOpts.BaseDir == "":
+			if err := template.RejectIncludesPattern(content, file, includeCtx.Pattern); err != nil {
+				return "", fmt.Errorf("%w (pass --base-dir to resolve includes of --prompt)", err)
+			}
+			return content, nil
+		}
+		// Limits are shared by the template and the --body file
+		includeCtx.BaseDir = filepath.Dir(file)
+		includeCtx.File = file
+		expanded, err := template.ProcessIncludes(content, includeCtx)
+		if err != nil {
+			return "", fmt.Errorf("processing includes: %w", err)
+		}
+		for _, warning := range includeCtx.Warnings {
+			warns.Add("%s", warning)
+		}
+		includeCtx.Warnings = nil
+		return expanded, nil
+	}
+	contentWithIncludes, err := expandIncludes(string(content), templateFile)
+	if err != nil {
+		return &exitError{code: ExitTemplateError, err: err}
+	}
+
+	// With --no-frontmatter the whole file is the prompt, even if it starts
+	// with a delimiter line
+	var cfg config.Config
+	markdown := contentWithIncludes
+	if !cliOpts.NoFrontmatter {
+		cfg, markdown, err = config.ParseFrontmatter([]byte(contentWithIncludes))
+		if err != nil {
+			// Report lines of the template file rather than of the text
+			// with its includes expanded
+			err = config.MapErrorLines(err, includeCtx.SourceLine)
+			return &exitError{code: ExitConfigError, err: fmt.Errorf("parsing template: %w", err)}
+		}
+	}
+
+	// With --body the template only provides the frontmatter
+	if cliOpts.Body != "" {
+		if strings.TrimSpace(markdown) != "" {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--body %s: %s already has a body after its frontmatter", cliOpts.Body, templateFile)}
+		}
+		body, err := opts.readFile(cliOpts.Body)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("reading body file %s: %w", cliOpts.Body, err)}
+		}
+		markdown, err = expandIncludes(string(body), cliOpts.Body)
+		if err != nil {
+			return &exitError{code: ExitTemplateError, err: err}
+		}
+		markdown = strings.TrimSpace(markdown)
+	}
+
+	// An inline prompt has no file, so no sidecar either
+	if !inline {
+		sidecar, err := opts.loadSidecar(templateFile)
+		if err != nil {
+			return &exitError{code: ExitConfigError, err: err}
+		}
+		cfg = config.Merge(sidecar, cfg)
+	}
+
+	if cliOpts.Profile != "" {
+		cfg, err = cfg.WithProfile(cliOpts.Profile)
+		if err != nil {
+			return &exitError{code: ExitConfigError, err: fmt.Errorf("selecting profile: %w", err)}
+		}
+	}
+
+	// A shared safety policy applies to categories the template leaves unset
+	if cliOpts.SafetyFile != "" {
+		data, err := opts.readFile(cliOpts.SafetyFile)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("reading safety file %s: %w", cliOpts.SafetyFile, err)}
+		}
+		policy, err := config.ParseSafetyFile(data)
+		if err != nil {
+			return &exitError{code: ExitConfigError, err: fmt.Errorf("parsing safety file %s: %w", cliOpts.SafetyFile, err)}
+		}
+		cfg = config.Merge(config.Config{SafetySettings: policy}, cfg)
+	}
+
+	// Flags take precedence over frontmatter, sidecar and profile
+	if cliOpts.Model != "" {
+		cfg.Model = cliOpts.Model
+	}
+	if cliOpts.NoDefaultSafety {
+		noDefaultSafety := true
+		cfg.NoDefaultSafety = &noDefaultSafety
+	}
+	if uniformSafety != nil {
+		cfg.SafetySettings = uniformSafety
+	}
+	if cliOpts.ResponseMime != "" {
+		cfg.ResponseMimeType = cliOpts.ResponseMime
+	}
+	if cliOpts.SchemaFile != "" {
+		data, err := opts.readFile(cliOpts.SchemaFile)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("reading schema file %s: %w", cliOpts.SchemaFile, err)}
+		}
+		cfg.ResponseSchema, err = config.ParseSchemaFile(data)
+		if err != nil {
+			return &exitError{code: ExitConfigError, err: fmt.Errorf("parsing schema file %s: %w", cliOpts.SchemaFile, err)}
+		}
+	}
+
+	if cfg.DropEmptySchema() {
+		warns.Add("responseSchema is empty and was ignored")
 	}
 
+	if err := cfg.ApplyEnvDefaults(envVars); err != nil {
+		return &exitError{code: ExitConfigError, err: fmt.Errorf("invalid configuration: %w", err)}
+	}
 	if err := cfg.Validate(); err != nil {
 		return &exitError{code: ExitConfigError, err: fmt.Errorf("invalid configuration: %w", err)}
 	}
+	if cliOpts.ForbidBlockNone {
+		if err := cfg.ValidateNoBlockNone(); err != nil {
+			return &exitError{code: ExitConfigError, err: fmt.Errorf("forbidden safety settings (--forbid-block-none): %w", err)}
+		}
+	}
 
-	envVars := opts.getEnvVariables()
-	variables := template.MergeVariables(envVars, cfg.Variables, cliOpts.Variables)
+	if cliOpts.SchemaStrict {
+		for _, warning := range cfg.SchemaWarnings() {
+			warns.Add("%s", warning)
+		}
+	}
 
-	finalMarkdown, err := template.ReplacePlaceholders(markdown, variables)
-	if err != nil {
-		return &exitError{code: ExitTemplateError, err: fmt.Errorf("replacing placeholders: %w", err)}
+	if cliOpts.PrintSchema {
+		if cfg.ResponseSchema == nil {
+			fmt.Fprintln(opts.stderr, "No responseSchema configured")
+		} else {
+			compiled, err := schema.FormatProtobuf(cfg.ResponseSchema)
+			if err != nil {
+				return &exitError{code: ExitConfigError, err: err}
+			}
+			fmt.Fprintln(opts.stderr, compiled)
+		}
+		if cliOpts.SchemaOnly {
+			return nil
+		}
+	}
+
+	// Vars files sit between frontmatter and --var; --locale sits just below
+	// --var, and the built-in date variables below everything else
+	var localeVars map[string]string
+	if cliOpts.Locale != "" {
+		localeVars = map[string]string{"locale": cliOpts.Locale}
+	}
+	dateVars := template.DateVariables(opts.now(), cfg.DateFormat)
+	variables := template.MergeVariables(dateVars, envVars, cfg.Variables, fileVars, localeVars, cliOpts.Variables)
+
+	// Conflicting definitions often mean a precedence mistake
+	if cliOpts.StrictVars {
+		sources := []template.VariableSource{{Name: "environment", Variables: envVars}, {Name: "frontmatter", Variables: cfg.Variables}}
+		sources = append(sources, fileSources...)
+		sources = append(sources, template.VariableSource{Name: "--locale", Variables: localeVars}, template.VariableSource{Name: "--var", Variables: cliOpts.Variables})
+		for _, conflict := range template.FindConflicts(sources) {
+			warns.Add("%s", conflict)
+		}
+	}
+
+	if cliOpts.EchoVars {
+		echoed, err := yaml.Marshal(variables)
+		if err != nil {
+			return &exitError{code: ExitTemplateError, err: fmt.Errorf("encoding variables: %w", err)}
+		}
+		fmt.Fprint(opts.stderr, string(echoed))
+	}
+
+	// If --explain flag is set, describe the pipeline instead of running it
+	if cliOpts.Explain {
+		explain(opts.stdout, templateFile, includeCtx.Included, cfg, markdown, variables, cliOpts.RegionFallback)
+		return nil
+	}
+
+	finalMarkdown := markdown
+	if !cliOpts.NoPlaceholders {
+		finalMarkdown, err = template.ReplacePlaceholders(markdown, variables)
+		if err != nil {
+			return &exitError{code: ExitTemplateError, err: fmt.Errorf("replacing placeholders: %w", err)}
+		}
+	}
+	if !cliOpts.NoPlaceholders && cfg.SystemInstruction != "" {
+		cfg.SystemInstruction, err = template.ReplacePlaceholders(cfg.SystemInstruction, variables)
+		if err != nil {
+			return &exitError{code: ExitTemplateError, err: fmt.Errorf("replacing placeholders in systemInstruction: %w", err)}
+		}
+	}
+
+	if cliOpts.Locale != "" && !cliOpts.NoLocaleHint {
+		hint, err := template.ReplacePlaceholders(cfg.LocaleHintOrDefault(), variables)
+		if err != nil {
+			return &exitError{code: ExitTemplateError, err: fmt.Errorf("replacing placeholders in localeHint: %w", err)}
+		}
+		finalMarkdown = strings.TrimRight(finalMarkdown, "\n") + "\n\n" + hint
+	}
+
+	// Redactions apply to the prompt exactly as it would be sent
+	if len(cliOpts.Redactions) > 0 {
+		var count int
+		finalMarkdown, count = template.Redact(finalMarkdown, cliOpts.Redactions)
+		if cfg.SystemInstruction != "" {
+			var systemCount int
+			cfg.SystemInstruction, systemCount = template.Redact(cfg.SystemInstruction, cliOpts.Redactions)
+			count += systemCount
+		}
+		if cliOpts.Verbose {
+			fmt.Fprintf(opts.stderr, "Redacted %d match(es) from the prompt\n", count)
+		}
 	}
 
 	// If --show-prompt-only flag is set, just output the prompt and exit
 	if cliOpts.ShowPromptOnly {
-		if err := opts.writeOutput(cliOpts, finalMarkdown); err != nil {
+		if err := opts.writeOutputs(cliOpts, templateFile, variables, []string{finalMarkdown}); err != nil {
 			return &exitError{code: ExitFileError, err: fmt.Errorf("writing output: %w", err)}
 		}
+		// No request is made, so the count can only be estimated
+		if cliOpts.CountTokens {
+			fmt.Fprintf(opts.stderr, "Estimated prompt tokens: ~%d (local estimate, not counted by the model)\n", ai.EstimateTokens(finalMarkdown))
+		}
 		return nil
 	}
 
-	ctx := context.Background()
-	response, err := opts.callAI(ctx, cfg, finalMarkdown)
+	if strings.TrimSpace(finalMarkdown) == "" {
+		if cliOpts.Body != "" {
+			return &exitError{code: ExitTemplateError, err: fmt.Errorf("prompt is empty: body file %s has no content", cliOpts.Body)}
+		}
+		return &exitError{code: ExitTemplateError, err: fmt.Errorf("prompt is empty: %s has no content after the frontmatter", templateFile)}
+	}
+
+	sizeLimit, err := maxPromptSize(cliOpts, envVars)
 	if err != nil {
-		return &exitError{code: ExitAIError, err: fmt.Errorf("calling AI: %w", err)}
+		return &exitError{code: ExitInvalidArgs, err: err}
+	}
+	if len(finalMarkdown) > sizeLimit {
+		return &exitError{code: ExitTemplateError, err: fmt.Errorf("prompt is too large: %d bytes (limit %d bytes)", len(finalMarkdown), sizeLimit)}
 	}
 
-	output := response.Text
-	if cfg.ResponseSchema != nil {
-		output = schema.FormatResponse(response.Text)
+	var history []ai.Turn
+	if cfg.History != "" {
+		history, err = opts.loadHistory(templateFile, cfg.History)
+		if err != nil {
+			return &exitError{code: ExitConfigError, err: err}
+		}
+		// Earlier turns are sent along with the prompt, so they are
+		// redacted like it
+		if len(cliOpts.Redactions) > 0 {
+			var count int
+			for i := range history {
+				var turnCount int
+				history[i].Text, turnCount = template.Redact(history[i].Text, cliOpts.Redactions)
+				count += turnCount
+			}
+			if cliOpts.Verbose {
+				fmt.Fprintf(opts.stderr, "Redacted %d match(es) from the history\n", count)
+			}
+		}
+		opts.ctx = ai.WithHistory(opts.ctx, history)
 	}
 
-	if err := opts.writeOutput(cliOpts, output); err != nil {
-		return &exitError{code: ExitFileError, err: fmt.Errorf("writing output: %w", err)}
+	// The token budget is checked before anything is generated; a replayed
+	// response costs nothing, and --check stays offline
+	tokenLimit := cliOpts.MaxPromptTokens
+	if tokenLimit == 0 && cfg.MaxPromptTokens != nil {
+		tokenLimit = *cfg.MaxPromptTokens
+	}
+	if tokenLimit > 0 && cliOpts.Replay == "" && !cliOpts.Check {
+		tokens, err := opts.countTokens(opts.ctx, cfg, finalMarkdown)
+		if err != nil {
+			return &exitError{code: ExitAIError, err: fmt.Errorf("counting prompt tokens: %w", err)}
+		}
+		if tokens > tokenLimit {
+			return &exitError{code: ExitTemplateError, err: fmt.Errorf("prompt is too large: %d tokens (maxPromptTokens %d)", tokens, tokenLimit)}
+		}
+		if cliOpts.Verbose {
+			fmt.Fprintf(opts.stderr, "Prompt tokens: %d of %d allowed\n", tokens, tokenLimit)
+		}
+	}
+
+	var cachePrefix string
+	if cfg.CacheKey != "" {
+		if len(cliOpts.RegionFallback) > 0 {
+			return &exitError{code: ExitInvalidArgs, err: fmt.Errorf("--region-fallback cannot be used with cacheKey: cached content belongs to one location")}
+		}
+		cachePrefix, err = opts.loadCachePrefix(templateFile, cfg.CachePrefix)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: err}
+		}
+		// The prefix is sent to the model too, so it is redacted like the
+		// prompt
+		if len(cliOpts.Redactions) > 0 {
+			var count int
+			cachePrefix, count = template.Redact(cachePrefix, cliOpts.Redactions)
+			if cliOpts.Verbose {
+				fmt.Fprintf(opts.stderr, "Redacted %d match(es) from the cache prefix\n", count)
+			}
+		}
+	}
+
+	// If --check flag is set, stop before the AI client is ever created
+	if cliOpts.Check {
+		if err := cfg.ValidateSchema(); err != nil {
+			return &exitError{code: ExitConfigError, err: err}
+		}
+		fmt.Fprintf(opts.stdout, "%s: OK\n", templateFile)
+		return nil
+	}
+
+	ctx := opts.ctx
+	model := cfg.ModelOrDefault()
+
+	callAI := opts.callAI
+	if cliOpts.Replay != "" {
+		replayed, err := opts.readFile(cliOpts.Replay)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("reading replay file %s: %w", cliOpts.Replay, err)}
+		}
+		callAI = func(context.Context, config.Config, string) (*ai.Response, error) {
+			return &ai.Response{Text: string(replayed), Source: ai.SourceReplay}, nil
+		}
+	} else {
+		// Every attempt is audited, including fallbacks and retries
+		auditLogger := opts.auditLogger
+		if cliOpts.AuditLog != "" {
+			file, err := opts.openAuditLog(cliOpts.AuditLog)
+			if err != nil {
+				return &exitError{code: ExitFileError, err: err}
+			}
+			defer file.Close()
+			auditLogger = ai.NewJSONAuditLogger(file)
+		}
+		if auditLogger != nil {
+			callAI = ai.WithAudit(callAI, auditLogger, opts.now)
+		}
+		callAI = ai.WithRegionFallback(callAI, cliOpts.RegionFallback)
+		if cliOpts.RetryEmpty {
+			callAI = ai.WithEmptyRetry(callAI)
+		}
+		if cliOpts.RetryDeadline {
+			callAI = ai.WithDeadlineRetry(callAI)
+		}
+		if cliOpts.Continue {
+			maxContinuations := cliOpts.MaxContinuations
+			if maxContinuations == 0 {
+				maxContinuations = ai.DefaultMaxContinuations
+			}
+			callAI = ai.WithContinuation(callAI, maxContinuations)
+		}
 	}
 
+	// The static prefix is cached once and referenced by every run
+	cacheStatus := ""
+	if cfg.CacheKey != "" && cliOpts.Replay == "" {
+		name, hit, err := opts.contentCache.Resolve(ctx, cfg.CacheKey, model, cachePrefix)
+		if err != nil {
+			return &exitError{code: ExitAIError, err: fmt.Errorf("resolving cached content %s: %w", cfg.CacheKey, err)}
+		}
+		ctx = ai.WithCachedContent(ctx, name)
+		cacheStatus = "created"
+		if hit {
+			cacheStatus = "hit"
+		}
+	}
+
+	var reporter *progress.Reporter
+	if cliOpts.Replay == "" && !cliOpts.Quiet && isTerminal(opts.stderr) && cfg.MaxTokensOrDefault() > 0 {
+		reporter = progress.NewReporter(opts.stderr, cfg.MaxTokensOrDefault())
+		ctx = ai.WithProgress(ctx, reporter.Update)
+	}
+
+	// The summary destination is opened up front, so a bad path fails
+	// before any request is made
+	summaryWriter := io.Discard
 	if !cliOpts.NoSummary {
-		model := cfg.ModelOrDefault()
-		s := summary.BuildSummary(model, response)
-		summary.Display(s, opts.stderr)
+		writer, closeSummary, err := summary.Destination(cliOpts.SummaryDest, opts.stdout, opts.stderr)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: err}
+		}
+		defer closeSummary()
+		summaryWriter = writer
+	}
+
+	outputs := make([]string, 0, cliOpts.Count)
+	texts := make([]string, 0, cliOpts.Count)
+	files := make([][]ai.File, 0, cliOpts.Count)
+	var unmatched []int
+	var s *summary.Summary
+
+	started := opts.now()
+	for i := 0; i < cliOpts.Count; i++ {
+		if err := ctx.Err(); err != nil {
+			return &exitError{code: ExitAIError, err: fmt.Errorf("stopped after %d of %d runs: %w", i, cliOpts.Count, err)}
+		}
+
+		response, err := callAI(ctx, cfg, finalMarkdown)
+		if reporter != nil {
+			reporter.Done()
+		}
+		if err != nil {
+			opts.salvagePartial(cliOpts.OnErrorOutput, err, warns)
+			return &exitError{code: ExitAIError, err: fmt.Errorf("calling AI: %w", err)}
+		}
+
+		if cliOpts.Verbose && len(response.SafetyRatings) > 0 {
+			fmt.Fprintln(opts.stderr, summary.FormatSafetyRatings(response.SafetyRatings))
+		}
+		if cliOpts.SafetyWarn != "" {
+			ai.WarnSafetyRatings(ctx, response.SafetyRatings, safetyWarn)
+		}
+
+		if cliOpts.FailOnEmpty && strings.TrimSpace(response.Text) == "" {
+			return &exitError{code: ExitEmptyResponse, err: fmt.Errorf("empty response from AI (run %d of %d)", i+1, cliOpts.Count)}
+		}
+
+		if cliOpts.ExpectMatch != nil && !cliOpts.ExpectMatch.MatchString(response.Text) {
+			unmatched = append(unmatched, i+1)
+		}
+
+		text := response.Text
+		if cliOpts.Extract != "" {
+			text, err = schema.ExtractField(response.Text, cliOpts.Extract)
+			if err != nil {
+				return &exitError{code: ExitNoMatch, err: fmt.Errorf("run %d of %d: --extract: %w", i+1, cliOpts.Count, err)}
+			}
+		}
+
+		if cliOpts.JSONLines {
+			record := jsonlRecord{
+				Template:     templateFile,
+				RequestID:    requestID,
+				Run:          i + 1,
+				Model:        model,
+				Output:       text,
+				InputTokens:  response.InputTokens,
+				OutputTokens: response.OutputTokens,
+				TotalTokens:  response.TotalTokens,
+			}
+			if cliOpts.IncludePrompt {
+				record.Prompt = finalMarkdown
+			}
+			if cliOpts.Citations {
+				record.Output = withCitations(record.Output, response.Citations)
+			}
+			line, err := json.Marshal(record)
+			if err != nil {
+				return &exitError{code: ExitFileError, err: fmt.Errorf("encoding JSONL record: %w", err)}
+			}
+			outputs = append(outputs, string(line))
+		} else {
+			output := text
+			if cfg.SchemaEnabled() && cliOpts.Extract == "" {
+				output = schema.FormatResponseWith(response.Text, formatOptions(cliOpts))
+			}
+			if cliOpts.Citations {
+				output = withCitations(output, response.Citations)
+			}
+			if cliOpts.IncludePrompt {
+				output = withPrompt(finalMarkdown, output)
+			}
+			outputs = append(outputs, output)
+		}
+		texts = append(texts, response.Text)
+		files = append(files, response.Files)
+
+		if s == nil {
+			s = summary.BuildSummary(model, response)
+		} else {
+			s.Add(response)
+		}
+	}
+	s.Duration = opts.now().Sub(started)
+	s.Cache = cacheStatus
+	if cliOpts.Verbose || cliOpts.RequestID != "" {
+		s.RequestID = requestID
+	}
+	if cliOpts.CountTokens {
+		s.EstimatedInputTokens = ai.EstimateTokens(finalMarkdown) * int32(cliOpts.Count)
+	}
+
+	if !cliOpts.NoSummary && cliOpts.SummaryFirst {
+		summary.Display(s, summaryWriter)
+	}
+
+	if cliOpts.SplitDir != "" {
+		n, err := opts.writeSplit(cliOpts, templateFile, texts)
+		if err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("writing split output: %w", err)}
+		}
+		if cliOpts.Verbose {
+			fmt.Fprintf(opts.stderr, "Wrote %d file(s) to %s\n", n, cliOpts.SplitDir)
+		}
+	} else if err := opts.writeOutputs(cliOpts, templateFile, variables, outputs); err != nil {
+		return &exitError{code: ExitFileError, err: fmt.Errorf("writing output: %w", err)}
+	}
+	if err := opts.writeFiles(cliOpts, templateFile, variables, files, warns); err != nil {
+		return &exitError{code: ExitFileError, err: fmt.Errorf("writing inline data: %w", err)}
+	}
+
+	if cliOpts.SaveConversation != "" {
+		if err := opts.saveConversation(cliOpts.SaveConversation, history, finalMarkdown, texts[0]); err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("saving conversation: %w", err)}
+		}
+	}
+
+	if !cliOpts.NoSummary && !cliOpts.SummaryFirst {
+		summary.Display(s, summaryWriter)
+	}
+	if cliOpts.MetricsFile != "" {
+		if err := opts.writeFile(cliOpts.MetricsFile, s.FormatPrometheus(opts.now())); err != nil {
+			return &exitError{code: ExitFileError, err: fmt.Errorf("writing metrics file %s: %w", cliOpts.MetricsFile, err)}
+		}
+	}
+
+	// The output is written even when it does not match
+	if len(unmatched) > 0 {
+		return &exitError{code: ExitNoMatch, err: fmt.Errorf("response of run(s) %v does not match --expect-match %s", unmatched, cliOpts.ExpectMatch)}
+	}
+
+	if cliOpts.Diff != "" {
+		return opts.diffOutput(cliOpts, outputs)
 	}
 
 	return nil
@@ -155,6 +1695,9 @@ func run(opts runOptions) error {
 type exitError struct {
 	code int
 	err  error
+
+	// reported is set when the error was already written (--errors-json)
+	reported bool
 }
 
 func (e *exitError) Error() string {
@@ -168,18 +1711,38 @@ func (e *exitError) Unwrap() error {
 func main() {
 	loadEnv()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// One client serves every request of the process
+	client := &ai.Client{}
+
 	opts := runOptions{
+		ctx:             ctx,
 		args:            os.Args[1:],
+		stdin:           os.Stdin,
 		stdout:          os.Stdout,
 		stderr:          os.Stderr,
 		readFile:        os.ReadFile,
+		fileExists:      fileExists,
 		writeFile:       writeOutputToFile,
+		mkdirAll:        makeDir,
+		openAppend:      appendToFile,
+		walkDir:         filepath.WalkDir,
 		getEnvVariables: template.GetEnvVariables,
-		callAI:          ai.CallVertexAI,
+		now:             time.Now,
+		callAI:          client.Call,
+		auditLogger:     ai.NopAuditLogger{},
+		countTokens:     ai.CountTokens,
+		contentCache:    &ai.VertexCache{},
 	}
 
-	if err := run(opts); err != nil {
-		if exitErr, ok := err.(*exitError); ok {
+	err := run(opts)
+	client.Close()
+	if err != nil {
+		if exitErr, ok := err.(*exitError); ok && exitErr.reported {
+			os.Exit(exitErr.code)
+		} else if ok {
 			fatalf(exitErr.code, "Error: %v", exitErr.err)
 		} else {
 			fatalf(ExitAIError, "Error: %v", err)
@@ -3,12 +3,28 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"air/internal/ai"
 	"air/internal/config"
+	"air/internal/template"
+	"air/internal/warnings"
+
+	"cloud.google.com/go/aiplatform/apiv1/aiplatformpb"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestRun_MissingArgument(t *testing.T) {
@@ -442,81 +458,3490 @@ func TestRun_ShowPromptOnly_ErrorCases(t *testing.T) {
 	}
 }
 
-func TestRun_WriteFileError(t *testing.T) {
+func TestRun_Explain(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
 	opts := createTestOptions()
-	opts.args = []string{"-o", "output.txt", "template.md"}
+	opts.args = []string{"--explain", "--var", "name=Alice", "template.md"}
+	opts.stdout = stdout
 	opts.readFile = func(path string) ([]byte, error) {
-		return []byte("Test prompt"), nil
-	}
-	opts.writeFile = func(path, content string) error {
-		return errors.New("permission denied")
+		return []byte("---\nmodel: gemini-1.5-pro-002\n---\nHello {{name}}, do {{task}} in {{lang|Go}}"), nil
 	}
+
+	aiCalled := false
 	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
-		return &ai.Response{
-			Text:        "Response",
-			InputTokens: 10,
-			OutputTokens: 20,
-		}, nil
+		aiCalled = true
+		return nil, errors.New("should not be called")
 	}
 
 	err := run(opts)
-	if err == nil {
-		t.Fatal("expected error for write file failure")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if aiCalled {
+		t.Error("AI should not have been called with --explain flag")
+	}
+
+	output := stdout.String()
+	for _, want := range []string{"template.md", "gemini-1.5-pro-002", "name (provided)", "task (missing)"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected explanation to contain %q, got: %s", want, output)
+		}
+	}
+	if strings.Contains(output, "lang") {
+		t.Errorf("expected variables with defaults not to be listed as required, got: %s", output)
+	}
+}
+
+func TestRun_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		wantCode int
+	}{
+		{"valid", "---\nmodel: gemini-1.5-pro-002\n---\nHello {{name|World}}", ExitSuccess},
+		{"valid schema", "---\nresponseSchema:\n  type: object\n  properties:\n    name:\n      type: string\n---\nPrompt", ExitSuccess},
+		{"missing variable", "Hello {{name}}", ExitTemplateError},
+		{"invalid config", "---\nsafetySettings:\n  hate_speech: BLOCK_SOMETIMES\n---\nPrompt", ExitConfigError},
+		{"invalid schema", "---\nresponseSchema:\n  type: 42\n---\nPrompt", ExitConfigError},
+		{"empty prompt", "---\nmodel: gemini-1.5-pro-002\n---\n", ExitTemplateError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = []string{"--check", "template.md"}
+			opts.stdout = stdout
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.content), nil
+			}
+
+			aiCalled := false
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				aiCalled = true
+				return nil, errors.New("should not be called")
+			}
+
+			err := run(opts)
+			if aiCalled {
+				t.Error("AI should not have been called with --check flag")
+			}
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !strings.Contains(stdout.String(), "template.md: OK") {
+					t.Errorf("expected OK line, got: %s", stdout.String())
+				}
+				return
+			}
+			exitErr, ok := err.(*exitError)
+			if !ok || exitErr.code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestRun_VerboseSkippedEnv(t *testing.T) {
+	stderr := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--verbose", "template.md"}
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Prompt"), nil
+	}
+	opts.getEnvVariables = func() (map[string]string, []string) {
+		return map[string]string{}, []string{"BAD_VALUE"}
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "Warning: skipped environment variable BAD_VALUE") {
+		t.Errorf("expected skipped variable to be reported, got: %s", stderr.String())
+	}
+}
+
+func TestRun_SchemaStrict(t *testing.T) {
+	content := "---\nresponseSchema:\n  type: object\n  properties:\n    name:\n      type: string\n---\nPrompt"
+
+	for _, strict := range []bool{false, true} {
+		stderr := &bytes.Buffer{}
+		opts := createTestOptions()
+		opts.args = []string{"--no-summary", "template.md"}
+		if strict {
+			opts.args = append([]string{"--schema-strict"}, opts.args...)
+		}
+		opts.stderr = stderr
+		opts.readFile = func(path string) ([]byte, error) {
+			return []byte(content), nil
+		}
+
+		if err := run(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		warned := strings.Contains(stderr.String(), "Warning: responseSchema property name has no description")
+		if warned != strict {
+			t.Errorf("strict=%v: expected warning %v, got stderr: %s", strict, strict, stderr.String())
+		}
+	}
+}
+
+func TestRun_SchemaStrictDeadEnd(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--schema-strict", "--no-summary", "template.md"}
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nresponseSchema:\n  type: object\n  additionalProperties: false\n---\nPrompt"), nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "Warning: responseSchema has no properties and additionalProperties: false") {
+		t.Errorf("expected a dead-end schema warning, got stderr: %s", stderr.String())
+	}
+}
+
+func TestRun_PrintSchema(t *testing.T) {
+	content := "---\nresponseSchema:\n  type: object\n  properties:\n    name:\n      type: string\n    age:\n      type: integer\n---\nPrompt"
+
+	tests := []struct {
+		name       string
+		flag       string
+		wantAICall bool
+	}{
+		{"print and continue", "--print-schema", true},
+		{"print only", "--print-schema-only", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = []string{tt.flag, "--no-summary", "template.md"}
+			opts.stderr = stderr
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(content), nil
+			}
+
+			aiCalled := false
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				aiCalled = true
+				return &ai.Response{Text: "{}"}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if aiCalled != tt.wantAICall {
+				t.Errorf("expected AI called = %v, got %v", tt.wantAICall, aiCalled)
+			}
+			for _, want := range []string{"OBJECT", "\"name\"", "STRING", "\"age\"", "INTEGER"} {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("expected printed schema to contain %s, got: %s", want, stderr.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRun_NoFrontmatter(t *testing.T) {
+	content := "---\n\nHello {{name|World}}\n\n---\nmodel: not-config\n"
+
+	var gotPrompt string
+	var gotCfg config.Config
+	opts := createTestOptions()
+	opts.args = []string{"--no-frontmatter", "--no-summary", "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte(content), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		gotCfg, gotPrompt = cfg, prompt
+		return &ai.Response{Text: "Response"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "---\n\nHello World\n\n---\nmodel: not-config\n"
+	if gotPrompt != want {
+		t.Errorf("expected prompt %q, got %q", want, gotPrompt)
+	}
+	if gotCfg.Model != "" {
+		t.Errorf("expected default config, got model %q", gotCfg.Model)
+	}
+}
+
+func TestRun_NoPlaceholders(t *testing.T) {
+	var gotPrompt string
+	opts := createTestOptions()
+	opts.args = []string{"--no-placeholders", "--no-summary", "--var", "name=Alice", "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Write {{name}} or {{name|default}} to insert a variable."), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		gotPrompt = prompt
+		return &ai.Response{Text: "Response"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "Write {{name}} or {{name|default}} to insert a variable."
+	if gotPrompt != want {
+		t.Errorf("expected prompt %q, got %q", want, gotPrompt)
+	}
+}
+
+func TestRun_NoIncludes(t *testing.T) {
+	content := `Summarize {{include "../../etc/passwd"}}`
+
+	tests := []struct {
+		name       string
+		flag       string
+		wantPrompt string
+		wantCode   int
+	}{
+		{"left literal", "--no-includes", content, ExitSuccess},
+		{"rejected", "--reject-includes", "", ExitTemplateError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPrompt string
+			opts := createTestOptions()
+			opts.args = []string{tt.flag, "--no-summary", "template.md"}
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(content), nil
+			}
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				gotPrompt = prompt
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				exitErr, ok := err.(*exitError)
+				if !ok || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotPrompt != tt.wantPrompt {
+				t.Errorf("expected prompt %q, got %q", tt.wantPrompt, gotPrompt)
+			}
+		})
+	}
+}
+
+func TestRun_Warnings(t *testing.T) {
+	content := "---\nresponseSchema:\n  type: object\n  properties:\n    name:\n      type: string\n---\nPrompt"
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantStderr string
+	}{
+		{"text", nil, "Warning: responseSchema property name has no description\nWarning: response does not match schema\n"},
+		{"quiet", []string{"--quiet"}, ""},
+		{"json", []string{"--errors-json"}, `{"level":"warning","message":"responseSchema property name has no description"}` + "\n" +
+			`{"level":"warning","message":"response does not match schema"}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--schema-strict", "--no-summary"}, tt.args...), "template.md")
+			opts.stderr = stderr
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(content), nil
+			}
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				warnings.FromContext(ctx).Add("response does not match schema")
+				return &ai.Response{Text: "{}"}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stderr.String() != tt.wantStderr {
+				t.Errorf("expected stderr %q, got %q", tt.wantStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRun_Werror(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		warn     bool
+		wantCode int
+	}{
+		{"warning without --werror", nil, true, ExitSuccess},
+		{"warning with --werror", []string{"--werror"}, true, ExitWarnings},
+		{"no warning with --werror", []string{"--werror"}, false, ExitSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), "template.md")
+			opts.stdout = stdout
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte("Prompt"), nil
+			}
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				if tt.warn {
+					warnings.FromContext(ctx).Add("response does not match schema")
+				}
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if stdout.String() != "Response\n" {
+				t.Errorf("expected output to be written, got %q", stdout.String())
+			}
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			exitErr, ok := err.(*exitError)
+			if !ok || exitErr.code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestRun_ErrorsJSON(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--errors-json", "template.md"}
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Hello {{name}}"), nil
 	}
 
+	err := run(opts)
 	exitErr, ok := err.(*exitError)
-	if !ok {
-		t.Fatal("expected exitError")
+	if !ok || exitErr.code != ExitTemplateError || !exitErr.reported {
+		t.Fatalf("expected reported template exitError, got: %v", err)
 	}
 
-	if exitErr.code != ExitFileError {
-		t.Errorf("expected exit code %d, got %d", ExitFileError, exitErr.code)
+	var record warnings.Record
+	if err := json.Unmarshal(stderr.Bytes(), &record); err != nil {
+		t.Fatalf("stderr is not a JSON record: %v (%s)", err, stderr.String())
+	}
+	if record.Level != "error" || record.Code != ExitTemplateError || !strings.Contains(record.Message, "name") {
+		t.Errorf("unexpected error record %+v", record)
 	}
 }
 
-func TestExitError_Error(t *testing.T) {
-	err := &exitError{
-		code: ExitAIError,
-		err:  errors.New("test error"),
+func TestRun_VarsFiles(t *testing.T) {
+	files := map[string]string{
+		"template.md": "---\nvariables:\n  tone: neutral\n---\n{{tone}} {{env}} {{region}} {{name}}",
+		"base.yaml":   "tone: formal\nenv: dev\nregion: eu\nname: Base",
+		"prod.yaml":   "env: prod\nname: Prod",
 	}
 
-	if err.Error() != "test error" {
-		t.Errorf("expected 'test error', got: %s", err.Error())
+	var gotPrompt string
+	opts := createTestOptions()
+	opts.args = []string{"--vars-file", "base.yaml", "--vars-file", "prod.yaml", "--var", "name=Alice", "--no-summary", "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte(files[path]), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		gotPrompt = prompt
+		return &ai.Response{Text: "Response"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "formal prod eu Alice"; gotPrompt != want {
+		t.Errorf("expected prompt %q, got %q", want, gotPrompt)
 	}
 }
 
-func TestExitError_Unwrap(t *testing.T) {
-	innerErr := errors.New("inner error")
-	err := &exitError{
-		code: ExitAIError,
-		err:  innerErr,
+func TestRun_EchoVars(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	files := map[string]string{
+		"template.md": "---\nvariables:\n  tone: neutral\n  region: eu\n---\n{{tone}} {{region}} {{name}}",
+		"vars.yaml":   "tone: formal\nname: File",
 	}
 
-	if err.Unwrap() != innerErr {
-		t.Error("Unwrap() did not return the inner error")
+	opts := createTestOptions()
+	opts.args = []string{"--echo-vars", "--vars-file", "vars.yaml", "--var", "name=Alice", "--no-summary", "template.md"}
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte(files[path]), nil
+	}
+	opts.getEnvVariables = func() (map[string]string, []string) {
+		return map[string]string{"region": "us", "USER": "tester"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "USER: tester\nname: Alice\nnow: \"2024-06-01T12:30:00Z\"\nregion: eu\ntimestamp: \"1717245000\"\ntoday: \"2024-06-01\"\ntone: formal\n"
+	if stderr.String() != want {
+		t.Errorf("expected echoed variables %q, got %q", want, stderr.String())
 	}
 }
 
-func createTestOptions() runOptions {
-	return runOptions{
-		args:   []string{},
-		stdout: &bytes.Buffer{},
-		stderr: &bytes.Buffer{},
-		readFile: func(path string) ([]byte, error) {
-			return []byte("default content"), nil
-		},
-		writeFile: func(path, content string) error {
-			return nil
+func TestRun_PlainTextSkipsSchema(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nresponseMimeType: text/plain\nresponseSchema:\n  type: object\n---\nPrompt"), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return &ai.Response{Text: `{"a": 1}`}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "{\"a\": 1}\n"; stdout.String() != want {
+		t.Errorf("expected unformatted output %q, got %q", want, stdout.String())
+	}
+}
+
+func TestRun_Profile(t *testing.T) {
+	content := "---\nmodel: gemini-1.5-pro-002\nprofiles:\n  dev:\n    model: gemini-2.0-flash-001\n---\nPrompt"
+
+	tests := []struct {
+		name      string
+		args      []string
+		wantModel string
+		wantErr   bool
+	}{
+		{"base config", []string{"template.md"}, "gemini-1.5-pro-002", false},
+		{"dev profile", []string{"--profile", "dev", "template.md"}, "gemini-2.0-flash-001", false},
+		{"unknown profile", []string{"--profile", "prod", "template.md"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(content), nil
+			}
+
+			var gotModel string
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				gotModel = cfg.ModelOrDefault()
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantErr {
+				exitErr, ok := err.(*exitError)
+				if !ok || exitErr.code != ExitConfigError {
+					t.Fatalf("expected config exitError, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotModel != tt.wantModel {
+				t.Errorf("expected model %q, got %q", tt.wantModel, gotModel)
+			}
+		})
+	}
+}
+
+func TestRun_DefaultModelEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		env       string
+		wantModel string
+		wantCode  int
+	}{
+		{"env default", "Prompt", "gemini-1.5-pro-002", "gemini-1.5-pro-002", ExitSuccess},
+		{"frontmatter wins", "---\nmodel: gemini-2.5-pro\n---\nPrompt", "gemini-1.5-pro-002", "gemini-2.5-pro", ExitSuccess},
+		{"unsupported env default", "Prompt", "gemini-99", "", ExitConfigError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = []string{"template.md"}
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.content), nil
+			}
+			opts.getEnvVariables = func() (map[string]string, []string) {
+				return map[string]string{config.DefaultModelEnv: tt.env}, nil
+			}
+			var gotModel string
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				gotModel = cfg.ModelOrDefault()
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				if exitErr, ok := err.(*exitError); !ok || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotModel != tt.wantModel {
+				t.Errorf("expected model %q, got %q", tt.wantModel, gotModel)
+			}
+		})
+	}
+}
+
+func TestRun_Sidecar(t *testing.T) {
+	files := map[string]string{
+		"template.md":          "---\nmaxTokens: 256\n---\nHello {{name|World}}",
+		"template.md.air.yaml": "model: gemini-1.5-pro-002\nmaxTokens: 1024\nvariables:\n  name: Sidecar\n",
+	}
+
+	tests := []struct {
+		name       string
+		sidecar    bool
+		wantModel  string
+		wantTokens int32
+		wantPrompt string
+	}{
+		{"no sidecar", false, config.DefaultModel, 256, "Hello World"},
+		{"sidecar under inline", true, "gemini-1.5-pro-002", 256, "Hello Sidecar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = []string{"template.md"}
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(files[path]), nil
+			}
+			opts.fileExists = func(path string) bool {
+				return tt.sidecar && path == "template.md.air.yaml"
+			}
+
+			var gotCfg config.Config
+			var gotPrompt string
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				gotCfg, gotPrompt = cfg, prompt
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotCfg.ModelOrDefault() != tt.wantModel {
+				t.Errorf("expected model %q, got %q", tt.wantModel, gotCfg.ModelOrDefault())
+			}
+			if gotCfg.MaxTokens == nil || int32(*gotCfg.MaxTokens) != tt.wantTokens {
+				t.Errorf("expected maxTokens %d, got %v", tt.wantTokens, gotCfg.MaxTokens)
+			}
+			if gotPrompt != tt.wantPrompt {
+				t.Errorf("expected prompt %q, got %q", tt.wantPrompt, gotPrompt)
+			}
+		})
+	}
+}
+
+func TestRun_SidecarOutsideProject(t *testing.T) {
+	opts := createTestOptions()
+	opts.args = []string{"../template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Prompt"), nil
+	}
+	opts.fileExists = func(path string) bool {
+		return path == "../template.md.air.yaml"
+	}
+
+	err := run(opts)
+	exitErr, ok := err.(*exitError)
+	if !ok || exitErr.code != ExitConfigError {
+		t.Fatalf("expected config exitError, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "outside the project directory") {
+		t.Errorf("expected outside-project error, got: %v", err)
+	}
+}
+
+func TestRun_Count(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--count", "3", "template.md"}
+	opts.stdout = stdout
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Test prompt"), nil
+	}
+
+	calls := 0
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		calls++
+		return &ai.Response{
+			Text:         fmt.Sprintf("Response %d", calls),
+			InputTokens:  10,
+			OutputTokens: 20,
+			TotalTokens:  30,
+		}, nil
+	}
+
+	err := run(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 AI calls, got %d", calls)
+	}
+
+	output := stdout.String()
+	for i := 1; i <= 3; i++ {
+		want := fmt.Sprintf("--- Output %d of 3 ---\nResponse %d", i, i)
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got: %s", want, output)
+		}
+	}
+
+	summaryOutput := stderr.String()
+	for _, want := range []string{"Calls: 3", "Input tokens: 30", "Output tokens: 60", "Total tokens: 90"} {
+		if !strings.Contains(summaryOutput, want) {
+			t.Errorf("expected summary to contain %q, got: %s", want, summaryOutput)
+		}
+	}
+}
+
+func TestRun_CountCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := createTestOptions()
+	opts.ctx = ctx
+	opts.args = []string{"--count", "5", "template.md"}
+
+	calls := 0
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return &ai.Response{Text: "Response"}, nil
+	}
+
+	err := run(opts)
+	if err == nil {
+		t.Fatal("expected error after cancellation")
+	}
+
+	if calls != 2 {
+		t.Errorf("expected cancellation to stop after 2 calls, got %d", calls)
+	}
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestRun_IncludePrompt(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--include-prompt", "--no-summary", "--var", "name=Alice", "template.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Hello {{name}}\n"), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return &ai.Response{Text: "Hi there"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "--- Prompt ---\nHello Alice\n\n--- Response ---\nHi there\n"
+	if stdout.String() != want {
+		t.Errorf("expected output %q, got %q", want, stdout.String())
+	}
+}
+
+func TestRun_IncludePromptJSONLines(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--include-prompt", "--jsonl", "--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Test prompt"), nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var record jsonlRecord
+	if err := json.Unmarshal(stdout.Bytes(), &record); err != nil {
+		t.Fatalf("output is not valid JSON: %v (%s)", err, stdout.String())
+	}
+	if record.Prompt != "Test prompt" || record.Output != "default response" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+func TestRun_Diff(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+		wantCode int
+		wantDiff string
+	}{
+		{"match", []string{"--diff", "expected.txt", "template.md"}, "default response\n", ExitSuccess, ""},
+		{"mismatch", []string{"--diff", "expected.txt", "template.md"}, "other response\n", ExitDiffMismatch, "-other response\n+default response\n"},
+		{"replay match", []string{"--replay", "replay.txt", "--diff", "expected.txt", "template.md"}, "replayed\nresponse\n", ExitSuccess, ""},
+		{"replay mismatch", []string{"--replay", "replay.txt", "--diff", "expected.txt", "template.md"}, "replayed\nanswer\n", ExitDiffMismatch, " replayed\n-answer\n+response\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			files := map[string]string{
+				"template.md":  "Prompt",
+				"expected.txt": tt.expected,
+				"replay.txt":   "replayed\nresponse",
+			}
+
+			opts := createTestOptions()
+			opts.args = append([]string{"--no-summary"}, tt.args...)
+			opts.stderr = stderr
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(files[path]), nil
+			}
+
+			err := run(opts)
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if stderr.Len() != 0 {
+					t.Errorf("expected no diff, got: %s", stderr.String())
+				}
+				return
+			}
+			exitErr, ok := err.(*exitError)
+			if !ok || exitErr.code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+			}
+			if !strings.Contains(stderr.String(), "--- expected.txt\n+++ output\n") || !strings.Contains(stderr.String(), tt.wantDiff) {
+				t.Errorf("expected diff containing %q, got: %s", tt.wantDiff, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRun_Replay(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--replay", "replay.txt", "--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		if path == "replay.txt" {
+			return []byte("Replayed response"), nil
+		}
+		return []byte("Prompt"), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return nil, errors.New("should not be called")
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stdout.String() != "Replayed response\n" {
+		t.Errorf("expected replayed response, got %q", stdout.String())
+	}
+}
+
+func TestRun_RegionFallback(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_LOCATION", "us-central1")
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--region-fallback", "europe-west4,asia-northeast1", "--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.stderr = stderr
+	var tried []string
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		location := ai.LocationFromContext(ctx)
+		tried = append(tried, location)
+		if location == "us-central1" {
+			return nil, status.Error(codes.ResourceExhausted, "quota exceeded")
+		}
+		return &ai.Response{Text: "Response from " + location}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"us-central1", "europe-west4"}; strings.Join(tried, ",") != strings.Join(want, ",") {
+		t.Errorf("tried locations %v, want %v", tried, want)
+	}
+	if stdout.String() != "Response from europe-west4\n" {
+		t.Errorf("expected response from fallback location, got %q", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Warning: location us-central1 failed, retrying in europe-west4") {
+		t.Errorf("expected fallback warning, got: %s", stderr.String())
+	}
+}
+
+func TestRun_EditorFormat(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		content      string
+		wantStderr   string
+		wantReported bool
+	}{
+		{
+			"frontmatter error",
+			[]string{"--format=editor", "template.md"},
+			"---\nmodel: gemini-1.5-pro-002\ntemperature: hot\n---\nPrompt",
+			"template.md:3: parsing template: failed to parse YAML: yaml: unmarshal errors:\n  line 3: cannot unmarshal !!str `hot` into float32\n",
+			true,
 		},
-		getEnvVariables: func() map[string]string {
-			return map[string]string{}
+		{
+			"rejected include",
+			[]string{"--format", "editor", "--reject-includes", "template.md"},
+			"Intro\n{{include \"secret.txt\"}}",
+			"template.md:2: include \"secret.txt\": includes are disabled\n",
+			true,
 		},
-		callAI: func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
-			return &ai.Response{
-				Text:        "default response",
-				InputTokens: 10,
-				OutputTokens: 20,
-			}, nil
+		{
+			"error without location",
+			[]string{"--format=editor", "template.md"},
+			"Hello {{name}}",
+			"",
+			false,
 		},
 	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.stderr = stderr
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.content), nil
+			}
+
+			err := run(opts)
+			var exitErr *exitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("expected exitError, got %v", err)
+			}
+			if exitErr.reported != tt.wantReported {
+				t.Errorf("reported = %v, want %v", exitErr.reported, tt.wantReported)
+			}
+			if stderr.String() != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestRun_FrontmatterErrorLineWithIncludes(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_errline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := os.WriteFile(filepath.Join(tempDir, "safety.yaml"), []byte("safetySettings:\n  harassment: BLOCK_NONE\n  hate_speech: BLOCK_NONE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--format=editor", filepath.Join(tempDir, "template.md")}
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\n{{include \"safety.yaml\"}}\ntemperature: hot\n---\nPrompt"), nil
+	}
+
+	if err := run(opts); err == nil {
+		t.Fatal("expected an error for the invalid temperature")
+	}
+	// temperature is on line 3 of the template, not on line 5 of the text
+	// with the include expanded
+	if want := "template.md:3: "; !strings.Contains(stderr.String(), want) || !strings.Contains(stderr.String(), "line 3: cannot unmarshal") {
+		t.Errorf("expected the error on line 3, got %q", stderr.String())
+	}
+}
+
+func TestRun_ResponseOverrides(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantMime   string
+		wantSchema string
+	}{
+		{"frontmatter only", []string{"template.md"}, "text/plain", ""},
+		{"response mime flag", []string{"--response-mime", "application/json", "template.md"}, "application/json", ""},
+		{"schema file flag", []string{"--schema-file", "schema.json", "template.md"}, "text/plain", "object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = append([]string{"--no-summary"}, tt.args...)
+			opts.readFile = func(path string) ([]byte, error) {
+				if path == "schema.json" {
+					return []byte(`{"type": "object", "properties": {"name": {"type": "string"}}}`), nil
+				}
+				return []byte("---\nresponseMimeType: text/plain\n---\nPrompt"), nil
+			}
+			var got config.Config
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				got = cfg
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.ResponseMimeType != tt.wantMime {
+				t.Errorf("ResponseMimeType = %q, want %q", got.ResponseMimeType, tt.wantMime)
+			}
+			if typ, _ := got.ResponseSchema["type"].(string); typ != tt.wantSchema {
+				t.Errorf("ResponseSchema type = %q, want %q", typ, tt.wantSchema)
+			}
+		})
+	}
+}
+
+// fakeContentCache resolves every key to a fixed cached content.
+type fakeContentCache struct {
+	name   string
+	hit    bool
+	prefix string
+}
+
+func (c *fakeContentCache) Resolve(ctx context.Context, key, model, prefix string) (string, bool, error) {
+	c.prefix = prefix
+	return c.name, c.hit, nil
+}
+
+func TestRun_ContentCache(t *testing.T) {
+	for _, hit := range []bool{true, false} {
+		stderr := &bytes.Buffer{}
+
+		cache := &fakeContentCache{name: "projects/p/locations/l/cachedContents/1", hit: hit}
+		opts := createTestOptions()
+		opts.args = []string{"--count", "2", "template.md"}
+		opts.stderr = stderr
+		opts.contentCache = cache
+		opts.readFile = func(path string) ([]byte, error) {
+			if strings.HasSuffix(path, "docs.md") {
+				return []byte("Large shared documentation"), nil
+			}
+			return []byte("---\ncacheKey: docs\ncachePrefix: docs.md\n---\nQuestion"), nil
+		}
+		var cachedContents []string
+		opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+			cachedContents = append(cachedContents, ai.CachedContentFromContext(ctx))
+			return &ai.Response{Text: "Answer"}, nil
+		}
+
+		if err := run(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cache.prefix != "Large shared documentation" {
+			t.Errorf("cached prefix = %q, want the cachePrefix file content", cache.prefix)
+		}
+		if len(cachedContents) != 2 || cachedContents[0] != cache.name || cachedContents[1] != cache.name {
+			t.Errorf("calls referenced cached contents %v, want %s for both runs", cachedContents, cache.name)
+		}
+		want := "Cache: created"
+		if hit {
+			want = "Cache: hit"
+		}
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("hit=%v: expected %q in summary, got: %s", hit, want, stderr.String())
+		}
+	}
+}
+
+func TestRun_Body(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "body_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	files := map[string]string{
+		"config.md":    "---\nvariables:\n  name: Alice\n---\n",
+		"with-body.md": "---\nvariables:\n  name: Alice\n---\nTemplate body",
+		"body.md":      "Hello {{name}}\n{{include \"part.md\"}}\n",
+		"part.md":      "Included part",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		template   string
+		wantPrompt string
+		wantCode   int
+	}{
+		{"external body", "config.md", "Hello Alice\nIncluded part", ExitSuccess},
+		{"template with body", "with-body.md", "", ExitInvalidArgs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = []string{"--no-summary", "--body", filepath.Join(tempDir, "body.md"), filepath.Join(tempDir, tt.template)}
+			opts.readFile = os.ReadFile
+			var prompt string
+			opts.callAI = func(ctx context.Context, cfg config.Config, p string) (*ai.Response, error) {
+				prompt = p
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				var exitErr *exitError
+				if !errors.As(err, &exitErr) || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if prompt != tt.wantPrompt {
+				t.Errorf("prompt = %q, want %q", prompt, tt.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestRun_ForbidBlockNone(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		content  string
+		wantCode int
+	}{
+		{"BLOCK_NONE allowed by default", []string{"template.md"}, "---\nsafetySettings:\n  harassment: BLOCK_NONE\n---\nPrompt", ExitSuccess},
+		{"BLOCK_NONE setting", []string{"--forbid-block-none", "template.md"}, "---\nsafetySettings:\n  harassment: BLOCK_NONE\n---\nPrompt", ExitConfigError},
+		{"default settings", []string{"--forbid-block-none", "template.md"}, "Prompt", ExitConfigError},
+		{"blocking settings", []string{"--forbid-block-none", "template.md"}, "---\nsafetySettings:\n  harassment: BLOCK_ONLY_HIGH\n---\nPrompt", ExitSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = append([]string{"--no-summary"}, tt.args...)
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.content), nil
+			}
+
+			err := run(opts)
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var exitErr *exitError
+			if !errors.As(err, &exitErr) || exitErr.code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestRun_Redact(t *testing.T) {
+	stderr := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--verbose", "--no-summary", "--redact", `[\w.]+@[\w.]+=>[email]`, "--var", "contact=ann@example.com", "template.md"}
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Reply to {{contact}}, cc team@example.com"), nil
+	}
+	var prompt string
+	opts.callAI = func(ctx context.Context, cfg config.Config, p string) (*ai.Response, error) {
+		prompt = p
+		return &ai.Response{Text: "Response"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Reply to [email], cc [email]"; prompt != want {
+		t.Errorf("prompt = %q, want %q", prompt, want)
+	}
+	if !strings.Contains(stderr.String(), "Redacted 2 match(es) from the prompt") {
+		t.Errorf("expected redaction count in verbose output, got: %s", stderr.String())
+	}
+
+	opts.args = []string{"--redact", `[=>x`, "template.md"}
+	var exitErr *exitError
+	if err := run(opts); !errors.As(err, &exitErr) || exitErr.code != ExitInvalidArgs {
+		t.Errorf("expected invalid args error for a bad regex, got %v", err)
+	}
+}
+
+func TestRun_RedactCachePrefix(t *testing.T) {
+	cache := &fakeContentCache{name: "projects/p/locations/l/cachedContents/1"}
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "--redact", `[\w.]+@[\w.]+=>[email]`, "template.md"}
+	opts.contentCache = cache
+	opts.readFile = func(path string) ([]byte, error) {
+		if strings.HasSuffix(path, "docs.md") {
+			return []byte("Contact support@example.com"), nil
+		}
+		return []byte("---\ncacheKey: docs\ncachePrefix: docs.md\n---\nQuestion"), nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Contact [email]"; cache.prefix != want {
+		t.Errorf("cached prefix = %q, want %q", cache.prefix, want)
+	}
+}
+
+func TestRun_RedactHistory(t *testing.T) {
+	conversation, err := ai.Conversation{Turns: []ai.Turn{
+		{Role: ai.RoleUser, Text: "Write to ann@example.com"},
+		{Role: ai.RoleModel, Text: "Done, ann@example.com is informed"},
+	}}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "--redact", `[\w.]+@[\w.]+=>[email]`, "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		if strings.HasSuffix(path, "conversation.yaml") {
+			return conversation, nil
+		}
+		return []byte("---\nhistory: conversation.yaml\n---\nAnd now?"), nil
+	}
+	var history []ai.Turn
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		history = ai.HistoryFromContext(ctx)
+		return &ai.Response{Text: "Response"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ai.Turn{{Role: ai.RoleUser, Text: "Write to [email]"}, {Role: ai.RoleModel, Text: "Done, [email] is informed"}}
+	if !reflect.DeepEqual(history, want) {
+		t.Errorf("history = %+v, want %+v", history, want)
+	}
+}
+
+func TestRun_JSONLines(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--jsonl", "--count", "2", "--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nmodel: gemini-1.5-pro-002\n---\nTest prompt"), nil
+	}
+
+	calls := 0
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		calls++
+		return &ai.Response{
+			Text:         fmt.Sprintf("Line one\nResponse %d", calls),
+			InputTokens:  10,
+			OutputTokens: 20,
+			TotalTokens:  30,
+		}, nil
+	}
+
+	err := run(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSONL records, got %d: %q", len(lines), stdout.String())
+	}
+
+	for i, line := range lines {
+		var record jsonlRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("record %d is not valid JSON: %v (%s)", i, err, line)
+		}
+		if record.Run != i+1 {
+			t.Errorf("record %d: expected run %d, got %d", i, i+1, record.Run)
+		}
+		if record.Output != fmt.Sprintf("Line one\nResponse %d", i+1) {
+			t.Errorf("record %d: unexpected output %q", i, record.Output)
+		}
+		if record.Template != "template.md" || record.Model != "gemini-1.5-pro-002" || record.TotalTokens != 30 {
+			t.Errorf("record %d: unexpected metadata %+v", i, record)
+		}
+	}
+}
+
+func TestRun_TopLevelArraySchema(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nresponseSchema:\n  type: array\n  maxItems: 2\n  items:\n    type: string\n---\nList two colors"), nil
+	}
+
+	var gotSchema map[string]interface{}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		gotSchema = cfg.ResponseSchema
+		return &ai.Response{Text: `["red","blue"]`}, nil
+	}
+
+	err := run(opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if gotSchema["type"] != "array" {
+		t.Errorf("expected array schema to reach the AI call, got: %v", gotSchema)
+	}
+
+	want := "[\n  \"red\",\n  \"blue\"\n]\n"
+	if stdout.String() != want {
+		t.Errorf("expected pretty-printed array %q, got: %q", want, stdout.String())
+	}
+}
+
+func TestRun_FailOnEmpty(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		response string
+		wantCode int
+	}{
+		{"whitespace fails with flag", []string{"--fail-on-empty", "template.md"}, " \n\t ", ExitEmptyResponse},
+		{"whitespace passes without flag", []string{"template.md"}, " \n\t ", ExitSuccess},
+		{"text passes with flag", []string{"--fail-on-empty", "template.md"}, "Response", ExitSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				return &ai.Response{Text: tt.response}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			exitErr, ok := err.(*exitError)
+			if !ok {
+				t.Fatalf("expected exitError, got: %v", err)
+			}
+			if exitErr.code != tt.wantCode {
+				t.Errorf("expected exit code %d, got %d", tt.wantCode, exitErr.code)
+			}
+		})
+	}
+}
+
+func TestRun_TrailingNewline(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"default", nil, "Response\n"},
+		{"no trailing newline", []string{"--no-trailing-newline"}, "Response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, toFile := range []bool{false, true} {
+				stdout := &bytes.Buffer{}
+				var written string
+
+				opts := createTestOptions()
+				opts.args = append([]string{"--no-summary"}, tt.args...)
+				if toFile {
+					opts.args = append(opts.args, "-o", "out.txt")
+				}
+				opts.args = append(opts.args, "template.md")
+				opts.stdout = stdout
+				opts.writeFile = func(path, content string) error {
+					written = content
+					return nil
+				}
+				opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+					return &ai.Response{Text: "Response"}, nil
+				}
+
+				if err := run(opts); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				got := stdout.String()
+				if toFile {
+					got = written
+				}
+				if got != tt.want {
+					t.Errorf("toFile=%v: expected %q, got %q", toFile, tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_TemplatedOutputPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantFiles map[string]string
+	}{
+		{
+			name: "variables and index per run",
+			args: []string{"--var", "name=report", "--count", "2", "-o", "out/{{name}}-{{index}}.txt", "prompts/summary.md"},
+			wantFiles: map[string]string{
+				"out/report-1.txt": "Response 1\n",
+				"out/report-2.txt": "Response 2\n",
+			},
+		},
+		{
+			name:      "basename",
+			args:      []string{"-o", "{{basename}}.txt", "prompts/summary.md"},
+			wantFiles: map[string]string{"summary.txt": "Response 1\n"},
+		},
+		{
+			name:      "runs sharing a path are combined",
+			args:      []string{"--count", "2", "-o", "{{basename}}.txt", "prompts/summary.md"},
+			wantFiles: map[string]string{"summary.txt": "--- Output 1 of 2 ---\nResponse 1\n\n--- Output 2 of 2 ---\nResponse 2\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written := make(map[string]string)
+
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.writeFile = func(path, content string) error {
+				written[path] = content
+				return nil
+			}
+
+			calls := 0
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				calls++
+				return &ai.Response{Text: fmt.Sprintf("Response %d", calls)}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(written) != len(tt.wantFiles) {
+				t.Errorf("expected files %v, got %v", tt.wantFiles, written)
+			}
+			for path, want := range tt.wantFiles {
+				if written[path] != want {
+					t.Errorf("expected %s to contain %q, got %q", path, want, written[path])
+				}
+			}
+		})
+	}
+}
+
+func TestRun_TemplatedOutputPathTraversal(t *testing.T) {
+	opts := createTestOptions()
+	opts.args = []string{"--var", "dir=..", "-o", "{{dir}}/escape.txt", "template.md"}
+	opts.writeFile = writeOutputToFile
+
+	err := run(opts)
+	if err == nil {
+		t.Fatal("expected error for output path escaping via a variable")
+	}
+
+	exitErr, ok := err.(*exitError)
+	if !ok || exitErr.code != ExitFileError {
+		t.Fatalf("expected file exitError, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "path traversal") {
+		t.Errorf("expected path traversal error, got: %v", err)
+	}
+}
+
+func TestMaxIncludes(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    int
+		env     map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"default", 0, map[string]string{}, template.DefaultMaxIncludes, false},
+		{"env", 0, map[string]string{"AIR_MAX_INCLUDES": "50"}, 50, false},
+		{"flag overrides env", 5, map[string]string{"AIR_MAX_INCLUDES": "50"}, 5, false},
+		{"invalid env", 0, map[string]string{"AIR_MAX_INCLUDES": "lots"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := maxIncludes(&template.CLIOptions{MaxIncludes: tt.flag}, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("maxIncludes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("maxIncludes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxIncludeSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    int
+		env     map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"default", 0, map[string]string{}, template.DefaultMaxIncludeSize, false},
+		{"env", 0, map[string]string{"AIR_MAX_INCLUDE_SIZE": "4096"}, 4096, false},
+		{"flag overrides env", 100, map[string]string{"AIR_MAX_INCLUDE_SIZE": "4096"}, 100, false},
+		{"invalid env", 0, map[string]string{"AIR_MAX_INCLUDE_SIZE": "1MB"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := maxIncludeSize(&template.CLIOptions{MaxIncludeSize: tt.flag}, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("maxIncludeSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("maxIncludeSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxIncludeDepth(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    int
+		env     map[string]string
+		want    int
+		wantErr bool
+	}{
+		{"default", 0, map[string]string{}, template.DefaultMaxIncludeDepth, false},
+		{"env", 0, map[string]string{"AIR_MAX_INCLUDE_DEPTH": "4"}, 4, false},
+		{"flag overrides env", 2, map[string]string{"AIR_MAX_INCLUDE_DEPTH": "4"}, 2, false},
+		{"invalid env", 0, map[string]string{"AIR_MAX_INCLUDE_DEPTH": "0"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := maxIncludeDepth(&template.CLIOptions{MaxDepth: tt.flag}, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("maxIncludeDepth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("maxIncludeDepth() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_MaxPromptSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		wantCode int
+	}{
+		{"under the cap", []string{"--max-prompt-size", "100", "template.md"}, nil, ExitSuccess},
+		{"over the flag cap", []string{"--max-prompt-size", "10", "template.md"}, nil, ExitTemplateError},
+		{"over the env cap", []string{"template.md"}, map[string]string{"AIR_MAX_PROMPT_SIZE": "10"}, ExitTemplateError},
+		{"invalid env cap", []string{"template.md"}, map[string]string{"AIR_MAX_PROMPT_SIZE": "big"}, ExitInvalidArgs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte("Hello {{name|World}}, this prompt is 36 bytes"), nil
+			}
+			opts.getEnvVariables = func() (map[string]string, []string) {
+				return tt.env, nil
+			}
+
+			aiCalled := false
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				aiCalled = true
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			exitErr, ok := err.(*exitError)
+			if !ok || exitErr.code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+			}
+			if aiCalled {
+				t.Error("AI should not be called when the prompt exceeds the cap")
+			}
+			if tt.wantCode == ExitTemplateError && !strings.Contains(err.Error(), "36 bytes (limit 10 bytes)") {
+				t.Errorf("expected actual and allowed sizes in error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestRun_VerboseSafetyRatings(t *testing.T) {
+	for _, verbose := range []bool{true, false} {
+		stderr := &bytes.Buffer{}
+
+		opts := createTestOptions()
+		opts.args = []string{"--no-summary", "template.md"}
+		if verbose {
+			opts.args = append([]string{"--verbose"}, opts.args...)
+		}
+		opts.stderr = stderr
+		opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+			return &ai.Response{
+				Text: "Response",
+				SafetyRatings: [][]ai.SafetyRating{{
+					{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HARASSMENT, Probability: aiplatformpb.SafetyRating_LOW},
+				}},
+			}, nil
+		}
+
+		if err := run(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		shown := strings.Contains(stderr.String(), "harassment")
+		if shown != verbose {
+			t.Errorf("verbose=%v: expected safety table shown=%v, got: %s", verbose, verbose, stderr.String())
+		}
+	}
+}
+
+func TestRun_SummaryOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		summaryFirst bool
+	}{
+		{"summary after response by default", []string{"--summary-stdout", "template.md"}, false},
+		{"summary first", []string{"--summary-stdout", "--summary-first", "template.md"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.stdout = stdout
+			opts.stderr = stderr
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				return &ai.Response{Text: "Test response"}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			output := stdout.String()
+			summaryIdx := strings.Index(output, "Request Summary")
+			responseIdx := strings.Index(output, "Test response")
+			if summaryIdx < 0 || responseIdx < 0 {
+				t.Fatalf("expected summary and response on stdout, got: %s", output)
+			}
+			if (summaryIdx < responseIdx) != tt.summaryFirst {
+				t.Errorf("expected summaryFirst=%v, got: %s", tt.summaryFirst, output)
+			}
+			if stderr.Len() != 0 {
+				t.Errorf("expected nothing on stderr with --summary-stdout, got: %s", stderr.String())
+			}
+		})
+	}
+}
+
+func TestRun_SummaryDest(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	logFile := filepath.Join(tempDir, "summaries.log")
+
+	tests := []struct {
+		name       string
+		dest       string
+		wantStdout bool
+		wantStderr bool
+	}{
+		{"stderr", "--summary-dest=stderr", false, true},
+		{"stdout", "--summary-dest=stdout", true, false},
+		{"file", "--summary-dest=" + logFile, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			opts := createTestOptions()
+			opts.args = []string{tt.dest, "template.md"}
+			opts.stdout = stdout
+			opts.stderr = stderr
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(stdout.String(), "default response") {
+				t.Errorf("expected the response on stdout, got: %s", stdout.String())
+			}
+			if got := strings.Contains(stdout.String(), "Request Summary"); got != tt.wantStdout {
+				t.Errorf("summary on stdout = %v, want %v", got, tt.wantStdout)
+			}
+			if got := strings.Contains(stderr.String(), "Request Summary"); got != tt.wantStderr {
+				t.Errorf("summary on stderr = %v, want %v", got, tt.wantStderr)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("reading summary file: %v", err)
+	}
+	if !strings.Contains(string(data), "Request Summary") {
+		t.Errorf("expected the summary in %s, got: %s", logFile, data)
+	}
+}
+
+func TestRun_FrontmatterOnlyTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		content string
+		wantErr bool
+	}{
+		{"frontmatter only", []string{"template.md"}, "---\ntemperature: 0.5\n---\n", true},
+		{"whitespace body", []string{"template.md"}, "---\nmodel: gemini-2.0-flash-001\n---\n  \n\t\n", true},
+		{"show prompt only", []string{"--show-prompt-only", "template.md"}, "---\ntemperature: 0.5\n---\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.content), nil
+			}
+
+			aiCalled := false
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				aiCalled = true
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			exitErr, ok := err.(*exitError)
+			if !ok || exitErr.code != ExitTemplateError {
+				t.Fatalf("expected template exitError, got: %v", err)
+			}
+			if !strings.Contains(err.Error(), "prompt is empty") {
+				t.Errorf("expected empty prompt error, got: %v", err)
+			}
+			if aiCalled {
+				t.Error("AI should not be called with an empty prompt")
+			}
+		})
+	}
+}
+
+func TestRun_WriteFileError(t *testing.T) {
+	opts := createTestOptions()
+	opts.args = []string{"-o", "output.txt", "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Test prompt"), nil
+	}
+	opts.writeFile = func(path, content string) error {
+		return errors.New("permission denied")
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return &ai.Response{
+			Text:        "Response",
+			InputTokens: 10,
+			OutputTokens: 20,
+		}, nil
+	}
+
+	err := run(opts)
+	if err == nil {
+		t.Fatal("expected error for write file failure")
+	}
+
+	exitErr, ok := err.(*exitError)
+	if !ok {
+		t.Fatal("expected exitError")
+	}
+
+	if exitErr.code != ExitFileError {
+		t.Errorf("expected exit code %d, got %d", ExitFileError, exitErr.code)
+	}
+}
+
+func TestExitError_Error(t *testing.T) {
+	err := &exitError{
+		code: ExitAIError,
+		err:  errors.New("test error"),
+	}
+
+	if err.Error() != "test error" {
+		t.Errorf("expected 'test error', got: %s", err.Error())
+	}
+}
+
+func TestExitError_Unwrap(t *testing.T) {
+	innerErr := errors.New("inner error")
+	err := &exitError{
+		code: ExitAIError,
+		err:  innerErr,
+	}
+
+	if err.Unwrap() != innerErr {
+		t.Error("Unwrap() did not return the inner error")
+	}
+}
+
+func createTestOptions() runOptions {
+	return runOptions{
+		ctx:    context.Background(),
+		args:   []string{},
+		stdout: &bytes.Buffer{},
+		stderr: &bytes.Buffer{},
+		readFile: func(path string) ([]byte, error) {
+			return []byte("default content"), nil
+		},
+		fileExists: func(path string) bool {
+			return false
+		},
+		writeFile: func(path, content string) error {
+			return nil
+		},
+		mkdirAll: func(path string) error {
+			return nil
+		},
+		walkDir: func(root string, fn fs.WalkDirFunc) error {
+			return fs.WalkDir(fstest.MapFS{}, root, fn)
+		},
+		getEnvVariables: func() (map[string]string, []string) {
+			return map[string]string{}, nil
+		},
+		now: func() time.Time {
+			return time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+		},
+		callAI: func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+			return &ai.Response{
+				Text:        "default response",
+				InputTokens: 10,
+				OutputTokens: 20,
+			}, nil
+		},
+	}
+}
+
+func TestRun_InlineFiles(t *testing.T) {
+	written := make(map[string]string)
+
+	opts := createTestOptions()
+	opts.args = []string{"--count", "2", "--no-summary", "-o", "out.txt", "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Draw a chart"), nil
+	}
+	opts.writeFile = func(path, content string) error {
+		written[path] = content
+		return nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return &ai.Response{
+			Text:  "Chart attached",
+			Files: []ai.File{{MimeType: "image/png", Data: []byte("png")}},
+		}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range []string{"out.txt", "out-1.png", "out-2.png"} {
+		if _, ok := written[path]; !ok {
+			t.Errorf("expected %s to be written, got %v", path, written)
+		}
+	}
+	if written["out-1.png"] != "png" {
+		t.Errorf("out-1.png = %q, want %q", written["out-1.png"], "png")
+	}
+
+	stderr := &bytes.Buffer{}
+	opts.args = []string{"--no-summary", "template.md"}
+	opts.stderr = stderr
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "response contains 1 inline file(s); use -o to save them") {
+		t.Errorf("expected inline file warning, got: %s", stderr.String())
+	}
+}
+
+func TestRun_Locale(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		template string
+		want     string
+	}{
+		{
+			name:     "variable and default hint",
+			args:     []string{"--locale", "de"},
+			template: "Summarize for {{locale}} readers",
+			want:     "Summarize for de readers\n\nRespond in the language of the de locale.",
+		},
+		{
+			name:     "configured hint",
+			args:     []string{"--locale", "fr"},
+			template: "---\nlocaleHint: \"Answer in {{locale}} only.\"\n---\nSummarize",
+			want:     "Summarize\n\nAnswer in fr only.",
+		},
+		{
+			name:     "hint disabled",
+			args:     []string{"--locale", "es", "--no-locale-hint"},
+			template: "Summarize in {{locale}}",
+			want:     "Summarize in es",
+		},
+		{
+			name:     "--var overrides locale variable",
+			args:     []string{"--locale", "es", "--no-locale-hint", "--var", "locale=pt"},
+			template: "Summarize in {{locale}}",
+			want:     "Summarize in pt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), "template.md")
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.template), nil
+			}
+			var prompt string
+			opts.callAI = func(ctx context.Context, cfg config.Config, p string) (*ai.Response, error) {
+				prompt = p
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if prompt != tt.want {
+				t.Errorf("prompt = %q, want %q", prompt, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_ExpectMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		wantCode int
+	}{
+		{name: "matching response", response: "Verdict: PASS", wantCode: ExitSuccess},
+		{name: "non-matching response", response: "Verdict: unsure", wantCode: ExitNoMatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+
+			opts := createTestOptions()
+			opts.args = []string{"--no-summary", "--expect-match", `^Verdict: (PASS|FAIL)$`, "template.md"}
+			opts.stdout = stdout
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte("Review the change"), nil
+			}
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				return &ai.Response{Text: tt.response}, nil
+			}
+
+			err := run(opts)
+			code := ExitSuccess
+			var exitErr *exitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.code
+				if !strings.Contains(err.Error(), "does not match --expect-match") {
+					t.Errorf("unexpected error message: %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if !strings.Contains(stdout.String(), tt.response) {
+				t.Errorf("expected the response to be written, got: %q", stdout.String())
+			}
+		})
+	}
+}
+
+func TestRun_Split(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	splitDir := filepath.Join(tempDir, "docs")
+
+	stdout := &bytes.Buffer{}
+	written := make(map[string]string)
+
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "--split-on", "===", "--split-dir", splitDir, "guides.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Write three guides"), nil
+	}
+	opts.writeFile = func(path, content string) error {
+		written[path] = content
+		return nil
+	}
+	var made []string
+	opts.mkdirAll = func(path string) error {
+		made = append(made, path)
+		return nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return &ai.Response{Text: "Install\n===\nConfigure\n===\nDeploy\n"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(made) != 1 || made[0] != splitDir {
+		t.Errorf("created directories %v, want [%s]", made, splitDir)
+	}
+	want := map[string]string{
+		filepath.Join(splitDir, "guides-1.txt"): "Install\n",
+		filepath.Join(splitDir, "guides-2.txt"): "Configure\n",
+		filepath.Join(splitDir, "guides-3.txt"): "Deploy\n",
+	}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("written files = %v, want %v", written, want)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected no stdout output, got: %q", stdout.String())
+	}
+
+	for _, args := range [][]string{
+		{"--split-on", "==="},
+		{"--split-on", "===", "--split-dir", "../docs"},
+		{"--split-on", "===", "--split-dir", splitDir, "-o", "out.txt"},
+	} {
+		opts.args = append(args, "guides.md")
+		var exitErr *exitError
+		if err := run(opts); !errors.As(err, &exitErr) || exitErr.code != ExitInvalidArgs {
+			t.Errorf("run(%v) = %v, want invalid args error", args, err)
+		}
+	}
+}
+
+func TestRun_MaxPromptTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		template string
+		wantCode int
+	}{
+		{name: "within the flag cap", args: []string{"--max-prompt-tokens", "100"}, template: "Short prompt", wantCode: ExitSuccess},
+		{name: "over the flag cap", args: []string{"--max-prompt-tokens", "40"}, template: "Short prompt", wantCode: ExitTemplateError},
+		{name: "over the config cap", template: "---\nmaxPromptTokens: 40\n---\nShort prompt", wantCode: ExitTemplateError},
+		{name: "flag overrides config", args: []string{"--max-prompt-tokens", "100"}, template: "---\nmaxPromptTokens: 40\n---\nShort prompt", wantCode: ExitSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), "template.md")
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.template), nil
+			}
+			opts.countTokens = func(ctx context.Context, cfg config.Config, prompt string) (int32, error) {
+				return 50, nil
+			}
+			called := false
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				called = true
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			code := ExitSuccess
+			var exitErr *exitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.code
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("exit code = %d, want %d (err: %v)", code, tt.wantCode, err)
+			}
+			if code != ExitSuccess {
+				if !strings.Contains(err.Error(), "50 tokens (maxPromptTokens 40)") {
+					t.Errorf("unexpected error message: %v", err)
+				}
+				if called {
+					t.Error("expected the AI not to be called when the prompt exceeds the cap")
+				}
+			}
+		})
+	}
+}
+
+func TestRun_MaxPromptTokensCheck(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--check", "template.md"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nmaxPromptTokens: 40\n---\nShort prompt"), nil
+	}
+	opts.countTokens = func(ctx context.Context, cfg config.Config, prompt string) (int32, error) {
+		t.Error("tokens should not be counted with --check")
+		return 0, errors.New("offline")
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "template.md: OK") {
+		t.Errorf("expected OK line, got: %s", stdout.String())
+	}
+}
+
+func TestRun_RetryEmpty(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--retry-empty", "--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.stderr = stderr
+	calls := 0
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		calls++
+		if calls == 1 {
+			return nil, &ai.EmptyResponseError{Reason: "empty response content"}
+		}
+		return &ai.Response{Text: "Second try"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+	if !strings.Contains(stdout.String(), "Second try") {
+		t.Errorf("expected the retried response, got: %s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "empty response content, retrying once") {
+		t.Errorf("expected a retry warning, got: %s", stderr.String())
+	}
+}
+
+func TestRun_DateVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		template string
+		want     string
+	}{
+		{"built-in variables", nil, "Today is {{today}} ({{now}}, {{timestamp}})", "Today is 2024-06-01 (2024-06-01T12:30:00Z, 1717245000)"},
+		{"configured date format", nil, "---\ndateFormat: 2 January 2006\n---\nToday is {{today}}", "Today is 1 June 2024"},
+		{"user variable overrides", []string{"--var", "today=yesterday"}, "Today is {{today}}", "Today is yesterday"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), "template.md")
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.template), nil
+			}
+			var prompt string
+			opts.callAI = func(ctx context.Context, cfg config.Config, p string) (*ai.Response, error) {
+				prompt = p
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if prompt != tt.want {
+				t.Errorf("prompt = %q, want %q", prompt, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_SaveConversation(t *testing.T) {
+	files := map[string]string{
+		"first.md":  "Name a colour",
+		"second.md": "---\nhistory: conversation.yaml\n---\nAnd another?",
+	}
+
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "--save-conversation", "conversation.yaml", "first.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		content, ok := files[filepath.Base(path)]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return []byte(content), nil
+	}
+	opts.writeFile = func(path, content string) error {
+		files[path] = content
+		return nil
+	}
+	var history []ai.Turn
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		history = ai.HistoryFromContext(ctx)
+		return &ai.Response{Text: "Blue"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := files["conversation.yaml"]; !ok {
+		t.Fatal("expected the conversation to be saved")
+	}
+
+	// The saved conversation is the history of the next run, which extends it
+	opts.args = []string{"--no-summary", "--save-conversation", "conversation.yaml", "second.md"}
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ai.Turn{{Role: "user", Text: "Name a colour"}, {Role: "model", Text: "Blue"}}
+	if !reflect.DeepEqual(history, want) {
+		t.Errorf("history = %+v, want %+v", history, want)
+	}
+	conv, err := ai.ParseConversation([]byte(files["conversation.yaml"]))
+	if err != nil {
+		t.Fatalf("parsing saved conversation: %v", err)
+	}
+	if len(conv.Turns) != 4 || conv.Turns[2].Text != "And another?" {
+		t.Errorf("saved conversation = %+v, want 4 turns ending with the second exchange", conv.Turns)
+	}
+
+	opts.args = []string{"--count", "2", "--save-conversation", "conversation.yaml", "first.md"}
+	var exitErr *exitError
+	if err := run(opts); !errors.As(err, &exitErr) || exitErr.code != ExitInvalidArgs {
+		t.Errorf("expected invalid args error with --count, got %v", err)
+	}
+}
+
+func TestRun_StrictVars(t *testing.T) {
+	stderr := &bytes.Buffer{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--strict-vars", "--no-summary", "--var", "tone=casual", "template.md"}
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nvariables:\n  tone: formal\n  region: eu\n---\n{{tone}} {{region}}"), nil
+	}
+	opts.getEnvVariables = func() (map[string]string, []string) {
+		return map[string]string{"region": "eu"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `variable "tone" is defined with different values: frontmatter="formal", --var="casual"`
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("expected conflict warning %q, got: %s", want, stderr.String())
+	}
+	if strings.Contains(stderr.String(), `"region"`) {
+		t.Errorf("expected no warning for a variable defined with the same value, got: %s", stderr.String())
+	}
+
+	stderr.Reset()
+	opts.args = []string{"--no-summary", "--var", "tone=casual", "template.md"}
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(stderr.String(), "different values") {
+		t.Errorf("expected no conflict warnings without --strict-vars, got: %s", stderr.String())
+	}
+}
+
+func TestRun_OnErrorOutput(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	written := make(map[string]string)
+
+	opts := createTestOptions()
+	opts.args = []string{"--on-error-output", "partial.txt", "template.md"}
+	opts.stderr = stderr
+	opts.writeFile = func(path, content string) error {
+		written[path] = content
+		return nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return nil, &ai.StreamError{Partial: "Chapter 1\nIt was", Err: status.Error(codes.Internal, "stream reset")}
+	}
+
+	err := run(opts)
+	var exitErr *exitError
+	if !errors.As(err, &exitErr) || exitErr.code != ExitAIError {
+		t.Fatalf("expected AI error, got %v", err)
+	}
+	if got := written["partial.txt"]; got != "Chapter 1\nIt was" {
+		t.Errorf("partial.txt = %q, want the partial output", got)
+	}
+	if !strings.Contains(stderr.String(), "wrote 16 bytes of partial output to partial.txt") {
+		t.Errorf("expected a partial output warning, got: %s", stderr.String())
+	}
+
+	// Without the flag nothing is written
+	written = make(map[string]string)
+	opts.args = []string{"template.md"}
+	run(opts)
+	if len(written) != 0 {
+		t.Errorf("expected no files without --on-error-output, got %v", written)
+	}
+}
+
+// recordingAuditLogger keeps every audit record in memory.
+type recordingAuditLogger struct {
+	records []ai.AuditRecord
+}
+
+func (l *recordingAuditLogger) Log(record ai.AuditRecord) error {
+	l.records = append(l.records, record)
+	return nil
+}
+
+func TestRun_AuditLog(t *testing.T) {
+	logger := &recordingAuditLogger{}
+
+	opts := createTestOptions()
+	opts.args = []string{"--count", "2", "--no-summary", "template.md"}
+	opts.auditLogger = logger
+	opts.getEnvVariables = func() (map[string]string, []string) {
+		return map[string]string{"GOOGLE_CLOUD_PROJECT": "audited-project"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(logger.records) != 2 {
+		t.Fatalf("expected one audit record per request, got %d", len(logger.records))
+	}
+	if logger.records[0].InputTokens != 10 || logger.records[0].PromptSHA256 == "" {
+		t.Errorf("unexpected audit record: %+v", logger.records[0])
+	}
+	if logger.records[0].Project != "audited-project" {
+		t.Errorf("audit record project = %q, want the project from the environment", logger.records[0].Project)
+	}
+
+	// --audit-log appends JSON lines to a file instead
+	logs := map[string]*bytes.Buffer{}
+	opts.openAppend = func(path string) (io.WriteCloser, error) {
+		if logs[path] == nil {
+			logs[path] = &bytes.Buffer{}
+		}
+		return nopWriteCloser{logs[path]}, nil
+	}
+	for i := 0; i < 2; i++ {
+		opts.args = []string{"--audit-log", "audit.jsonl", "--no-summary", "template.md"}
+		if err := run(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := strings.Count(logs["audit.jsonl"].String(), "\n"); got != 2 {
+		t.Errorf("expected 2 audit records in audit.jsonl, got %d:\n%s", got, logs["audit.jsonl"])
+	}
+	if len(logger.records) != 2 {
+		t.Errorf("expected --audit-log to replace the default logger, got %d records", len(logger.records))
+	}
+
+	opts.args = []string{"--audit-log", "../audit.jsonl", "template.md"}
+	var exitErr *exitError
+	if err := run(opts); !errors.As(err, &exitErr) || exitErr.code != ExitFileError {
+		t.Errorf("expected a file error for a path outside the directory, got %v", err)
+	}
+}
+
+// nopWriteCloser adds a Close that does nothing to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestRun_SampleConfig(t *testing.T) {
+	opts := createTestOptions()
+	opts.args = []string{"--sample-config"}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		t.Fatal("--sample-config must not call the AI")
+		return nil, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	output := opts.stdout.(*bytes.Buffer).String()
+	for _, key := range []string{"temperature:", "model:"} {
+		if !strings.Contains(output, key) {
+			t.Errorf("expected %q in sample config, got:\n%s", key, output)
+		}
+	}
+}
+
+func TestRun_OutputFormatEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		env       map[string]string
+		wantJSONL bool
+		wantCode  int
+	}{
+		{"default is text", []string{"template.md"}, nil, false, ExitSuccess},
+		{"env selects jsonl", []string{"template.md"}, map[string]string{"AIR_OUTPUT_FORMAT": "jsonl"}, true, ExitSuccess},
+		{"flag overrides env", []string{"--output-format", "text", "template.md"}, map[string]string{"AIR_OUTPUT_FORMAT": "jsonl"}, false, ExitSuccess},
+		{"--jsonl overrides env", []string{"--jsonl", "template.md"}, map[string]string{"AIR_OUTPUT_FORMAT": "text"}, true, ExitSuccess},
+		{"invalid env value", []string{"template.md"}, map[string]string{"AIR_OUTPUT_FORMAT": "xml"}, false, ExitInvalidArgs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = append([]string{"--no-summary"}, tt.args...)
+			opts.stdout = stdout
+			opts.getEnvVariables = func() (map[string]string, []string) {
+				return tt.env, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				exitErr, ok := err.(*exitError)
+				if !ok || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var record jsonlRecord
+			gotJSONL := json.Unmarshal(stdout.Bytes(), &record) == nil
+			if gotJSONL != tt.wantJSONL {
+				t.Errorf("JSONL output = %v, want %v (output %q)", gotJSONL, tt.wantJSONL, stdout.String())
+			}
+		})
+	}
+}
+
+func TestRun_RetryDeadline(t *testing.T) {
+	for _, retry := range []bool{false, true} {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+
+		opts := createTestOptions()
+		opts.args = []string{"--no-summary", "template.md"}
+		if retry {
+			opts.args = append([]string{"--retry-deadline"}, opts.args...)
+		}
+		opts.stdout = stdout
+		opts.stderr = stderr
+		calls := 0
+		opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+			calls++
+			if calls == 1 {
+				return nil, &ai.StreamError{Partial: "Once upon", Err: context.DeadlineExceeded}
+			}
+			return &ai.Response{Text: "Once upon a time"}, nil
+		}
+
+		err := run(opts)
+		if !retry {
+			if err == nil || calls != 1 {
+				t.Errorf("without --retry-deadline: expected one failed call, got %d calls and error %v", calls, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if calls != 2 || !strings.Contains(stdout.String(), "Once upon a time") {
+			t.Errorf("expected the reconnected response after 2 calls, got %d calls: %s", calls, stdout.String())
+		}
+		if !strings.Contains(stderr.String(), "response stream timed out after 9 characters, reconnecting") {
+			t.Errorf("expected a reconnect warning, got: %s", stderr.String())
+		}
+	}
+}
+
+func TestRun_IncludeKeyword(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_keyword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := os.WriteFile(filepath.Join(tempDir, "part.md"), []byte("Part"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		content    string
+		wantPrompt string
+		wantCode   int
+	}{
+		{"default keyword", nil, `{{include "part.md"}} and {{import "part.md"}}`, `Part and {{import "part.md"}}`, ExitSuccess},
+		{"keyword from flag", []string{"--include-keyword", "import"}, `{{include "part.md"}} and {{import "part.md"}}`, `{{include "part.md"}} and Part`, ExitSuccess},
+		{"keyword from frontmatter", nil, "---\nincludeKeyword: import\n---\n{{import \"part.md\"}}", "Part", ExitSuccess},
+		{"flag overrides frontmatter", []string{"--include-keyword", "use"}, "---\nincludeKeyword: import\n---\n{{use \"part.md\"}}", "Part", ExitSuccess},
+		{"custom keyword rejected", []string{"--include-keyword", "import", "--reject-includes"}, `{{import "part.md"}}`, "", ExitTemplateError},
+		{"invalid keyword", []string{"--include-keyword", "{{"}, "Prompt", "", ExitConfigError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPrompt string
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), filepath.Join(tempDir, "template.md"))
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.content), nil
+			}
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				gotPrompt = prompt
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				exitErr, ok := err.(*exitError)
+				if !ok || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotPrompt != tt.wantPrompt {
+				t.Errorf("expected prompt %q, got %q", tt.wantPrompt, gotPrompt)
+			}
+		})
+	}
+}
+
+func TestRun_RequestID(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantID  string
+		summary bool
+	}{
+		{"generated", nil, "", false},
+		{"generated in verbose summary", []string{"--verbose"}, "", true},
+		{"overridden", []string{"--request-id", "ci-build-42"}, "ci-build-42", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			logger := &recordingAuditLogger{}
+			opts := createTestOptions()
+			opts.args = append(tt.args, "template.md")
+			opts.stderr = stderr
+			opts.auditLogger = logger
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(logger.records) != 1 {
+				t.Fatalf("expected 1 audit record, got %d", len(logger.records))
+			}
+			id := logger.records[0].RequestID
+			if tt.wantID != "" && id != tt.wantID {
+				t.Errorf("expected request ID %q, got %q", tt.wantID, id)
+			}
+			if tt.wantID == "" {
+				if _, err := uuid.Parse(id); err != nil {
+					t.Errorf("expected a generated UUID, got %q", id)
+				}
+			}
+			if got := strings.Contains(stderr.String(), "Request ID: "+id+"\n"); got != tt.summary {
+				t.Errorf("request ID in summary = %v, want %v; stderr:\n%s", got, tt.summary, stderr.String())
+			}
+		})
+	}
+
+	if _, _, err := template.ParseCLIFlags([]string{"--request-id", "has space", "template.md"}); err == nil {
+		t.Error("expected an error for a request ID with whitespace")
+	}
+}
+
+func TestRun_Extract(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		wantOut  string
+		wantCode int
+	}{
+		{"nested field", "result.items.0.name", "first\n", ExitSuccess},
+		{"missing path", "result.total", "", ExitNoMatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = []string{"--extract", tt.path, "--no-summary", "template.md"}
+			opts.stdout = stdout
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				return &ai.Response{Text: `{"result": {"items": [{"name": "first"}]}}`}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				exitErr, ok := err.(*exitError)
+				if !ok || exitErr.code != tt.wantCode || !strings.Contains(err.Error(), `no field "total"`) {
+					t.Fatalf("expected exit code %d naming the missing field, got: %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stdout.String() != tt.wantOut {
+				t.Errorf("expected output %q, got %q", tt.wantOut, stdout.String())
+			}
+		})
+	}
+}
+
+func TestRun_KeepGoing(t *testing.T) {
+	templates := map[string]string{
+		"a.md": "First prompt",
+		"b.md": "---\ntemperature: hot\n---\nBroken config",
+		"c.md": "fail",
+		"d.md": "Last prompt",
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCalled []string
+		wantCode   int
+		wantStderr []string
+	}{
+		{"all succeed", []string{"a.md", "d.md"}, []string{"First prompt", "Last prompt"}, ExitSuccess, []string{"OK: a.md\nOK: d.md\nSucceeded: 2, failed: 0"}},
+		{"first error aborts", []string{"a.md", "b.md", "d.md"}, []string{"First prompt"}, ExitConfigError, nil},
+		{"keep going past failures", []string{"--keep-going", "a.md", "b.md", "c.md", "d.md"}, []string{"First prompt", "fail", "Last prompt"}, ExitConfigError,
+			[]string{"Error: b.md: parsing template", "Error: c.md: calling AI: quota exceeded", "OK: a.md\nOK: d.md\nFAILED: b.md\nFAILED: c.md\nSucceeded: 2, failed: 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.stderr = stderr
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(templates[path]), nil
+			}
+			var called []string
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				called = append(called, prompt)
+				if prompt == "fail" {
+					return nil, errors.New("quota exceeded")
+				}
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				exitErr, ok := err.(*exitError)
+				if !ok || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+				}
+			}
+			if !reflect.DeepEqual(called, tt.wantCalled) {
+				t.Errorf("expected calls %q, got %q", tt.wantCalled, called)
+			}
+			for _, want := range tt.wantStderr {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("expected stderr to contain %q, got:\n%s", want, stderr.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRun_SafetyFile(t *testing.T) {
+	files := map[string]string{
+		"policy.yaml": "hate_speech: BLOCK_LOW_AND_ABOVE\nharassment: BLOCK_MEDIUM_AND_ABOVE\n",
+		"bad.yaml":    "hate_speech: BLOCK_SOMETIMES\n",
+		"template.md": "---\nsafetySettings:\n  harassment: BLOCK_ONLY_HIGH\n---\nPrompt",
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		want     map[string]string
+		wantCode int
+	}{
+		{"inline only", nil, map[string]string{"harassment": "BLOCK_ONLY_HIGH"}, ExitSuccess},
+		{"policy merged under inline", []string{"--safety-file", "policy.yaml"}, map[string]string{"hate_speech": "BLOCK_LOW_AND_ABOVE", "harassment": "BLOCK_ONLY_HIGH"}, ExitSuccess},
+		{"invalid policy", []string{"--safety-file", "bad.yaml"}, nil, ExitConfigError},
+		{"missing policy", []string{"--safety-file", "missing.yaml"}, nil, ExitFileError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), "template.md")
+			opts.readFile = func(path string) ([]byte, error) {
+				content, ok := files[path]
+				if !ok {
+					return nil, os.ErrNotExist
+				}
+				return []byte(content), nil
+			}
+			var got map[string]string
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				got = cfg.SafetySettings
+				return &ai.Response{Text: "Response"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				exitErr, ok := err.(*exitError)
+				if !ok || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected safety settings %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRun_CheckDir(t *testing.T) {
+	files := fstest.MapFS{
+		"prompts/valid.md":       {Data: []byte("---\ntemperature: 0.2\n---\nHello {{name|World}}")},
+		"prompts/sub/invalid.md": {Data: []byte("---\ntemperature: hot\n---\nBroken")},
+		"prompts/notes.txt":      {Data: []byte("---\ntemperature: hot\n---\nNot a template")},
+		"prompts/.drafts/wip.md": {Data: []byte("---\ntemperature: hot\n---\nHidden")},
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--check-dir", "prompts"}
+	opts.stdout = stdout
+	opts.stderr = stderr
+	opts.walkDir = func(root string, fn fs.WalkDirFunc) error {
+		return fs.WalkDir(files, root, fn)
+	}
+	opts.readFile = func(path string) ([]byte, error) {
+		return files.ReadFile(filepath.ToSlash(path))
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		t.Fatal("--check-dir must not call the AI")
+		return nil, nil
+	}
+
+	err := run(opts)
+	exitErr, ok := err.(*exitError)
+	if !ok || exitErr.code != ExitConfigError {
+		t.Fatalf("expected exit code %d, got: %v", ExitConfigError, err)
+	}
+	invalid := "prompts/sub/invalid.md"
+	if !strings.Contains(err.Error(), "1 of 2 templates failed: "+invalid) {
+		t.Errorf("expected the error to name %s only, got: %v", invalid, err)
+	}
+	if want := "prompts/valid.md: OK\n"; stdout.String() != want {
+		t.Errorf("expected stdout %q, got %q", want, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Error: "+invalid+": parsing template") {
+		t.Errorf("expected the failure to be reported with its path, got:\n%s", stderr.String())
+	}
+
+	opts.args = []string{"--check-dir", "missing"}
+	if err := run(opts); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestRun_CountTokens(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--show-prompt-only", "--count-tokens", "template.md"}
+	opts.stdout = stdout
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Summarize the attached report in three sentences."), nil // 50 characters
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		t.Fatal("--show-prompt-only must not call the AI")
+		return nil, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stdout.String() != "Summarize the attached report in three sentences.\n" {
+		t.Errorf("expected only the prompt on stdout, got %q", stdout.String())
+	}
+	if want := "Estimated prompt tokens: ~13 (local estimate, not counted by the model)\n"; stderr.String() != want {
+		t.Errorf("expected stderr %q, got %q", want, stderr.String())
+	}
+
+	// With a model call, the summary compares the estimate with the usage
+	stderr.Reset()
+	opts.args = []string{"--count-tokens", "template.md"}
+	opts.callAI = createTestOptions().callAI
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "Input tokens: 10 (estimated 13, -3)") {
+		t.Errorf("expected the estimate in the summary, got:\n%s", stderr.String())
+	}
+}
+
+func TestRun_Manifest(t *testing.T) {
+	files := map[string]string{
+		"batch/manifest.yaml": `
+- template: topic.md
+  vars: {topic: Go}
+  output: out/go.txt
+- template: topic.md
+  vars: {topic: Rust}
+  output: out/rust.txt
+`,
+		"batch/topic.md": "Write about {{topic}} in a {{tone}} tone",
+	}
+
+	stdout := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--manifest", "batch/manifest.yaml", "--var", "tone=formal", "--var", "topic=ignored"}
+	opts.stdout = stdout
+	opts.readFile = func(path string) ([]byte, error) {
+		content, ok := files[path]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return []byte(content), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		return &ai.Response{Text: "Response to: " + prompt}, nil
+	}
+	written := map[string]string{}
+	opts.writeFile = func(path, content string) error {
+		written[path] = content
+		return nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{
+		"batch/out/go.txt":   "Response to: Write about Go in a formal tone\n",
+		"batch/out/rust.txt": "Response to: Write about Rust in a formal tone\n",
+	}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("expected outputs %q, got %q", want, written)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected nothing on stdout, got %q", stdout.String())
+	}
+
+	opts.args = []string{"--manifest", "batch/missing.yaml"}
+	if err := run(opts); err == nil {
+		t.Error("expected an error for a missing manifest")
+	} else if exitErr, ok := err.(*exitError); !ok || exitErr.code != ExitFileError {
+		t.Errorf("expected exit code %d, got: %v", ExitFileError, err)
+	}
+}
+
+func TestRun_Interactive(t *testing.T) {
+	templates := map[string]string{
+		"greet.md": "Say hello to {{name}}",
+		"bye.md":   "Say goodbye to {{name}}",
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--interactive", "--no-summary", "--var", "name=Alice", "greet.md"}
+	opts.stdin = strings.NewReader(strings.Join([]string{
+		"run",
+		"set name=Bob",
+		"vars",
+		"run",
+		"bogus",
+		"set broken",
+		"reload bye.md",
+		"run",
+		"unset name",
+		"run",
+		"quit",
+		"run",
+	}, "\n"))
+	opts.stdout = stdout
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		content, ok := templates[path]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return []byte(content), nil
+	}
+	var called []string
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		called = append(called, prompt)
+		return &ai.Response{Text: fmt.Sprintf("Response %d", len(called))}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantCalled := []string{"Say hello to Alice", "Say hello to Bob", "Say goodbye to Bob"}
+	if !reflect.DeepEqual(called, wantCalled) {
+		t.Errorf("expected calls %q, got %q", wantCalled, called)
+	}
+	wantStdout := "Response 1\nname=Bob\nResponse 2\nbye.md: OK\nResponse 3\n"
+	if stdout.String() != wantStdout {
+		t.Errorf("expected stdout %q, got %q", wantStdout, stdout.String())
+	}
+	for _, want := range []string{
+		`Error: unknown command "bogus"`,
+		"Error: usage: set name=value",
+		"Error: replacing placeholders: undefined variables without defaults: [name]",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("expected stderr to contain %q, got:\n%s", want, stderr.String())
+		}
+	}
+
+	opts.args = []string{"--interactive", "greet.md", "bye.md"}
+	if err := run(opts); err == nil {
+		t.Error("expected an error for two templates")
+	}
+}
+
+func TestRun_SafetyWarn(t *testing.T) {
+	tests := []struct {
+		name       string
+		level      string
+		wantCode   int
+		wantStderr string
+	}{
+		{"below level", "HIGH", ExitSuccess, ""},
+		{"at level", "medium", ExitSuccess, "Warning: candidate 0 rated MEDIUM probability of harassment (at or above MEDIUM)"},
+		{"unknown level", "SEVERE", ExitInvalidArgs, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = []string{"--safety-warn", tt.level, "--no-summary", "template.md"}
+			opts.stderr = stderr
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				return &ai.Response{
+					Text: "Response",
+					SafetyRatings: [][]ai.SafetyRating{{
+						{Category: aiplatformpb.HarmCategory_HARM_CATEGORY_HARASSMENT, Probability: aiplatformpb.SafetyRating_MEDIUM},
+					}},
+				}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode == ExitSuccess {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if exitErr, ok := err.(*exitError); !ok || exitErr.code != tt.wantCode {
+				t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+			}
+			if tt.wantStderr == "" && strings.Contains(stderr.String(), "Warning:") {
+				t.Errorf("expected no warning, got:\n%s", stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("expected stderr to contain %q, got:\n%s", tt.wantStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRun_Continue(t *testing.T) {
+	segments := []*ai.Response{
+		{Text: "Chapter one. ", InputTokens: 10, OutputTokens: 20, TotalTokens: 30, FinishReason: aiplatformpb.Candidate_MAX_TOKENS},
+		{Text: "Chapter two.", InputTokens: 30, OutputTokens: 15, TotalTokens: 45, FinishReason: aiplatformpb.Candidate_STOP},
+	}
+
+	tests := []struct {
+		name      string
+		args      []string
+		wantCalls int
+		wantOut   string
+	}{
+		{"without --continue", []string{"template.md"}, 1, "Chapter one. \n"},
+		{"--continue", []string{"--continue", "template.md"}, 2, "Chapter one. Chapter two.\n"},
+		{"--max-continuations", []string{"--max-continuations", "1", "template.md"}, 2, "Chapter one. Chapter two.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = tt.args
+			opts.stdout = stdout
+			opts.stderr = stderr
+			calls := 0
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				calls++
+				return segments[calls-1], nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, calls)
+			}
+			if stdout.String() != tt.wantOut {
+				t.Errorf("expected output %q, got %q", tt.wantOut, stdout.String())
+			}
+			if tt.wantCalls == 2 && !strings.Contains(stderr.String(), "Output tokens: 35") {
+				t.Errorf("expected summed output tokens in the summary, got:\n%s", stderr.String())
+			}
+		})
+	}
+
+	opts := createTestOptions()
+	opts.args = []string{"--max-continuations", "0", "template.md"}
+	if err := run(opts); err == nil {
+		t.Error("expected an error for --max-continuations 0")
+	}
+}
+
+func TestRun_Separator(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"between runs", []string{"--count", "2", "--separator", "=====", "a.md"}, "Response to A 1\n=====\nResponse to A 2\n"},
+		{"empty concatenates", []string{"--count", "2", "--separator", "", "a.md"}, "Response to A 1Response to A 2\n"},
+		{"between templates", []string{"--separator", "-----", "a.md", "b.md"}, "Response to A 1\n-----\nResponse to B 2\n"},
+		{"without trailing newline", []string{"--separator", "-----", "--no-trailing-newline", "a.md", "b.md"}, "Response to A 1\n-----\nResponse to B 2"},
+		{"default numbers the runs", []string{"--count", "2", "a.md"}, "--- Output 1 of 2 ---\nResponse to A 1\n\n--- Output 2 of 2 ---\nResponse to A 2\n"},
+		{"default between templates", []string{"a.md", "b.md"}, "Response to A 1\n" + defaultSeparator + "\nResponse to B 2\n"},
+		{"empty concatenates templates", []string{"--separator", "", "a.md", "b.md"}, "Response to A 1\nResponse to B 2\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = append([]string{"--no-summary"}, tt.args...)
+			opts.stdout = stdout
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(strings.ToUpper(strings.TrimSuffix(path, ".md"))), nil
+			}
+			calls := 0
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				calls++
+				return &ai.Response{Text: fmt.Sprintf("Response to %s %d", prompt, calls)}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stdout.String() != tt.want {
+				t.Errorf("expected output %q, got %q", tt.want, stdout.String())
+			}
+		})
+	}
+}
+
+func TestRun_SeparatorJSONLinesFromEnv(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "a.md", "b.md"}
+	opts.stdout = stdout
+	opts.getEnvVariables = func() (map[string]string, []string) {
+		return map[string]string{"AIR_OUTPUT_FORMAT": "jsonl"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSONL records, got %d: %q", len(lines), stdout.String())
+	}
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("expected a JSON record, got %q", line)
+		}
+	}
+}
+
+func TestRun_EmptySchema(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", "template.md"}
+	opts.stdout = stdout
+	opts.stderr = stderr
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nresponseSchema: {}\n---\nList three colors"), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		if cfg.ResponseSchema != nil {
+			t.Errorf("expected no schema to be sent, got %v", cfg.ResponseSchema)
+		}
+		return &ai.Response{Text: `{"colors": ["red"]}`}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Without a schema the response is not reformatted
+	if want := "{\"colors\": [\"red\"]}\n"; stdout.String() != want {
+		t.Errorf("expected output %q, got %q", want, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Warning: responseSchema is empty and was ignored") {
+		t.Errorf("expected a warning about the empty schema, got:\n%s", stderr.String())
+	}
+}
+
+func TestRun_JSONFormatting(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"defaults", nil, "{\n  \"a\": 2,\n  \"b\": 1\n}\n"},
+		{"indent", []string{"--json-indent", "4"}, "{\n    \"a\": 2,\n    \"b\": 1\n}\n"},
+		{"compact", []string{"--json-indent", "0"}, "{\"a\":2,\"b\":1}\n"},
+		{"no sort", []string{"--no-sort-keys"}, "{\n  \"b\": 1,\n  \"a\": 2\n}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), "template.md")
+			opts.stdout = stdout
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte("---\nresponseSchema:\n  type: object\n---\nPrompt"), nil
+			}
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				return &ai.Response{Text: `{"b": 1, "a": 2}`}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stdout.String() != tt.want {
+				t.Errorf("expected output %q, got %q", tt.want, stdout.String())
+			}
+		})
+	}
+
+	opts := createTestOptions()
+	opts.args = []string{"--json-indent", "-1", "template.md"}
+	if err := run(opts); err == nil || !strings.Contains(err.Error(), "invalid --json-indent value") {
+		t.Errorf("expected an invalid --json-indent error, got %v", err)
+	}
+}
+
+func TestRun_VarsStdin(t *testing.T) {
+	var gotPrompt string
+	opts := createTestOptions()
+	opts.args = []string{"--vars-stdin", "--var", "tone=formal", "--no-summary", "template.md"}
+	opts.stdin = strings.NewReader("name=Alice\ntone=casual\n")
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("Write to {{name}} in a {{tone}} tone"), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		gotPrompt = prompt
+		return &ai.Response{Text: "ok"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Write to Alice in a formal tone"; gotPrompt != want {
+		t.Errorf("expected prompt %q, got %q", want, gotPrompt)
+	}
+
+	opts = createTestOptions()
+	opts.args = []string{"--vars-stdin", "template.md"}
+	opts.stdin = strings.NewReader("not a variable\n")
+	err := run(opts)
+	if err == nil || !strings.Contains(err.Error(), "parsing variables from stdin: line 1") {
+		t.Errorf("expected a stdin parse error, got %v", err)
+	}
+
+	opts = createTestOptions()
+	opts.args = []string{"--vars-stdin", "--interactive", "template.md"}
+	opts.stdin = strings.NewReader("")
+	err = run(opts)
+	if err == nil || !strings.Contains(err.Error(), "--vars-stdin cannot be used with --interactive") {
+		t.Errorf("expected an --interactive conflict error, got %v", err)
+	}
+}
+
+func TestRun_Citations(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		citations []ai.Citation
+		want      string
+	}{
+		{"footnotes", []string{"--citations"}, []ai.Citation{
+			{Title: "Go spec", URI: "https://go.dev/ref/spec", License: "BSD-3-Clause"},
+			{URI: "https://example.com/post"},
+		}, "Answer\n\nSources:\n[1] Go spec <https://go.dev/ref/spec> (license: BSD-3-Clause)\n[2] <https://example.com/post>\n"},
+		{"no citations", []string{"--citations"}, nil, "Answer\n"},
+		{"without flag", nil, []ai.Citation{{URI: "https://example.com/post"}}, "Answer\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = append(append([]string{"--no-summary"}, tt.args...), "template.md")
+			opts.stdout = stdout
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				return &ai.Response{Text: "Answer", Citations: tt.citations}, nil
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if stdout.String() != tt.want {
+				t.Errorf("expected output %q, got %q", tt.want, stdout.String())
+			}
+		})
+	}
+}
+
+func TestRun_SystemInstruction(t *testing.T) {
+	var gotCfg config.Config
+	var gotPrompt string
+	opts := createTestOptions()
+	opts.args = []string{"--var", "role=reviewer", "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nsystemInstruction: You are a {{role}}.\n---\nReview this"), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		gotCfg, gotPrompt = cfg, prompt
+		return &ai.Response{Text: "ok"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "You are a reviewer."; gotCfg.SystemInstruction != want {
+		t.Errorf("expected system instruction %q, got %q", want, gotCfg.SystemInstruction)
+	}
+	if gotPrompt != "Review this" {
+		t.Errorf("expected prompt without the system instruction, got %q", gotPrompt)
+	}
+}
+
+func TestRun_Safety(t *testing.T) {
+	var gotCfg config.Config
+	opts := createTestOptions()
+	opts.args = []string{"--safety", "BLOCK_LOW_AND_ABOVE", "--no-summary", "template.md"}
+	opts.readFile = func(path string) ([]byte, error) {
+		return []byte("---\nsafetySettings:\n  harassment: BLOCK_NONE\n---\nPrompt"), nil
+	}
+	opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+		gotCfg = cfg
+		return &ai.Response{Text: "ok"}, nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	settings, err := config.BuildSafetySettings(gotCfg)
+	if err != nil {
+		t.Fatalf("BuildSafetySettings() error = %v", err)
+	}
+	if len(settings) != 4 {
+		t.Fatalf("expected all 4 categories, got %v", settings)
+	}
+	for _, setting := range settings {
+		if setting.Threshold != aiplatformpb.SafetySetting_BLOCK_LOW_AND_ABOVE {
+			t.Errorf("expected BLOCK_LOW_AND_ABOVE for %v, got %v", setting.Category, setting.Threshold)
+		}
+	}
+
+	opts = createTestOptions()
+	opts.args = []string{"--safety", "BLOCK_SOME", "template.md"}
+	err = run(opts)
+	if exitErr, ok := err.(*exitError); !ok || exitErr.code != ExitInvalidArgs || !strings.Contains(err.Error(), "unknown safety threshold: BLOCK_SOME") {
+		t.Errorf("expected an invalid --safety error, got %v", err)
+	}
+}
+
+func TestRun_NoDefaultSafety(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		template string
+		wantLen  int
+	}{
+		{"defaults", []string{"template.md"}, "Prompt", 4},
+		{"flag", []string{"--no-default-safety", "template.md"}, "Prompt", 0},
+		{"frontmatter", []string{"template.md"}, "---\nnoDefaultSafety: true\n---\nPrompt", 0},
+		{"explicit settings still apply", []string{"--no-default-safety", "template.md"}, "---\nsafetySettings:\n  harassment: BLOCK_ONLY_HIGH\n---\nPrompt", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := createTestOptions()
+			opts.args = append([]string{"--no-summary"}, tt.args...)
+			opts.readFile = func(path string) ([]byte, error) {
+				return []byte(tt.template), nil
+			}
+			var settings []*aiplatformpb.SafetySetting
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				var err error
+				settings, err = config.BuildSafetySettings(cfg)
+				return &ai.Response{Text: "Response"}, err
+			}
+
+			if err := run(opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(settings) != tt.wantLen {
+				t.Errorf("expected %d safety settings, got %v", tt.wantLen, settings)
+			}
+		})
+	}
+}
+
+func TestRun_MetricsFile(t *testing.T) {
+	written := map[string]string{}
+	opts := createTestOptions()
+	opts.args = []string{"--metrics-file", "metrics/air.prom", "--no-summary", "template.md"}
+	opts.writeFile = func(path, content string) error {
+		written[path] = content
+		return nil
+	}
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	metrics, ok := written["metrics/air.prom"]
+	if !ok {
+		t.Fatalf("expected the metrics file to be written, got %v", written)
+	}
+	label := fmt.Sprintf(`{model="%s"}`, config.DefaultModel)
+	for _, want := range []string{
+		"# TYPE air_input_tokens gauge\nair_input_tokens" + label + " 10\n",
+		"air_output_tokens" + label + " 20\n",
+		"air_duration_seconds" + label + " 0\n",
+		"air_last_run_timestamp_seconds" + label + " 1717245000\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestRun_IncludedFrontmatter(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_frontmatter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "part.md"), []byte("---\ntemperature: 0.2\n---\nBe brief."), 0644)
+	templateFile := filepath.Join(tempDir, "template.md")
+	os.WriteFile(templateFile, []byte(`Summarize the report. {{include "part.md"}}`), 0644)
+
+	stderr := &bytes.Buffer{}
+	opts := createTestOptions()
+	opts.args = []string{"--no-summary", templateFile}
+	opts.stderr = stderr
+	opts.readFile = os.ReadFile
+
+	if err := run(opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "part.md starts with frontmatter") {
+		t.Errorf("expected a warning about the included frontmatter, got:\n%s", stderr.String())
+	}
+
+	// --werror turns it into a failure
+	opts.args = []string{"--no-summary", "--werror", templateFile}
+	exitErr, ok := run(opts).(*exitError)
+	if !ok || exitErr.code != ExitWarnings {
+		t.Errorf("expected exit code %d with --werror, got: %v", ExitWarnings, exitErr)
+	}
+}
+
+func TestRun_InlinePrompt(t *testing.T) {
+	tempDir, err := os.MkdirTemp(".", "test_inline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	os.WriteFile(filepath.Join(tempDir, "style.md"), []byte("Answer in one line."), 0644)
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantPrompt string
+		wantModel  string
+		wantCode   int
+	}{
+		{"inline prompt", []string{"--prompt", "Say hi to {{name}}", "--var", "name=Bob"}, "Say hi to Bob", config.DefaultModel, ExitSuccess},
+		{"with --model", []string{"--prompt", "Say hi", "--model", "gemini-1.5-pro-002"}, "Say hi", "gemini-1.5-pro-002", ExitSuccess},
+		{"unknown --model", []string{"--prompt", "Say hi", "--model", "gpt-4"}, "", "", ExitConfigError},
+		{"unlisted --model", []string{"--prompt", "Say hi", "--model", "gemini-2.5-pro"}, "Say hi", "gemini-2.5-pro", ExitSuccess},
+		{"includes need --base-dir", []string{"--prompt", `Say hi. {{include "style.md"}}`}, "", "", ExitTemplateError},
+		{"includes from --base-dir", []string{"--prompt", `Say hi. {{include "style.md"}}`, "--base-dir", tempDir}, "Say hi. Answer in one line.", config.DefaultModel, ExitSuccess},
+		{"not with a template file", []string{"--prompt", "Say hi", "template.md"}, "", "", ExitInvalidArgs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			opts := createTestOptions()
+			opts.args = append([]string{"--no-summary"}, tt.args...)
+			opts.stdout = stdout
+			opts.readFile = os.ReadFile
+			var gotPrompt, gotModel string
+			opts.callAI = func(ctx context.Context, cfg config.Config, prompt string) (*ai.Response, error) {
+				gotPrompt, gotModel = prompt, cfg.ModelOrDefault()
+				return &ai.Response{Text: "Hi!"}, nil
+			}
+
+			err := run(opts)
+			if tt.wantCode != ExitSuccess {
+				if exitErr, ok := err.(*exitError); !ok || exitErr.code != tt.wantCode {
+					t.Fatalf("expected exit code %d, got: %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotPrompt != tt.wantPrompt || gotModel != tt.wantModel {
+				t.Errorf("expected prompt %q for %s, got %q for %s", tt.wantPrompt, tt.wantModel, gotPrompt, gotModel)
+			}
+			if stdout.String() != "Hi!\n" {
+				t.Errorf("expected the response on stdout, got %q", stdout.String())
+			}
+		})
+	}
 }